@@ -0,0 +1,262 @@
+package cli
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spiffe/aws-spiffe-workload-helper/credentialprovider"
+	"github.com/spiffe/aws-spiffe-workload-helper/vendoredaws"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// defaultAssumeRoleSessionDuration is the lifetime of the credentials
+// returned by sts:AssumeRole when the hop does not set a session duration.
+const defaultAssumeRoleSessionDuration = time.Hour
+
+// stsIdentifierInvalidChars matches the characters which are not permitted
+// in an STS role session name or source identity.
+var stsIdentifierInvalidChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// stsIdentifier converts a SPIFFE ID into a value that can be used as an STS
+// role session name or source identity.
+func stsIdentifier(id spiffeid.ID) string {
+	return sanitizeSTSIdentifier(strings.TrimPrefix(id.String(), "spiffe://"))
+}
+
+// sanitizeSTSIdentifier makes s usable as an STS role session name or source
+// identity, by replacing disallowed characters and truncating it to the
+// maximum length of 64 characters.
+func sanitizeSTSIdentifier(s string) string {
+	s = stsIdentifierInvalidChars.ReplaceAllString(s, "-")
+	if len(s) > 64 {
+		s = s[:64]
+	}
+	return s
+}
+
+// assumeRoleHop is a sts:AssumeRole call made using the credentials obtained
+// by exchanging the SVID, or by the previous hop in the chain.
+type assumeRoleHop struct {
+	RoleARN    string `yaml:"role_arn"`
+	ExternalID string `yaml:"external_id"`
+	// RoleSessionName defaults to the SPIFFE ID of the SVID.
+	RoleSessionName string `yaml:"session_name"`
+	// Policy is an inline session policy, as a JSON document.
+	Policy string            `yaml:"policy"`
+	Tags   map[string]string `yaml:"tags"`
+	// SourceIdentity defaults to the SPIFFE ID of the SVID.
+	SourceIdentity  string `yaml:"source_identity"`
+	SessionDuration int    `yaml:"session_duration"`
+	Region          string `yaml:"region"`
+	Endpoint        string `yaml:"endpoint"`
+}
+
+// parseAssumeRoleHop parses the value of an --assume-role flag, which is a
+// comma-separated list of key=value pairs. Pairs are split as a CSV record,
+// so a pair whose value contains a comma can be enclosed in double quotes,
+// e.g. role-arn=...,"external-id=a,b".
+func parseAssumeRoleHop(spec string) (assumeRoleHop, error) {
+	hop := assumeRoleHop{}
+	records, err := csv.NewReader(strings.NewReader(spec)).ReadAll()
+	if err != nil {
+		return hop, fmt.Errorf("splitting key=value pairs: %w", err)
+	}
+	if len(records) != 1 {
+		return hop, fmt.Errorf("expected a single line of key=value pairs, got %q", spec)
+	}
+	for _, field := range records[0] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return hop, fmt.Errorf("expected key=value, got %q", field)
+		}
+		switch key {
+		case "role-arn":
+			hop.RoleARN = value
+		case "external-id":
+			hop.ExternalID = value
+		case "session-name":
+			hop.RoleSessionName = value
+		case "policy-file":
+			b, err := os.ReadFile(value)
+			if err != nil {
+				return hop, fmt.Errorf("reading policy file: %w", err)
+			}
+			hop.Policy = string(b)
+		case "tag":
+			tagKey, tagValue, ok := strings.Cut(value, "=")
+			if !ok {
+				return hop, fmt.Errorf("expected tag=key=value, got %q", field)
+			}
+			if hop.Tags == nil {
+				hop.Tags = map[string]string{}
+			}
+			hop.Tags[tagKey] = tagValue
+		case "source-identity":
+			hop.SourceIdentity = value
+		case "session-duration":
+			d, err := strconv.Atoi(value)
+			if err != nil {
+				return hop, fmt.Errorf("parsing session-duration: %w", err)
+			}
+			hop.SessionDuration = d
+		case "region":
+			hop.Region = value
+		case "endpoint":
+			hop.Endpoint = value
+		default:
+			return hop, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	if err := hop.validate(); err != nil {
+		return hop, err
+	}
+	return hop, nil
+}
+
+// config returns the configuration of the sts:AssumeRole call, given the
+// SPIFFE ID of the SVID.
+func (h assumeRoleHop) config(svidID spiffeid.ID) credentialprovider.AssumeRoleConfig {
+	cfg := credentialprovider.AssumeRoleConfig{
+		RoleARN:         h.RoleARN,
+		RoleSessionName: h.RoleSessionName,
+		ExternalID:      h.ExternalID,
+		SourceIdentity:  h.SourceIdentity,
+		Policy:          h.Policy,
+		Tags:            h.Tags,
+		SessionDuration: time.Duration(h.SessionDuration) * time.Second,
+		Region:          h.Region,
+		Endpoint:        h.Endpoint,
+	}
+	if cfg.RoleSessionName == "" {
+		cfg.RoleSessionName = stsIdentifier(svidID)
+	}
+	if cfg.SourceIdentity == "" {
+		cfg.SourceIdentity = stsIdentifier(svidID)
+	}
+	return cfg
+}
+
+// validate checks that the role ARN can be parsed, and that the STS endpoint
+// to call can be determined from it or the region.
+func (h assumeRoleHop) validate() error {
+	if h.RoleARN == "" {
+		return fmt.Errorf("role-arn is required")
+	}
+	return credentialprovider.ValidateAssumeRoleConfig(h.config(spiffeid.ID{}))
+}
+
+// assume calls sts:AssumeRole using the provided credentials.
+func (h assumeRoleHop) assume(
+	ctx context.Context,
+	creds vendoredaws.CredentialProcessOutput,
+	svidID spiffeid.ID,
+) (vendoredaws.CredentialProcessOutput, error) {
+	out, err := credentialprovider.AssumeRole(ctx, creds, h.config(svidID))
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("calling sts:AssumeRole: %w", err)
+	}
+	return out, nil
+}
+
+// assumeRoleChain is a sequence of sts:AssumeRole calls made after the SVID
+// has been exchanged for AWS credentials. This allows a workload to obtain
+// credentials for a role in another account to the one trusting the SVID.
+type assumeRoleChain []assumeRoleHop
+
+// assume calls each hop of the chain in turn, starting with the credentials
+// obtained by exchanging the SVID, and returns the credentials from the final
+// hop. If the chain is empty, the credentials are returned unchanged.
+func (c assumeRoleChain) assume(
+	ctx context.Context,
+	creds vendoredaws.CredentialProcessOutput,
+	svidID spiffeid.ID,
+) (vendoredaws.CredentialProcessOutput, error) {
+	for i, hop := range c {
+		slog.Debug(
+			"Assuming role",
+			"hop", i+1,
+			"role_arn", hop.RoleARN,
+		)
+		var err error
+		creds, err = hop.assume(ctx, creds, svidID)
+		if err != nil {
+			return vendoredaws.CredentialProcessOutput{}, classifyError(
+				errorClassAssumeRole,
+				fmt.Errorf("assuming role %q (hop %d): %w", hop.RoleARN, i+1, err),
+			)
+		}
+		slog.Debug(
+			"Assumed role",
+			"hop", i+1,
+			"role_arn", hop.RoleARN,
+			"expiration", creds.Expiration,
+		)
+	}
+	return creds, nil
+}
+
+// roleARN returns the ARN of the role that the final credentials belong to,
+// given the ARN of the role that the SVID was exchanged for.
+func (c assumeRoleChain) roleARN(initial string) string {
+	if len(c) == 0 {
+		return initial
+	}
+	return c[len(c)-1].RoleARN
+}
+
+// sessionDuration returns the lifetime of the final credentials, given the
+// session duration of the credentials that the SVID was exchanged for.
+func (c assumeRoleChain) sessionDuration(initial time.Duration) time.Duration {
+	if len(c) == 0 {
+		return initial
+	}
+	if d := c[len(c)-1].SessionDuration; d != 0 {
+		return time.Duration(d) * time.Second
+	}
+	return defaultAssumeRoleSessionDuration
+}
+
+// assumeRoleFlag implements pflag.Value for the repeatable --assume-role
+// flag, appending a hop to the chain each time it is set.
+type assumeRoleFlag struct {
+	chain *assumeRoleChain
+	specs []string
+}
+
+func (f *assumeRoleFlag) Set(spec string) error {
+	hop, err := parseAssumeRoleHop(spec)
+	if err != nil {
+		return err
+	}
+	*f.chain = append(*f.chain, hop)
+	f.specs = append(f.specs, spec)
+	return nil
+}
+
+func (f *assumeRoleFlag) String() string {
+	if len(f.specs) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(f.specs, " ") + "]"
+}
+
+// GetSlice returns the specs passed to each --assume-role flag, in order.
+func (f *assumeRoleFlag) GetSlice() []string {
+	return f.specs
+}
+
+func (f *assumeRoleFlag) Type() string {
+	return "stringArray"
+}
+
+const assumeRoleFlagUsage = "Assumes a role using sts:AssumeRole after exchanging the SVID. Can be repeated to chain several roles, in order. " +
+	"Accepts comma-separated key=value pairs: role-arn (required), external-id, session-name, policy-file, tag=<key>=<value> (repeatable), " +
+	"source-identity, session-duration, region and endpoint. A pair whose value contains a comma must be enclosed in double quotes, e.g. \"tag=teams=a,b\". The session name and source identity default to the SPIFFE ID of the SVID. " +
+	"The region defaults to the main region of the partition of the role, e.g. us-east-1 for aws."
@@ -0,0 +1,338 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// configEnvPrefix prefixes the environment variable which sets each flag.
+// For example, --role-arn can be set with AWS_SPIFFE_ROLE_ARN.
+const configEnvPrefix = "AWS_SPIFFE_"
+
+// envExcludedFlags are the flags which cannot be set from the environment.
+var envExcludedFlags = []string{
+	"help",
+	"version",
+}
+
+// configExcludedFlags are the flags which cannot be set from the config file.
+var configExcludedFlags = append([]string{"config"}, envExcludedFlags...)
+
+// configSourceAnnotation marks flags which were set from an environment
+// variable or the config file, rather than on the command line.
+const configSourceAnnotation = "aws-spiffe-workload-helper/config-source"
+
+// setOnCommandLine reports whether f was set on the command line.
+func setOnCommandLine(f *pflag.Flag) bool {
+	_, fromConfig := f.Annotations[configSourceAnnotation]
+	return f.Changed && !fromConfig
+}
+
+// envVarForFlag returns the name of the environment variable which sets the
+// named flag.
+func envVarForFlag(name string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// configKey returns the key used in the config file for a flag or command
+// name.
+func configKey(name string) string {
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// applyConfig sets the flags of cmd which were not set on the command line,
+// first from AWS_SPIFFE_* environment variables and then from the config file
+// named by the config flag. Flags set on the command line take precedence over
+// environment variables, which take precedence over the config file.
+//
+// As flags set this way are marked as changed, they satisfy cobra's check for
+// required flags, which runs afterwards. They are also annotated, so that
+// setOnCommandLine can tell them apart from flags set on the command line.
+func applyConfig(cmd *cobra.Command) error {
+	flags := cmd.Flags()
+	commandLine := map[string]bool{}
+	flags.Visit(func(f *pflag.Flag) {
+		commandLine[f.Name] = true
+	})
+	defer flags.Visit(func(f *pflag.Flag) {
+		if commandLine[f.Name] {
+			return
+		}
+		if f.Annotations == nil {
+			f.Annotations = map[string][]string{}
+		}
+		f.Annotations[configSourceAnnotation] = nil
+	})
+
+	var errs []error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Changed || slices.Contains(envExcludedFlags, f.Name) {
+			return
+		}
+		env := envVarForFlag(f.Name)
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return
+		}
+		if err := flags.Set(f.Name, value); err != nil {
+			errs = append(errs, fmt.Errorf("environment variable %s: %w", env, err))
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	configFlag := flags.Lookup("config")
+	if configFlag == nil || configFlag.Value.String() == "" {
+		return nil
+	}
+	path := configFlag.Value.String()
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if err := cfg.apply(cmd); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// configFile is a parsed config file. Top-level keys set the flag with the
+// same name, with dashes replaced by underscores. A key naming a command holds
+// settings which only apply to that command and its subcommands, and which
+// take precedence over the top-level settings. For example:
+//
+//	workload_api_addr: unix:///run/spire/agent.sock
+//	role_arn: arn:aws:iam::123456789012:role/example
+//	x509_credential_file:
+//	  aws_credentials_path: /home/user/.aws/credentials
+//
+// Settings for flags that the running command does not have are ignored, so
+// that one file can be shared by several commands.
+//
+// Files are YAML, unless their extension is .toml. TOML files are converted
+// to the same tree of YAML nodes, so that both are applied in the same way.
+type configFile struct {
+	root *yaml.Node
+}
+
+func loadConfigFile(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	var root *yaml.Node
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		root, err = parseTOMLConfig(data)
+	} else {
+		root, err = parseYAMLConfig(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	return &configFile{root: root}, nil
+}
+
+// parseYAMLConfig parses a YAML config file into its top-level mapping, or
+// nil if the file is empty.
+func parseYAMLConfig(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		// The file is empty.
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected a mapping of settings", root.Line)
+	}
+	return root, nil
+}
+
+// parseTOMLConfig parses a TOML config file, and converts it to a YAML
+// mapping. The nodes of the mapping carry no line numbers, as the TOML
+// decoder does not report where each key was defined.
+func parseTOMLConfig(data []byte) (*yaml.Node, error) {
+	settings := map[string]any{}
+	if err := toml.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("parsing: %w", err)
+	}
+	var root yaml.Node
+	if err := root.Encode(settings); err != nil {
+		return nil, fmt.Errorf("converting: %w", err)
+	}
+	clearLines(&root)
+	return &root, nil
+}
+
+// clearLines clears the line numbers that encoding assigns to node and its
+// descendants, which do not match the lines of the original file.
+func clearLines(node *yaml.Node) {
+	node.Line, node.Column = 0, 0
+	for _, child := range node.Content {
+		clearLines(child)
+	}
+}
+
+// atLine prefixes an error message with the line node was read from, if it
+// is known.
+func atLine(node *yaml.Node) string {
+	if node.Line == 0 {
+		return ""
+	}
+	return fmt.Sprintf("line %d: ", node.Line)
+}
+
+// apply sets the flags of cmd which have not already been set from the
+// sections of the config file which apply to cmd.
+func (c *configFile) apply(cmd *cobra.Command) error {
+	if c.root == nil {
+		return nil
+	}
+	if err := validateConfigSection(c.root, cmd.Root(), ""); err != nil {
+		return err
+	}
+
+	// Collect the sections which apply to cmd, from the top-level section
+	// to the section for cmd itself.
+	var path []*cobra.Command
+	for p := cmd; p.HasParent(); p = p.Parent() {
+		path = append([]*cobra.Command{p}, path...)
+	}
+	sections := []*yaml.Node{c.root}
+	for _, p := range path {
+		section := mappingValue(sections[len(sections)-1], configKey(p.Name()))
+		if section == nil {
+			break
+		}
+		sections = append(sections, section)
+	}
+
+	// The most specific section is applied first, so that its settings
+	// take precedence.
+	flags := cmd.Flags()
+	for i := len(sections) - 1; i >= 0; i-- {
+		section := sections[i]
+		for j := 0; j < len(section.Content); j += 2 {
+			key, value := section.Content[j], section.Content[j+1]
+			f := flags.Lookup(strings.ReplaceAll(key.Value, "_", "-"))
+			if f == nil || f.Changed || value.Kind == yaml.MappingNode {
+				continue
+			}
+			if err := setFlagFromConfig(flags, f, value); err != nil {
+				return fmt.Errorf("%s%s: %w", atLine(key), key.Value, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setFlagFromConfig sets a flag from a config file value. A list may be given
+// for flags which accept several values, such as --assume-role.
+func setFlagFromConfig(flags *pflag.FlagSet, f *pflag.Flag, value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		return flags.Set(f.Name, value.Value)
+	case yaml.SequenceNode:
+		items := make([]string, len(value.Content))
+		for i, item := range value.Content {
+			if item.Kind != yaml.ScalarNode {
+				return fmt.Errorf("%sexpected a single value", atLine(item))
+			}
+			items[i] = item.Value
+		}
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			if err := sv.Replace(items); err != nil {
+				return fmt.Errorf("invalid argument %q for %q flag: %w", items, "--"+f.Name, err)
+			}
+			f.Changed = true
+			return nil
+		}
+		if f.Value.Type() != "stringArray" {
+			return errors.New("expected a single value, not a list")
+		}
+		for _, item := range items {
+			if err := flags.Set(f.Name, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return errors.New("expected a value or list of values")
+	}
+}
+
+// validateConfigSection checks that every key in the section for cmd is
+// either a flag accepted by cmd or one of its subcommands, or a section for a
+// subcommand. prefix is the path of the section, for error messages.
+func validateConfigSection(section *yaml.Node, cmd *cobra.Command, prefix string) error {
+	known := map[string]bool{}
+	collectFlagNames(cmd, known)
+	for p := cmd; p != nil; p = p.Parent() {
+		p.PersistentFlags().VisitAll(func(f *pflag.Flag) {
+			known[f.Name] = true
+		})
+	}
+	for _, name := range configExcludedFlags {
+		delete(known, name)
+	}
+
+	for i := 0; i < len(section.Content); i += 2 {
+		key, value := section.Content[i], section.Content[i+1]
+		if sub := findSubcommand(cmd, key.Value); sub != nil {
+			if value.Kind != yaml.MappingNode {
+				return fmt.Errorf("%s%s%s: expected a mapping of settings for the %s command", atLine(key), prefix, key.Value, sub.CommandPath())
+			}
+			if err := validateConfigSection(value, sub, prefix+key.Value+"."); err != nil {
+				return err
+			}
+			continue
+		}
+		if !known[strings.ReplaceAll(key.Value, "_", "-")] || strings.Contains(key.Value, "-") {
+			return fmt.Errorf("%s%s%s: unknown setting", atLine(key), prefix, key.Value)
+		}
+	}
+	return nil
+}
+
+// collectFlagNames adds the names of the flags accepted by cmd and its
+// subcommands to names.
+func collectFlagNames(cmd *cobra.Command, names map[string]bool) {
+	cmd.LocalFlags().VisitAll(func(f *pflag.Flag) {
+		names[f.Name] = true
+	})
+	for _, sub := range cmd.Commands() {
+		collectFlagNames(sub, names)
+	}
+}
+
+func findSubcommand(cmd *cobra.Command, key string) *cobra.Command {
+	for _, sub := range cmd.Commands() {
+		if configKey(sub.Name()) == key {
+			return sub
+		}
+	}
+	return nil
+}
+
+// mappingValue returns the value of key in a mapping node, or nil if it is
+// not present or is not itself a mapping.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i < len(node.Content); i += 2 {
+		if node.Content[i].Value == key && node.Content[i+1].Kind == yaml.MappingNode {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
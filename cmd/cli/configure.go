@@ -0,0 +1,200 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spiffe/aws-spiffe-workload-helper/internal"
+)
+
+// safeCredentialProcessArg matches arguments which do not need quoting in a
+// credential_process line.
+var safeCredentialProcessArg = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// quoteCredentialProcessArg quotes an argument for use in a credential_process
+// line. The AWS SDKs and CLIs split the line in different ways, so only
+// double quotes are used, and characters which they treat differently are
+// rejected. '#' and ';' are also rejected, as they begin comments in the
+// config file.
+func quoteCredentialProcessArg(arg string) (string, error) {
+	if safeCredentialProcessArg.MatchString(arg) {
+		return arg, nil
+	}
+	if strings.ContainsAny(arg, "\"\\$`#;\n\r") {
+		return "", fmt.Errorf("argument %q contains characters which cannot be used in credential_process", arg)
+	}
+	return `"` + arg + `"`, nil
+}
+
+type configureFlags struct {
+	awsConfigPath string
+	profileName   string
+	awsRegion     string
+	executable    string
+	force         bool
+	replace       bool
+}
+
+func (f *configureFlags) addFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&f.awsConfigPath, "aws-config-path", "", "The path to the AWS config file to write. Defaults to the value of the AWS_CONFIG_FILE environment variable, or ~/.aws/config.")
+	cmd.PersistentFlags().StringVar(&f.profileName, "aws-profile", "default", "The name of the profile to write within the AWS config file.")
+	cmd.PersistentFlags().StringVar(&f.awsRegion, "aws-region", "", "The region to configure for the profile. Optional.")
+	cmd.PersistentFlags().StringVar(&f.executable, "executable", "", "The path to the aws-spiffe-workload-helper binary to invoke from credential_process. Defaults to the path of the running binary.")
+	cmd.PersistentFlags().BoolVar(&f.force, "force", false, "If set, failures loading the existing AWS config file will be ignored and the contents overwritten.")
+	cmd.PersistentFlags().BoolVar(&f.replace, "replace", false, "If set, the AWS config file will be replaced if it exists. This will remove any profiles not written by this tool.")
+}
+
+func (f *configureFlags) configPath() (string, error) {
+	if f.awsConfigPath != "" {
+		return f.awsConfigPath, nil
+	}
+	if path := os.Getenv("AWS_CONFIG_FILE"); path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("determining home directory: %w", err)
+	}
+	return filepath.Join(home, ".aws", "config"), nil
+}
+
+// credentialProcess builds a credential_process line which invokes process
+// with the flags that were set on the command line of cmd. Flags set from
+// AWS_SPIFFE_* environment variables or the config file are not written, as
+// they belong to the environment configure was run in.
+func (f *configureFlags) credentialProcess(cmd *cobra.Command, process string) (string, error) {
+	executable := f.executable
+	if executable == "" {
+		var err error
+		executable, err = os.Executable()
+		if err != nil {
+			return "", fmt.Errorf("determining path of executable: %w", err)
+		}
+	}
+
+	args := []string{executable, process}
+	var errs []error
+	cmd.LocalNonPersistentFlags().VisitAll(func(fl *pflag.Flag) {
+		if !setOnCommandLine(fl) {
+			return
+		}
+		switch v := fl.Value.(type) {
+		case *sessionPolicyFlag:
+			// An inline policy contains double quotes, which cannot be
+			// used in credential_process.
+			if strings.HasPrefix(strings.TrimSpace(v.value), "{") {
+				errs = append(errs, fmt.Errorf("--%s: an inline session policy cannot be used in credential_process, pass the path to a file containing it instead", fl.Name))
+				return
+			}
+			args = append(args, "--"+fl.Name, v.value)
+		case interface{ GetSlice() []string }:
+			for _, s := range v.GetSlice() {
+				args = append(args, "--"+fl.Name, s)
+			}
+		default:
+			if fl.Value.Type() == "bool" {
+				args = append(args, "--"+fl.Name+"="+fl.Value.String())
+				return
+			}
+			args = append(args, "--"+fl.Name, fl.Value.String())
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return "", err
+	}
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		q, err := quoteCredentialProcessArg(arg)
+		if err != nil {
+			return "", err
+		}
+		quoted[i] = q
+	}
+	return strings.Join(quoted, " "), nil
+}
+
+func (f *configureFlags) run(cmd *cobra.Command, process string) error {
+	credentialProcess, err := f.credentialProcess(cmd, process)
+	if err != nil {
+		return fmt.Errorf("building credential_process: %w", err)
+	}
+	path, err := f.configPath()
+	if err != nil {
+		return err
+	}
+	err = internal.UpsertAWSConfigFileProfile(
+		slog.Default(),
+		internal.AWSCredentialsFileConfig{
+			Path:        path,
+			ProfileName: f.profileName,
+			Force:       f.force,
+			ReplaceFile: f.replace,
+		},
+		internal.AWSConfigFileProfile{
+			CredentialProcess: credentialProcess,
+			Region:            f.awsRegion,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("writing profile to config file: %w", err)
+	}
+	slog.Info(
+		"Wrote AWS config profile",
+		"path", path,
+		"profile", f.profileName,
+		"credential_process", credentialProcess,
+	)
+	return nil
+}
+
+func newConfigureCmd() (*cobra.Command, error) {
+	f := &configureFlags{}
+	cmd := &cobra.Command{
+		Use:   "configure",
+		Short: `Writes a profile to the AWS config file which obtains credentials using this tool.`,
+		Long:  `Writes a profile to the AWS config file which obtains credentials by invoking this tool as a credential process. The flags for the chosen flow are validated, and those given on the command line are passed through to the credential process. Inline session policies cannot be passed through, so --policy must be given the path to a file.`,
+	}
+	f.addFlags(cmd)
+
+	x509Flags := &sharedX509Flags{}
+	x509CacheFlags := &sharedCacheFlags{}
+	x509Cmd := &cobra.Command{
+		Use:   "x509",
+		Short: `Configures a profile which uses x509-credential-process.`,
+		Long:  `Configures a profile which uses x509-credential-process to exchange an X509 SVID for AWS credentials using AWS Roles Anywhere.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return f.run(cmd, "x509-credential-process")
+		},
+	}
+	if err := x509Flags.addFlags(x509Cmd); err != nil {
+		return nil, fmt.Errorf("adding shared flags: %w", err)
+	}
+	x509CacheFlags.addFlags(x509Cmd)
+	cmd.AddCommand(x509Cmd)
+
+	jwtFlags := &sharedJWTFlags{}
+	jwtCacheFlags := &sharedCacheFlags{}
+	jwtCmd := &cobra.Command{
+		Use:   "jwt",
+		Short: `Configures a profile which uses jwt-credential-process.`,
+		Long:  `Configures a profile which uses jwt-credential-process to exchange a JWT SVID for AWS credentials using AWS AssumeRoleWithWebIdentity.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return f.run(cmd, "jwt-credential-process")
+		},
+	}
+	if err := jwtFlags.addFlags(jwtCmd); err != nil {
+		return nil, fmt.Errorf("adding shared flags: %w", err)
+	}
+	jwtCacheFlags.addFlags(jwtCmd)
+	cmd.AddCommand(jwtCmd)
+
+	return cmd, nil
+}
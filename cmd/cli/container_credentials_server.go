@@ -0,0 +1,173 @@
+package cli
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+)
+
+type containerCredentialsServerFlags struct {
+	listenAddr             string
+	path                   string
+	authorizationToken     string
+	authorizationTokenFile string
+}
+
+func (f *containerCredentialsServerFlags) addFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&f.listenAddr, "listen-addr", "127.0.0.1:1339", "The address the container credentials endpoint should listen on.")
+	cmd.PersistentFlags().StringVar(&f.path, "path", "/v1/credentials", "The path the credentials are served from. This should match the path of AWS_CONTAINER_CREDENTIALS_FULL_URI.")
+	cmd.PersistentFlags().StringVar(&f.authorizationToken, "authorization-token", "", "The token that clients must present in the Authorization header. This should match AWS_CONTAINER_AUTHORIZATION_TOKEN.")
+	cmd.PersistentFlags().StringVar(&f.authorizationTokenFile, "authorization-token-file", "", "The path to a file containing the token that clients must present in the Authorization header. This should match AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE. The file is read on each request, so it can be rotated.")
+	cmd.MarkFlagsMutuallyExclusive("authorization-token", "authorization-token-file")
+}
+
+func newContainerCredentialsServerCmd() (*cobra.Command, error) {
+	f := &containerCredentialsServerFlags{}
+	cmd := &cobra.Command{
+		Use:   "container-credentials-server",
+		Short: `Serves AWS credentials obtained using an SVID from a container credentials endpoint.`,
+		Long:  `Serves AWS credentials obtained using an SVID from a container credentials endpoint, in the format used by Amazon ECS and EKS Pod Identity. AWS SDKs and CLIs can be pointed at this endpoint using AWS_CONTAINER_CREDENTIALS_FULL_URI. The credentials are renewed in the background. Use the x509 or jwt subcommand to select how the SVID is exchanged for AWS credentials.`,
+	}
+	f.addFlags(cmd)
+	df := &sharedDaemonFlags{}
+	df.addFlags(cmd.PersistentFlags())
+	if err := addSVIDSourceCmds(cmd, func(ctx context.Context, src svidCredentialSource, _ []string) error {
+		return runContainerCredentialsServer(ctx, f, df, src)
+	}); err != nil {
+		return nil, fmt.Errorf("adding source subcommands: %w", err)
+	}
+	return cmd, nil
+}
+
+func runContainerCredentialsServer(
+	ctx context.Context,
+	f *containerCredentialsServerFlags,
+	df *sharedDaemonFlags,
+	src svidCredentialSource,
+) error {
+	if err := df.validate(); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(f.path, "/") {
+		return fmt.Errorf("path must begin with '/', got %q", f.path)
+	}
+	if f.authorizationToken == "" && f.authorizationTokenFile == "" {
+		slog.Warn("No authorization token has been configured, any client able to reach the endpoint will be served credentials")
+	}
+	slog.Info("Starting container credentials server")
+	creds := newLatestCredentials()
+	srv := &containerCredentialsServer{
+		creds:                  creds,
+		authorizationToken:     f.authorizationToken,
+		authorizationTokenFile: f.authorizationTokenFile,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+f.path, srv.handleCredentials)
+
+	t := df.newTelemetry()
+	g, ctx := errgroup.WithContext(ctx)
+	t.serve(ctx, g)
+	g.Go(func() error {
+		src, onRenew, onRevoke := t.instrument(src, profileID{}, creds.set, creds.clear)
+		return renewCredentials(ctx, src, onRenew, onRevoke, &df.retry, &df.renewal)
+	})
+	g.Go(func() error {
+		return serveHTTP(ctx, f.listenAddr, &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		})
+	})
+	return g.Wait()
+}
+
+// containerCredentialsServer serves credentials in the format expected by
+// the AWS SDK container credentials provider.
+type containerCredentialsServer struct {
+	creds                  *latestCredentials
+	authorizationToken     string
+	authorizationTokenFile string
+}
+
+// containerCredentialsResponse is the document returned by the container
+// credentials endpoint.
+type containerCredentialsResponse struct {
+	AccessKeyId     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	Expiration      string `json:"Expiration"`
+	AccountId       string `json:"AccountId,omitempty"`
+}
+
+// containerCredentialsError is the document returned by the container
+// credentials endpoint when a request fails. The SDKs include it in the error
+// they surface.
+type containerCredentialsError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (s *containerCredentialsServer) handleCredentials(w http.ResponseWriter, r *http.Request) {
+	authorized, err := s.authorized(r)
+	if err != nil {
+		slog.Error("Failed to check authorization of container credentials request", "error", err)
+		writeJSON(w, http.StatusInternalServerError, containerCredentialsError{
+			Code:    "InternalError",
+			Message: "Failed to check authorization token",
+		})
+		return
+	}
+	if !authorized {
+		writeJSON(w, http.StatusUnauthorized, containerCredentialsError{
+			Code:    "AccessDenied",
+			Message: "Missing or invalid authorization token",
+		})
+		return
+	}
+
+	creds, _, err := s.creds.get(r.Context())
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, containerCredentialsError{
+			Code:    "ServiceUnavailable",
+			Message: "AWS credentials are not available",
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, containerCredentialsResponse{
+		AccessKeyId:     creds.credentials.AccessKeyId,
+		SecretAccessKey: creds.credentials.SecretAccessKey,
+		Token:           creds.credentials.SessionToken,
+		Expiration:      creds.credentials.Expiration,
+		AccountId:       creds.accountID,
+	})
+}
+
+// authorized returns whether the request carries the configured
+// authorization token. If no token is configured, all requests are
+// authorized.
+func (s *containerCredentialsServer) authorized(r *http.Request) (bool, error) {
+	want := s.authorizationToken
+	if s.authorizationTokenFile != "" {
+		b, err := os.ReadFile(s.authorizationTokenFile)
+		if err != nil {
+			return false, fmt.Errorf("reading authorization token file: %w", err)
+		}
+		want = strings.TrimSpace(string(b))
+		if want == "" {
+			return false, fmt.Errorf("authorization token file %q is empty", s.authorizationTokenFile)
+		}
+	}
+	if want == "" {
+		return true, nil
+	}
+	got := r.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1, nil
+}
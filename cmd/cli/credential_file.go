@@ -4,46 +4,39 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spiffe/aws-spiffe-workload-helper/internal"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"golang.org/x/sync/errgroup"
 )
 
 func newX509CredentialFileOneshotCmd() (*cobra.Command, error) {
-	force := false
-	replace := false
-	awsCredentialsPath := ""
 	sf := &sharedX509Flags{}
+	cf := &sharedCredentialFileFlags{}
 	cmd := &cobra.Command{
 		Use:   "x509-credential-file-oneshot",
 		Short: `Exchanges an X509 SVID for a short-lived set of AWS credentials using AWS Roles Anywhere. Writes the credentials to a file in the 'credential file' format expected by the AWS CLI and SDKs.`,
 		Long:  `Exchanges an X509 SVID for a short-lived set of AWS credentials using AWS Roles Anywhere. Writes the credentials to a file in the 'credential file' format expected by the AWS CLI and SDKs.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return oneshotX509CredentialFile(
-				cmd.Context(), force, replace, awsCredentialsPath, sf,
+				cmd.Context(), cf, sf,
 			)
 		},
 	}
 	if err := sf.addFlags(cmd); err != nil {
 		return nil, fmt.Errorf("adding shared flags: %w", err)
 	}
-	cmd.Flags().StringVar(&awsCredentialsPath, "aws-credentials-path", "", "The path to the AWS credentials file to write.")
-	if err := cmd.MarkFlagRequired("aws-credentials-path"); err != nil {
-		return nil, fmt.Errorf("marking aws-credentials-path flag as required: %w", err)
+	if err := cf.addFlags(cmd); err != nil {
+		return nil, fmt.Errorf("adding credential file flags: %w", err)
 	}
-	cmd.Flags().BoolVar(&force, "force", false, "If set, failures loading the existing AWS credentials file will be ignored and the contents overwritten.")
-	cmd.Flags().BoolVar(&replace, "replace", false, "If set, the AWS credentials file will be replaced if it exists. This will remove any profiles not written by this tool.")
 
 	return cmd, nil
 }
 
 func oneshotX509CredentialFile(
 	ctx context.Context,
-	force bool,
-	replace bool,
-	awsCredentialsPath string,
+	cf *sharedCredentialFileFlags,
 	sf *sharedX509Flags,
 ) error {
 	client, err := workloadapi.New(
@@ -64,190 +57,87 @@ func oneshotX509CredentialFile(
 	if err != nil {
 		return fmt.Errorf("fetching x509 context: %w", err)
 	}
-	svid := x509Ctx.DefaultSVID()
+	svid, err := sf.selectX509SVID(x509Ctx)
+	if err != nil {
+		return err
+	}
 	slog.Info(
 		"Fetched X509 SVID",
 		"svid", svidValue(svid),
 	)
 
-	credentials, err := exchangeX509SVIDForAWSCredentials(sf, svid)
+	credentials, err := exchangeX509SVIDForAWSCredentials(ctx, sf, svid)
 	if err != nil {
 		return fmt.Errorf("exchanging X509 SVID for AWS credentials: %w", err)
 	}
 
-	expiresAt, err := time.Parse(time.RFC3339, credentials.Expiration)
+	creds, err := newExchangedX509Credentials(credentials, sf.assumeRoles.roleARN(sf.roleARN), svid)
 	if err != nil {
-		return fmt.Errorf("parsing expiration time: %w", err)
+		return err
 	}
 
-	// Now we write this to disk in the format that the AWS CLI/SDK
-	// expects for a credentials file.
-	err = internal.UpsertAWSCredentialsFileProfile(
-		slog.Default(),
-		internal.AWSCredentialsFileConfig{
-			Path:        awsCredentialsPath,
-			Force:       force,
-			ReplaceFile: replace,
-		},
-		internal.AWSCredentialsFileProfile{
-			AWSAccessKeyID:     credentials.AccessKeyId,
-			AWSSecretAccessKey: credentials.SecretAccessKey,
-			AWSSessionToken:    credentials.SessionToken,
-		},
-	)
-	if err != nil {
-		return fmt.Errorf("writing credentials to file: %w", err)
+	if err := cf.writeCredentials(creds); err != nil {
+		return err
 	}
 	slog.Info(
 		"Wrote AWS credential to file",
-		"path", awsCredentialsPath,
-		"aws_expires_at", expiresAt,
+		"path", cf.awsCredentialsPath,
+		"aws_expires_at", creds.expiresAt,
 	)
 	return nil
 }
 
 func newX509CredentialFileCmd() (*cobra.Command, error) {
-	force := false
-	replace := false
-	awsCredentialsPath := ""
 	sf := &sharedX509Flags{}
+	cf := &sharedCredentialFileFlags{}
+	df := &sharedDaemonFlags{}
 	cmd := &cobra.Command{
 		Use:   "x509-credential-file",
 		Short: `On a regular basis, this daemon exchanges an X509 SVID for a short-lived set of AWS credentials using AWS Roles Anywhere. Writes the credentials to a file in the 'credential file' format expected by the AWS CLI and SDKs.`,
 		Long:  `On a regular basis, this daemon exchanges an X509 SVID for a short-lived set of AWS credentials using AWS Roles Anywhere. Writes the credentials to a file in the 'credential file' format expected by the AWS CLI and SDKs.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return daemonX509CredentialFile(
-				cmd.Context(), force, replace, awsCredentialsPath, sf,
-			)
+			return daemonX509CredentialFile(cmd.Context(), cf, sf, df)
 		},
 	}
 	if err := sf.addFlags(cmd); err != nil {
 		return nil, fmt.Errorf("adding shared flags: %w", err)
 	}
-	cmd.Flags().StringVar(&awsCredentialsPath, "aws-credentials-path", "", "The path to the AWS credentials file to write.")
-	if err := cmd.MarkFlagRequired("aws-credentials-path"); err != nil {
-		return nil, fmt.Errorf("marking aws-credentials-path flag as required: %w", err)
+	if err := cf.addFlags(cmd); err != nil {
+		return nil, fmt.Errorf("adding credential file flags: %w", err)
 	}
-	cmd.Flags().BoolVar(&force, "force", false, "If set, failures loading the existing AWS credentials file will be ignored and the contents overwritten.")
-	cmd.Flags().BoolVar(&replace, "replace", false, "If set, the AWS credentials file will be replaced if it exists. This will remove any profiles not written by this tool.")
+	cf.addDaemonFlags(cmd)
+	df.addFlags(cmd.Flags())
 
 	return cmd, nil
 }
 
 func daemonX509CredentialFile(
 	ctx context.Context,
-	force bool,
-	replace bool,
-	awsCredentialsPath string,
+	cf *sharedCredentialFileFlags,
 	sf *sharedX509Flags,
+	df *sharedDaemonFlags,
 ) error {
-	slog.Info("Starting AWS credential file daemon")
-	client, err := workloadapi.New(
-		ctx,
-		workloadapi.WithAddr(sf.workloadAPIAddr),
-		workloadapi.WithLogger(internal.NewSPIFFESlogAdapter(slog.Default())),
-	)
-	if err != nil {
-		return fmt.Errorf("creating workload api client: %w", err)
-	}
-	defer func() {
-		if err := client.Close(); err != nil {
-			slog.Warn("Failed to close workload API client", "error", err)
-		}
-	}()
-
-	slog.Debug("Fetching initial X509 SVID")
-	x509Source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClient(client))
-	if err != nil {
-		return fmt.Errorf("creating x509 source: %w", err)
+	if err := df.validate(); err != nil {
+		return err
 	}
-	defer func() {
-		if err := x509Source.Close(); err != nil {
-			slog.Warn("Failed to close x509 source", "error", err)
-		}
-	}()
-
-	svidUpdate := x509Source.Updated()
-	svid, err := x509Source.GetX509SVID()
-	if err != nil {
-		return fmt.Errorf("fetching initial X509 SVID: %w", err)
-	}
-	slog.Info("Fetched initial X509 SVID", "svid", svidValue(svid))
-
-	for {
-		slog.Debug(
-			"Exchanging X509 SVID for AWS credentials",
-			"svid", svidValue(svid),
-		)
-		credentials, err := exchangeX509SVIDForAWSCredentials(sf, svid)
-		if err != nil {
-			return fmt.Errorf("exchanging X509 SVID for AWS credentials: %w", err)
-		}
-		slog.Info(
-			"Successfully exchanged X509 SVID for AWS credentials",
-			"svid", svidValue(svid),
-		)
-
-		expiresAt, err := time.Parse(time.RFC3339, credentials.Expiration)
+	slog.Info("Starting AWS credential file daemon")
+	t := df.newTelemetry()
+	g, ctx := errgroup.WithContext(ctx)
+	t.serve(ctx, g)
+	g.Go(func() error {
+		src, err := newX509CredentialSource(ctx, sf)
 		if err != nil {
-			return fmt.Errorf("parsing expiration time: %w", err)
+			return err
 		}
+		defer src.close()
 
-		slog.Debug("Writing AWS credentials to file", "path", awsCredentialsPath)
-		err = internal.UpsertAWSCredentialsFileProfile(
-			slog.Default(),
-			internal.AWSCredentialsFileConfig{
-				Path:        awsCredentialsPath,
-				Force:       force,
-				ReplaceFile: replace,
-			},
-			internal.AWSCredentialsFileProfile{
-				AWSAccessKeyID:     credentials.AccessKeyId,
-				AWSSecretAccessKey: credentials.SecretAccessKey,
-				AWSSessionToken:    credentials.SessionToken,
-			},
+		instrumented, write, remove := t.instrument(
+			src,
+			profileID{},
+			t.metrics.instrumentFileWrite(cf.writeRenewedCredentials, src.kind(), profileID{}),
+			cf.removeCredentials,
 		)
-		if err != nil {
-			return fmt.Errorf("writing credentials to file: %w", err)
-		}
-		slog.Info("Wrote AWS credentials to file", "path", awsCredentialsPath)
-
-		// Calculate next renewal time as 50% of the remaining time left on the
-		// AWS credentials.
-		// TODO(noah): This is a little crude, it may make more sense to just
-		// renew on a fixed basis (e.g every minute?). We'll go with this
-		// for now, and speak to consumers once it's in use to see if a
-		// different mechanism may be more suitable.
-		now := time.Now()
-		awsTTL := expiresAt.Sub(now)
-		renewIn := awsTTL / 2
-		awsRenewAt := now.Add(renewIn)
-
-		slog.Info(
-			"Sleeping until a new X509 SVID is received or the AWS credentials are close to expiry",
-			"aws_expires_at", expiresAt,
-			"aws_ttl", awsTTL,
-			"aws_renews_at", awsRenewAt,
-			"svid_expires_at", svid.Certificates[0].NotAfter,
-			"svid_ttl", svid.Certificates[0].NotAfter.Sub(now),
-		)
-
-		select {
-		case <-time.After(time.Until(awsRenewAt)):
-			slog.Info("Triggering renewal as AWS credentials are close to expiry")
-		case <-svidUpdate:
-			slog.Debug("Received potential X509 SVID update")
-			newSVID, err := x509Source.GetX509SVID()
-			if err != nil {
-				return fmt.Errorf("fetching updated X509 SVID: %w", err)
-			}
-			slog.Info(
-				"Received new X509 SVID from Workload API, will update AWS credentials",
-				"svid", svidValue(svid),
-			)
-			svid = newSVID
-		case <-ctx.Done():
-			return nil
-		}
-	}
+		return cf.renewCredentialsFile(ctx, instrumented, write, remove, &df.retry, &df.renewal)
+	})
+	return g.Wait()
 }
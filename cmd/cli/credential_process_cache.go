@@ -0,0 +1,174 @@
+package cli
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spiffe/aws-spiffe-workload-helper/internal"
+	"github.com/spiffe/aws-spiffe-workload-helper/vendoredaws"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// cacheKeyExcludedFlags are the flags which do not affect the credentials
+// returned, and so are excluded from the cache key.
+var cacheKeyExcludedFlags = []string{
+	"cache",
+	"cache-dir",
+	"cache-min-ttl",
+	"config",
+	"debug",
+}
+
+type sharedCacheFlags struct {
+	enabled bool
+	dir     string
+	minTTL  time.Duration
+}
+
+func (f *sharedCacheFlags) addFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&f.enabled, "cache", false, "If set, credentials are cached on disk and reused by later invocations with the same flags and SVID, until they are close to expiry or the SVID rotates.")
+	cmd.Flags().StringVar(&f.dir, "cache-dir", "", "The directory cached credentials are stored in. Implies --cache. Defaults to a directory within the user's cache directory.")
+	cmd.Flags().DurationVar(&f.minTTL, "cache-min-ttl", 20*time.Minute, "The minimum remaining lifetime that cached credentials must have to be reused. This should exceed the window in which the AWS SDKs proactively refresh credentials. If it is not less than the session duration, half of the session duration is used instead.")
+}
+
+// effectiveMinTTL returns the minimum remaining lifetime for cached
+// credentials with the given session duration to be reused. If the configured
+// minimum is not less than the session duration, no cached credentials could
+// ever be reused, so half of the session duration is used instead.
+func (f *sharedCacheFlags) effectiveMinTTL(flags *pflag.FlagSet, sessionDuration time.Duration) time.Duration {
+	if f.minTTL < sessionDuration {
+		return f.minTTL
+	}
+	minTTL := sessionDuration / 2
+	log := slog.Debug
+	if flags.Changed("cache-min-ttl") {
+		log = slog.Warn
+	}
+	log(
+		"The cache minimum TTL is not less than the session duration, using half of the session duration instead",
+		"cache_min_ttl", f.minTTL,
+		"session_duration", sessionDuration,
+		"effective_cache_min_ttl", minTTL,
+	)
+	return minTTL
+}
+
+func (f *sharedCacheFlags) cache() (internal.CredentialProcessCache, error) {
+	dir := f.dir
+	if dir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return internal.CredentialProcessCache{}, fmt.Errorf("determining user cache directory: %w", err)
+		}
+		dir = filepath.Join(userCacheDir, "aws-spiffe-workload-helper")
+	}
+	return internal.CredentialProcessCache{Dir: dir}, nil
+}
+
+// cachedExchange returns credentials from the cache if caching is enabled
+// and a valid entry exists for the flags and SVID. Otherwise, it calls
+// exchange and stores the result in the cache. sessionDuration is the
+// lifetime of the credentials returned by exchange. svidID is zero where the
+// SVID is only fetched by exchange, in which case entries are tied to the
+// flags alone.
+//
+// The cache entry is locked whilst this happens, so that concurrent
+// invocations only perform a single exchange.
+func (f *sharedCacheFlags) cachedExchange(
+	flags *pflag.FlagSet,
+	svidID spiffeid.ID,
+	svidFingerprint string,
+	sessionDuration time.Duration,
+	exchange func() (vendoredaws.CredentialProcessOutput, error),
+) (vendoredaws.CredentialProcessOutput, error) {
+	if !f.enabled && f.dir == "" {
+		return exchange()
+	}
+
+	cache, err := f.cache()
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, err
+	}
+	minTTL := f.effectiveMinTTL(flags, sessionDuration)
+	key := credentialCacheKey(flags, svidID)
+	unlock, err := cache.Lock(key)
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("locking cache entry: %w", err)
+	}
+	defer func() {
+		if err := unlock(); err != nil {
+			slog.Warn("Failed to unlock cache entry", "error", err)
+		}
+	}()
+
+	entry, err := cache.Load(key)
+	switch {
+	case err != nil:
+		slog.Warn("Failed to load cached credentials, they will be replaced", "error", err, "dir", cache.Dir)
+	case entry == nil:
+		slog.Debug("No cached credentials found")
+	case entry.SVIDFingerprint != svidFingerprint:
+		slog.Debug("SVID has rotated since credentials were cached")
+	default:
+		expiresAt, err := time.Parse(time.RFC3339, entry.Credentials.Expiration)
+		if err != nil {
+			slog.Warn("Failed to parse expiration of cached credentials, they will be replaced", "error", err)
+			break
+		}
+		if ttl := time.Until(expiresAt); ttl < minTTL {
+			slog.Debug("Cached credentials are close to expiry", "aws_expires_at", expiresAt)
+			break
+		}
+		slog.Debug("Using cached AWS credentials", "aws_expires_at", expiresAt)
+		return entry.Credentials, nil
+	}
+
+	credentials, err := exchange()
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, err
+	}
+	if err := cache.Store(key, internal.CredentialProcessCacheEntry{
+		SVIDFingerprint: svidFingerprint,
+		Credentials:     credentials,
+	}); err != nil {
+		slog.Warn("Failed to store credentials in cache", "error", err, "dir", cache.Dir)
+	}
+	return credentials, nil
+}
+
+// credentialCacheKey derives a cache key from the values of the flags and the
+// SPIFFE ID of the SVID, so that entries are only shared between invocations
+// which would request the same credentials.
+func credentialCacheKey(flags *pflag.FlagSet, svidID spiffeid.ID) string {
+	h := sha256.New()
+	flags.VisitAll(func(f *pflag.Flag) {
+		if slices.Contains(cacheKeyExcludedFlags, f.Name) {
+			return
+		}
+		value := f.Value.String()
+		// The session policy may be given as the path to a file, so the
+		// policy itself is used, in case the file has since changed.
+		if p, ok := f.Value.(*sessionPolicyFlag); ok {
+			value = *p.policy
+		}
+		_, _ = fmt.Fprintf(h, "%s=%s\n", f.Name, value)
+	})
+	_, _ = fmt.Fprintf(h, "spiffe-id=%s\n", svidID)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// x509SVIDFingerprint identifies an X509 SVID by the hash of its leaf
+// certificate, which changes whenever the SVID is rotated.
+func x509SVIDFingerprint(svid *x509svid.SVID) string {
+	sum := sha256.Sum256(svid.Certificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,440 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spiffe/aws-spiffe-workload-helper/internal"
+	"github.com/spiffe/aws-spiffe-workload-helper/vendoredaws"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// exchangedCredentials is a set of AWS credentials along with details of the
+// SVID that was exchanged to obtain them.
+type exchangedCredentials struct {
+	credentials vendoredaws.CredentialProcessOutput
+	expiresAt   time.Time
+	// accountID is the AWS account the credentials belong to, if known.
+	accountID string
+	// roleARN is the ARN of the role the credentials are for. When roles are
+	// chained, this is the last role assumed.
+	roleARN string
+
+	svidID        spiffeid.ID
+	svidHint      string
+	svidExpiresAt time.Time
+}
+
+func (c *exchangedCredentials) svidValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("id", c.svidID.String()),
+		slog.String("hint", c.svidHint),
+		slog.Time("expires_at", c.svidExpiresAt),
+	)
+}
+
+// Classes of failure when exchanging an SVID for AWS credentials. These are
+// used to label metrics, so must remain low in cardinality.
+const (
+	errorClassSVIDFetch          = "svid_fetch"
+	errorClassSVIDValidation     = "svid_validation"
+	errorClassAWSExchange        = "aws_exchange"
+	errorClassAssumeRole         = "assume_role"
+	errorClassInvalidCredentials = "invalid_credentials"
+	errorClassUnknown            = "unknown"
+)
+
+// classifiedError is an error annotated with the class of failure.
+type classifiedError struct {
+	class string
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// classifyError annotates err with class. If err has already been
+// classified, it is returned unchanged so that the most specific class is
+// retained.
+func classifyError(class string, err error) error {
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return err
+	}
+	return &classifiedError{class: class, err: err}
+}
+
+// errorClass returns the class of err, or errorClassUnknown if it has not
+// been classified.
+func errorClass(err error) string {
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return ce.class
+	}
+	return errorClassUnknown
+}
+
+// svidCredentialSource exchanges the current SVID of the workload for AWS
+// credentials. It allows the long-lived commands to share renewal logic
+// regardless of whether the X509 or JWT flow is in use.
+type svidCredentialSource interface {
+	// exchange fetches the current SVID and exchanges it for AWS credentials.
+	exchange(ctx context.Context) (*exchangedCredentials, error)
+	// updated returns a channel which receives when the SVID may have been
+	// rotated. Sources which are not notified of rotations return nil.
+	updated() <-chan struct{}
+	// kind returns the flow used by the source, either "x509" or "jwt".
+	kind() string
+	// close releases the resources held by the source.
+	close()
+}
+
+func newWorkloadAPIClient(ctx context.Context, addr string) (*workloadapi.Client, error) {
+	client, err := workloadapi.New(
+		ctx,
+		workloadapi.WithAddr(addr),
+		workloadapi.WithLogger(internal.NewSPIFFESlogAdapter(slog.Default())),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating workload api client: %w", err)
+	}
+	return client, nil
+}
+
+type x509CredentialSource struct {
+	sf      *sharedX509Flags
+	client  *workloadapi.Client
+	watcher *x509SVIDWatcher
+}
+
+func newX509CredentialSource(ctx context.Context, sf *sharedX509Flags) (*x509CredentialSource, error) {
+	client, err := newWorkloadAPIClient(ctx, sf.workloadAPIAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug("Fetching initial X509 SVID")
+	watcher, err := watchX509SVID(ctx, client, sf.selector())
+	if err != nil {
+		if err := client.Close(); err != nil {
+			slog.Warn("Failed to close workload API client", "error", err)
+		}
+		return nil, fmt.Errorf("creating x509 source: %w", err)
+	}
+	return &x509CredentialSource{
+		sf:      sf,
+		client:  client,
+		watcher: watcher,
+	}, nil
+}
+
+func (s *x509CredentialSource) exchange(ctx context.Context) (*exchangedCredentials, error) {
+	svid, err := s.watcher.get()
+	if err != nil {
+		return nil, classifyError(errorClassSVIDFetch, fmt.Errorf("fetching X509 SVID: %w", err))
+	}
+	slog.Debug(
+		"Exchanging X509 SVID for AWS credentials",
+		"svid", svidValue(svid),
+	)
+	credentials, err := exchangeX509SVIDForAWSCredentials(ctx, s.sf, svid)
+	if err != nil {
+		return nil, classifyError(errorClassAWSExchange, fmt.Errorf("exchanging X509 SVID for AWS credentials: %w", err))
+	}
+	slog.Info(
+		"Successfully exchanged X509 SVID for AWS credentials",
+		"svid", svidValue(svid),
+	)
+	return newExchangedX509Credentials(credentials, s.sf.assumeRoles.roleARN(s.sf.roleARN), svid)
+}
+
+func (s *x509CredentialSource) updated() <-chan struct{} {
+	return s.watcher.updated()
+}
+
+func (s *x509CredentialSource) kind() string {
+	return "x509"
+}
+
+func (s *x509CredentialSource) close() {
+	s.watcher.close()
+	if err := s.client.Close(); err != nil {
+		slog.Warn("Failed to close workload API client", "error", err)
+	}
+}
+
+type jwtCredentialSource struct {
+	sf     *sharedJWTFlags
+	client *workloadapi.Client
+}
+
+func newJWTCredentialSource(ctx context.Context, sf *sharedJWTFlags) (*jwtCredentialSource, error) {
+	client, err := newWorkloadAPIClient(ctx, sf.workloadAPIAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &jwtCredentialSource{
+		sf:     sf,
+		client: client,
+	}, nil
+}
+
+func (s *jwtCredentialSource) exchange(ctx context.Context) (*exchangedCredentials, error) {
+	svid, err := fetchJWTSVID(ctx, s.client, s.sf)
+	if err != nil {
+		return nil, classifyError(errorClassSVIDFetch, err)
+	}
+	slog.Debug(
+		"Exchanging JWT SVID for AWS credentials",
+		"svid", jwtSVIDValue(svid),
+	)
+	credentials, err := exchangeJWTSVIDForAWSCredentials(ctx, s.client, s.sf, svid)
+	if err != nil {
+		return nil, classifyError(errorClassAWSExchange, fmt.Errorf("exchanging JWT SVID for AWS credentials: %w", err))
+	}
+	slog.Info(
+		"Successfully exchanged JWT SVID for AWS credentials",
+		"svid", jwtSVIDValue(svid),
+	)
+	return newExchangedJWTCredentials(credentials, s.sf.assumeRoles.roleARN(s.sf.roleARN), svid)
+}
+
+// updated returns nil as JWT SVIDs are minted on request rather than pushed
+// by the Workload API. The renewal loop instead uses the expiry of the
+// JWT SVID to decide when to fetch a new one.
+func (s *jwtCredentialSource) updated() <-chan struct{} {
+	return nil
+}
+
+func (s *jwtCredentialSource) kind() string {
+	return "jwt"
+}
+
+func (s *jwtCredentialSource) close() {
+	if err := s.client.Close(); err != nil {
+		slog.Warn("Failed to close workload API client", "error", err)
+	}
+}
+
+func newExchangedX509Credentials(
+	credentials vendoredaws.CredentialProcessOutput,
+	roleARN string,
+	svid *x509svid.SVID,
+) (*exchangedCredentials, error) {
+	expiresAt, err := time.Parse(time.RFC3339, credentials.Expiration)
+	if err != nil {
+		return nil, classifyError(errorClassInvalidCredentials, fmt.Errorf("parsing expiration time: %w", err))
+	}
+	return &exchangedCredentials{
+		credentials:   credentials,
+		expiresAt:     expiresAt,
+		accountID:     accountIDFromARN(roleARN),
+		roleARN:       roleARN,
+		svidID:        svid.ID,
+		svidHint:      svid.Hint,
+		svidExpiresAt: svid.Certificates[0].NotAfter,
+	}, nil
+}
+
+func newExchangedJWTCredentials(
+	credentials vendoredaws.CredentialProcessOutput,
+	roleARN string,
+	svid *jwtsvid.SVID,
+) (*exchangedCredentials, error) {
+	expiresAt, err := time.Parse(time.RFC3339, credentials.Expiration)
+	if err != nil {
+		return nil, classifyError(errorClassInvalidCredentials, fmt.Errorf("parsing expiration time: %w", err))
+	}
+	return &exchangedCredentials{
+		credentials:   credentials,
+		expiresAt:     expiresAt,
+		accountID:     accountIDFromARN(roleARN),
+		roleARN:       roleARN,
+		svidID:        svid.ID,
+		svidHint:      svid.Hint,
+		svidExpiresAt: svid.Expiry,
+	}, nil
+}
+
+// accountIDFromARN returns the account ID portion of an ARN, or an empty
+// string if it cannot be determined.
+func accountIDFromARN(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" {
+		return ""
+	}
+	return parts[4]
+}
+
+// renewCredentials exchanges the SVID from the source for AWS credentials
+// and passes them to onRenew. It repeats this whenever a new SVID is received
+// or the renewal policy determines that the credentials are due for renewal,
+// until the context is cancelled. Failed renewals are retried according to the
+// retry policy, and the error is only returned once the policy gives up.
+//
+// If the Workload API stops issuing an SVID to the workload, onRevoke is
+// called so that the credentials previously passed to onRenew can be
+// discarded, as they were obtained using an identity the workload no longer
+// holds. Renewal is then retried as for any other failure, so that
+// credentials are obtained again if the identity is restored.
+func renewCredentials(
+	ctx context.Context,
+	src svidCredentialSource,
+	onRenew func(creds *exchangedCredentials) error,
+	onRevoke func() error,
+	retry *retryPolicy,
+	renewal *internal.RenewalPolicy,
+) error {
+	svidUpdate := src.updated()
+	var last *exchangedCredentials
+	// revoked is set once the last credentials have been removed because
+	// the identity was revoked. They are still kept in last, as their expiry
+	// determines when the retry policy gives up.
+	var revoked bool
+	var failures int
+	var failingSince time.Time
+	for {
+		creds, err := src.exchange(ctx)
+		if err == nil {
+			err = onRenew(creds)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if isIdentityRevoked(err) && last != nil && !revoked {
+				slog.Warn(
+					"Workload identity has been revoked, removing AWS credentials",
+					"error", err,
+					"svid", last.svidValue(),
+				)
+				if err := onRevoke(); err != nil {
+					slog.Error("Failed to remove AWS credentials", "error", err)
+				}
+				// Only the credentials that were last obtained are
+				// removed, so this is not repeated while retrying.
+				revoked = true
+			}
+			if failures == 0 {
+				failingSince = time.Now()
+			}
+			failures++
+			if retry.shouldGiveUp(err, failingSince, last) {
+				return err
+			}
+			// Any credentials previously obtained are left in place while
+			// retrying, as they may still be valid.
+			retryIn := retry.backoff(failures)
+			slog.Warn(
+				"Failed to renew AWS credentials, will retry",
+				"error", err,
+				"retryable", isRetryable(err),
+				"failures", failures,
+				"retry_in", retryIn,
+			)
+			select {
+			case <-time.After(retryIn):
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		failures = 0
+		last = creds
+		revoked = false
+
+		now := time.Now()
+		awsTTL := creds.expiresAt.Sub(now)
+		svidTTL := creds.svidExpiresAt.Sub(now)
+		renewAt := renewal.NextRenewal(creds.expiresAt, creds.svidExpiresAt, svidUpdate != nil)
+
+		slog.Info(
+			"Sleeping until a new SVID is received or the AWS credentials are due for renewal",
+			"renewal_policy", renewal.Policy,
+			"aws_expires_at", creds.expiresAt,
+			"aws_ttl", awsTTL,
+			"renews_at", renewAt,
+			"svid_expires_at", creds.svidExpiresAt,
+			"svid_ttl", svidTTL,
+		)
+
+		select {
+		case <-time.After(time.Until(renewAt)):
+			slog.Info("Triggering renewal as AWS credentials are due for renewal")
+		case <-svidUpdate:
+			slog.Info("Received potential SVID update from Workload API, will update AWS credentials")
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// latestCredentials holds the most recent credentials produced by
+// renewCredentials, so that they can be served to other processes.
+type latestCredentials struct {
+	mu          sync.RWMutex
+	creds       *exchangedCredentials
+	lastUpdated time.Time
+	ready       chan struct{}
+	readyOnce   sync.Once
+}
+
+func newLatestCredentials() *latestCredentials {
+	return &latestCredentials{
+		ready: make(chan struct{}),
+	}
+}
+
+// set replaces the held credentials. Its signature allows it to be passed
+// directly to renewCredentials.
+func (l *latestCredentials) set(creds *exchangedCredentials) error {
+	l.mu.Lock()
+	l.creds = creds
+	l.lastUpdated = time.Now()
+	l.mu.Unlock()
+	l.readyOnce.Do(func() {
+		close(l.ready)
+	})
+	return nil
+}
+
+// clear discards the held credentials, so that they are no longer served.
+// Its signature allows it to be passed directly to renewCredentials.
+func (l *latestCredentials) clear() error {
+	l.mu.Lock()
+	l.creds = nil
+	l.lastUpdated = time.Now()
+	l.mu.Unlock()
+	return nil
+}
+
+// get returns the held credentials and when they were last updated. If no
+// credentials have been obtained yet, it blocks until they have been or the
+// context is cancelled. If the credentials have been cleared, an error is
+// returned.
+func (l *latestCredentials) get(ctx context.Context) (*exchangedCredentials, time.Time, error) {
+	select {
+	case <-l.ready:
+	case <-ctx.Done():
+		return nil, time.Time{}, fmt.Errorf("waiting for initial AWS credentials: %w", ctx.Err())
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.creds == nil {
+		return nil, time.Time{}, errIdentityRevoked
+	}
+	return l.creds, l.lastUpdated, nil
+}
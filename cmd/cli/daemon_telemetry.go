@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/pflag"
+	"github.com/spiffe/aws-spiffe-workload-helper/internal"
+	"golang.org/x/sync/errgroup"
+)
+
+type sharedDaemonFlags struct {
+	metricsAddr        string
+	healthAddr         string
+	healthMaxStaleness time.Duration
+	healthMinTTL       time.Duration
+	retry              retryPolicy
+	renewal            internal.RenewalPolicy
+}
+
+func (f *sharedDaemonFlags) addFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&f.metricsAddr, "metrics-addr", "", "If set, Prometheus metrics are served on this address at /metrics.")
+	flags.StringVar(&f.healthAddr, "health-addr", "", "If set, health checks are served on this address at /healthz, /readyz and /status. May be the same as --metrics-addr.")
+	flags.DurationVar(&f.healthMaxStaleness, "health-max-staleness", 0, "If set, the health checks fail when the credentials have not been renewed for longer than this duration.")
+	flags.DurationVar(&f.healthMinTTL, "health-min-ttl", 5*time.Minute, "The health checks fail when the credentials expire within this duration.")
+	f.retry.addFlags(flags)
+	addRenewalFlags(flags, &f.renewal)
+}
+
+func (f *sharedDaemonFlags) validate() error {
+	if err := f.retry.validate(); err != nil {
+		return fmt.Errorf("validating retry policy: %w", err)
+	}
+	if err := f.renewal.Validate(); err != nil {
+		return fmt.Errorf("validating renewal policy: %w", err)
+	}
+	return nil
+}
+
+// profileID identifies a set of credentials maintained by a long-running
+// command. Profiles are identified by both their name and the credentials
+// file they are written to, as profiles in different files may share a name.
+// It is the zero value for commands which maintain a single set of
+// credentials.
+type profileID struct {
+	path string
+	name string
+}
+
+// daemonTelemetry holds the metrics and health state of a long-running
+// command.
+type daemonTelemetry struct {
+	flags   *sharedDaemonFlags
+	metrics *credentialMetrics
+	health  *healthChecker
+}
+
+func (f *sharedDaemonFlags) newTelemetry() *daemonTelemetry {
+	return &daemonTelemetry{
+		flags:   f,
+		metrics: newCredentialMetrics(),
+		health:  newHealthChecker(f.healthMaxStaleness, f.healthMinTTL),
+	}
+}
+
+// instrument wraps src, onRenew and onRevoke so that the outcome of each
+// renewal is recorded in the metrics and health state.
+func (t *daemonTelemetry) instrument(
+	src svidCredentialSource,
+	profile profileID,
+	onRenew func(creds *exchangedCredentials) error,
+	onRevoke func() error,
+) (svidCredentialSource, func(creds *exchangedCredentials) error, func() error) {
+	return t.health.instrument(t.metrics.instrumentSource(src, profile), profile, onRenew, onRevoke)
+}
+
+// serve adds goroutines serving the metrics and health endpoints to g, if
+// they have been configured. If both are configured with the same address,
+// they are served by a single server.
+func (t *daemonTelemetry) serve(ctx context.Context, g *errgroup.Group) {
+	muxes := map[string]*http.ServeMux{}
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+	if t.flags.metricsAddr != "" {
+		mux(t.flags.metricsAddr).Handle("GET /metrics", promhttp.HandlerFor(t.metrics.registry, promhttp.HandlerOpts{}))
+	}
+	if t.flags.healthAddr != "" {
+		t.health.register(mux(t.flags.healthAddr))
+	}
+	for addr, mux := range muxes {
+		g.Go(func() error {
+			return serveHTTP(ctx, addr, &http.Server{
+				Handler:           mux,
+				ReadHeaderTimeout: 10 * time.Second,
+			})
+		})
+	}
+}
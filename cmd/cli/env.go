@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// envVar is an environment variable to set for a process which uses the AWS
+// credentials.
+type envVar struct {
+	name  string
+	value string
+}
+
+// credentialEnvVarNames are the environment variables set by credentialEnv.
+// They are removed from the environment of child processes before the new
+// values are added, so that stale values are not inherited.
+var credentialEnvVarNames = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+	"AWS_CREDENTIAL_EXPIRATION",
+	"AWS_REGION",
+	"AWS_DEFAULT_REGION",
+}
+
+// credentialEnv returns the environment variables which configure the AWS
+// SDKs and CLIs to use creds. If region is empty, the region variables are
+// omitted.
+func credentialEnv(creds *exchangedCredentials, region string) []envVar {
+	vars := []envVar{
+		{"AWS_ACCESS_KEY_ID", creds.credentials.AccessKeyId},
+		{"AWS_SECRET_ACCESS_KEY", creds.credentials.SecretAccessKey},
+		{"AWS_SESSION_TOKEN", creds.credentials.SessionToken},
+		{"AWS_CREDENTIAL_EXPIRATION", creds.credentials.Expiration},
+	}
+	if region != "" {
+		vars = append(vars,
+			envVar{"AWS_REGION", region},
+			envVar{"AWS_DEFAULT_REGION", region},
+		)
+	}
+	return vars
+}
+
+// Formats supported by the env command.
+const (
+	envFormatBash       = "bash"
+	envFormatFish       = "fish"
+	envFormatPowerShell = "powershell"
+	envFormatDotenv     = "dotenv"
+)
+
+var envFormats = []string{envFormatBash, envFormatFish, envFormatPowerShell, envFormatDotenv}
+
+// formatEnv writes statements which set vars in the given format.
+func formatEnv(w io.Writer, format string, vars []envVar) error {
+	for _, v := range vars {
+		var line string
+		switch format {
+		case envFormatBash:
+			line = fmt.Sprintf("export %s='%s'", v.name, strings.ReplaceAll(v.value, `'`, `'\''`))
+		case envFormatFish:
+			value := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v.value)
+			line = fmt.Sprintf("set -gx %s '%s';", v.name, value)
+		case envFormatPowerShell:
+			line = fmt.Sprintf("$Env:%s = '%s'", v.name, strings.ReplaceAll(v.value, `'`, `''`))
+		case envFormatDotenv:
+			value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v.value)
+			line = fmt.Sprintf(`%s="%s"`, v.name, value)
+		default:
+			return fmt.Errorf("format must be one of %v, got %q", envFormats, format)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type envFlags struct {
+	format    string
+	awsRegion string
+}
+
+func (f *envFlags) addFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&f.format, "format", envFormatBash, fmt.Sprintf("The format to print the environment variables in. One of %v.", envFormats))
+	cmd.PersistentFlags().StringVar(&f.awsRegion, "aws-region", "", "If set, AWS_REGION and AWS_DEFAULT_REGION are also set to this region.")
+}
+
+func newEnvCmd() (*cobra.Command, error) {
+	f := &envFlags{}
+	cmd := &cobra.Command{
+		Use:   "env",
+		Short: `Prints statements which set AWS credentials obtained using an SVID as environment variables.`,
+		Long:  `Exchanges an SVID for a short-lived set of AWS credentials, and prints statements which set them as environment variables, for example with eval "$(aws-spiffe-workload-helper env x509 ...)". Use the x509 or jwt subcommand to select how the SVID is exchanged for AWS credentials.`,
+	}
+	f.addFlags(cmd)
+	if err := addSVIDSourceCmds(cmd, func(ctx context.Context, src svidCredentialSource, args []string) error {
+		if len(args) > 0 {
+			return fmt.Errorf("unexpected arguments: %v", args)
+		}
+		return runEnv(ctx, f, src, cmd.OutOrStdout())
+	}); err != nil {
+		return nil, fmt.Errorf("adding source subcommands: %w", err)
+	}
+	return cmd, nil
+}
+
+func runEnv(
+	ctx context.Context,
+	f *envFlags,
+	src svidCredentialSource,
+	out io.Writer,
+) error {
+	if !slices.Contains(envFormats, f.format) {
+		return fmt.Errorf("format must be one of %v, got %q", envFormats, f.format)
+	}
+	creds, err := src.exchange(ctx)
+	if err != nil {
+		return fmt.Errorf("exchanging SVID for AWS credentials: %w", err)
+	}
+	if err := formatEnv(out, f.format, credentialEnv(creds, f.awsRegion)); err != nil {
+		return fmt.Errorf("writing environment variables: %w", err)
+	}
+	return nil
+}
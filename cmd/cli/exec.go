@@ -0,0 +1,123 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ExitError is returned when a command should cause the process to exit with
+// a specific exit code, such as when the child process run by exec exits
+// unsuccessfully.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+type execFlags struct {
+	awsRegion string
+}
+
+func (f *execFlags) addFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&f.awsRegion, "aws-region", "", "If set, AWS_REGION and AWS_DEFAULT_REGION are also set to this region.")
+}
+
+func newExecCmd() (*cobra.Command, error) {
+	f := &execFlags{}
+	cmd := &cobra.Command{
+		Use:   "exec",
+		Short: `Runs a command with AWS credentials obtained using an SVID set as environment variables.`,
+		Long:  `Exchanges an SVID for a short-lived set of AWS credentials, and runs a command with them set as environment variables. Signals are forwarded to the command, and its exit code is propagated. The credentials are not renewed, so the command should complete before they expire. Use the x509 or jwt subcommand to select how the SVID is exchanged for AWS credentials, followed by -- and the command to run.`,
+	}
+	f.addFlags(cmd)
+	if err := addSVIDSourceCmds(cmd, func(ctx context.Context, src svidCredentialSource, args []string) error {
+		return runExec(ctx, cmd, f, src, args)
+	}); err != nil {
+		return nil, fmt.Errorf("adding source subcommands: %w", err)
+	}
+	for _, sub := range cmd.Commands() {
+		// The exit code of the child is propagated as an error, which
+		// should not be reported as a failure of this tool.
+		sub.SilenceErrors = true
+		sub.SilenceUsage = true
+	}
+	return cmd, nil
+}
+
+// childEnv returns the environment for the child process: the environment of
+// this process, with any existing credential variables replaced by vars.
+func childEnv(environ []string, vars []envVar) []string {
+	env := slices.DeleteFunc(slices.Clone(environ), func(kv string) bool {
+		name, _, _ := strings.Cut(kv, "=")
+		return slices.Contains(credentialEnvVarNames, name)
+	})
+	for _, v := range vars {
+		env = append(env, v.name+"="+v.value)
+	}
+	return env
+}
+
+func runExec(
+	ctx context.Context,
+	cmd *cobra.Command,
+	f *execFlags,
+	src svidCredentialSource,
+	args []string,
+) error {
+	if len(args) == 0 {
+		return errors.New("a command to run must be given after --")
+	}
+	creds, err := src.exchange(ctx)
+	if err != nil {
+		return fmt.Errorf("exchanging SVID for AWS credentials: %w", err)
+	}
+
+	child := exec.Command(args[0], args[1:]...)
+	child.Env = childEnv(os.Environ(), credentialEnv(creds, f.awsRegion))
+	child.Stdin = cmd.InOrStdin()
+	child.Stdout = cmd.OutOrStdout()
+	child.Stderr = cmd.ErrOrStderr()
+
+	// Signals are caught before the child starts, so that none are missed,
+	// and forwarded to it until it exits.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	slog.Debug("Starting command", "command", args[0], "aws_expires_at", creds.expiresAt)
+	if err := child.Start(); err != nil {
+		return fmt.Errorf("starting command: %w", err)
+	}
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- child.Wait()
+	}()
+	for {
+		select {
+		case sig := <-signals:
+			if err := signalChild(child.Process, sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+				slog.Warn("Failed to forward signal to command", "signal", sig.String(), "error", err)
+			}
+		case err := <-waitErr:
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				return &ExitError{Code: exitCode(exitErr.ProcessState)}
+			}
+			if err != nil {
+				return fmt.Errorf("waiting for command: %w", err)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+
+package cli
+
+import (
+	"os"
+	"syscall"
+)
+
+// forwardedSignals are the signals which exec forwards to the child process.
+var forwardedSignals = []os.Signal{
+	syscall.SIGHUP,
+	syscall.SIGINT,
+	syscall.SIGQUIT,
+	syscall.SIGTERM,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+	syscall.SIGWINCH,
+}
+
+// signalChild forwards sig to the child.
+func signalChild(p *os.Process, sig os.Signal) error {
+	return p.Signal(sig)
+}
+
+// exitCode returns the exit code to exit with for a child which has exited.
+// As is conventional for shells, a child killed by a signal results in 128
+// plus the signal number.
+func exitCode(state *os.ProcessState) int {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
+}
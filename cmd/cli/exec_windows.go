@@ -0,0 +1,41 @@
+//go:build windows
+
+package cli
+
+import (
+	"log/slog"
+	"os"
+	"time"
+)
+
+// forwardedSignals are the signals which exec forwards to the child process.
+// Windows delivers console control events to every process attached to the
+// console, so only interrupts need to be caught, to stop them terminating
+// this process before the child.
+var forwardedSignals = []os.Signal{
+	os.Interrupt,
+}
+
+// interruptGracePeriod is how long the child is given to exit after an
+// interrupt, before it is killed.
+const interruptGracePeriod = 10 * time.Second
+
+// signalChild forwards sig to the child. Windows cannot send signals to other
+// processes, but the console already delivers the event to the child, as it
+// shares the console of this process. The child is instead killed if it has
+// not exited within interruptGracePeriod, so that it cannot outlive an
+// interrupt which it ignores.
+func signalChild(p *os.Process, sig os.Signal) error {
+	slog.Debug("Command will be killed if it does not exit", "signal", sig.String(), "grace_period", interruptGracePeriod)
+	time.AfterFunc(interruptGracePeriod, func() {
+		// Once the child has exited and been waited for, this fails
+		// without effect.
+		_ = p.Kill()
+	})
+	return nil
+}
+
+// exitCode returns the exit code to exit with for a child which has exited.
+func exitCode(state *os.ProcessState) int {
+	return state.ExitCode()
+}
@@ -0,0 +1,94 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spiffe/aws-spiffe-workload-helper/internal"
+)
+
+// parseFileMode parses file permissions given in octal, e.g. "0640".
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("parsing file mode %q: must be in octal", s)
+	}
+	if mode == 0 || os.FileMode(mode)&^os.ModePerm != 0 {
+		return 0, fmt.Errorf("file mode %q must be between 0001 and 0777", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// parseFileOwner parses a file owner given as a numeric UID, optionally
+// followed by a colon and a numeric GID, e.g. "1000:1000". If the GID is
+// omitted, the group of the file is left unchanged.
+func parseFileOwner(s string) (*internal.FileOwner, error) {
+	uidStr, gidStr, hasGID := strings.Cut(s, ":")
+	uid, err := strconv.Atoi(uidStr)
+	if err != nil || uid < 0 {
+		return nil, fmt.Errorf("parsing file owner %q: UID must be a non-negative integer", s)
+	}
+	owner := &internal.FileOwner{UID: uid, GID: -1}
+	if hasGID {
+		gid, err := strconv.Atoi(gidStr)
+		if err != nil || gid < 0 {
+			return nil, fmt.Errorf("parsing file owner %q: GID must be a non-negative integer", s)
+		}
+		owner.GID = gid
+	}
+	return owner, nil
+}
+
+// fileModeFlag is a flag holding file permissions.
+type fileModeFlag struct {
+	mode *os.FileMode
+}
+
+func (f *fileModeFlag) Set(s string) error {
+	mode, err := parseFileMode(s)
+	if err != nil {
+		return err
+	}
+	*f.mode = mode
+	return nil
+}
+
+func (f *fileModeFlag) String() string {
+	return fmt.Sprintf("%#o", uint32(*f.mode))
+}
+
+func (f *fileModeFlag) Type() string {
+	return "mode"
+}
+
+// fileOwnerFlag is a flag holding the owner of a file. If unset, it holds
+// nil.
+type fileOwnerFlag struct {
+	owner **internal.FileOwner
+}
+
+func (f *fileOwnerFlag) Set(s string) error {
+	owner, err := parseFileOwner(s)
+	if err != nil {
+		return err
+	}
+	*f.owner = owner
+	return nil
+}
+
+func (f *fileOwnerFlag) String() string {
+	o := *f.owner
+	if o == nil {
+		return ""
+	}
+	if o.GID < 0 {
+		return strconv.Itoa(o.UID)
+	}
+	return fmt.Sprintf("%d:%d", o.UID, o.GID)
+}
+
+func (f *fileOwnerFlag) Type() string {
+	return "uid[:gid]"
+}
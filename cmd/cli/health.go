@@ -0,0 +1,259 @@
+package cli
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthChecker tracks the state of the credentials maintained by a
+// long-running command, so that it can be reported by the health endpoints.
+type healthChecker struct {
+	// maxStaleness is the longest time since the last successful renewal
+	// before the command is considered unhealthy. If zero, it is not checked.
+	maxStaleness time.Duration
+	// minTTL is the shortest remaining lifetime of the AWS credentials before
+	// the command is considered unhealthy.
+	minTTL time.Duration
+
+	mu       sync.Mutex
+	profiles []*profileHealth
+}
+
+// profileHealth is the state of a single set of credentials.
+type profileHealth struct {
+	id      profileID
+	renewed bool
+	revoked bool
+	// stopped is set once the profile has stopped after an error which
+	// cannot be resolved by retrying, so will not be renewed again.
+	stopped       bool
+	svidID        string
+	svidHint      string
+	svidExpiresAt time.Time
+	awsExpiresAt  time.Time
+	lastRenewal   time.Time
+	lastError     string
+	lastErrorAt   time.Time
+}
+
+// problem returns why the profile is unhealthy, or an empty string if it is
+// healthy.
+func (p *profileHealth) problem(now time.Time, maxStaleness, minTTL time.Duration) string {
+	switch {
+	case p.stopped:
+		return "renewal stopped after an error that cannot be resolved by retrying"
+	case !p.renewed:
+		return "credentials have not yet been obtained"
+	case p.revoked:
+		return "credentials were removed as the workload identity was revoked"
+	case maxStaleness > 0 && now.Sub(p.lastRenewal) > maxStaleness:
+		return "credentials have not been renewed recently"
+	case p.awsExpiresAt.Sub(now) < minTTL:
+		return "credentials are about to expire"
+	}
+	return ""
+}
+
+func newHealthChecker(maxStaleness, minTTL time.Duration) *healthChecker {
+	return &healthChecker{
+		maxStaleness: maxStaleness,
+		minTTL:       minTTL,
+	}
+}
+
+// profile returns the state tracked for the profile, registering it if it is
+// not yet known. Registered profiles must have renewed credentials before the
+// command is ready.
+func (h *healthChecker) profile(id profileID) *profileHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, p := range h.profiles {
+		if p.id == id {
+			return p
+		}
+	}
+	p := &profileHealth{id: id}
+	h.profiles = append(h.profiles, p)
+	return p
+}
+
+// instrument wraps src, onRenew and onRevoke so that the outcome of each
+// renewal, and the removal of credentials when the identity is revoked, is
+// tracked for the profile.
+func (h *healthChecker) instrument(
+	src svidCredentialSource,
+	profile profileID,
+	onRenew func(creds *exchangedCredentials) error,
+	onRevoke func() error,
+) (svidCredentialSource, func(creds *exchangedCredentials) error, func() error) {
+	p := h.profile(profile)
+	recordError := func(err error) {
+		h.recordError(profile, err)
+	}
+	revoke := func() error {
+		err := onRevoke()
+		if err != nil {
+			recordError(err)
+		}
+		// The credentials are no longer usable even if they could not be
+		// removed, as the identity they were obtained with was revoked.
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		p.revoked = true
+		return err
+	}
+	return &healthCheckedSource{
+		svidCredentialSource: src,
+		recordError:          recordError,
+	}, func(creds *exchangedCredentials) error {
+		if err := onRenew(creds); err != nil {
+			recordError(err)
+			return err
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		p.renewed = true
+		p.revoked = false
+		p.svidID = creds.svidID.String()
+		p.svidHint = creds.svidHint
+		p.svidExpiresAt = creds.svidExpiresAt
+		p.awsExpiresAt = creds.expiresAt
+		p.lastRenewal = time.Now()
+		return nil
+	}, revoke
+}
+
+// recordError records a failure to renew the credentials for the profile.
+func (h *healthChecker) recordError(profile profileID, err error) {
+	p := h.profile(profile)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p.lastError = err.Error()
+	p.lastErrorAt = time.Now()
+}
+
+// stop records that renewal of the profile has stopped for good after err.
+func (h *healthChecker) stop(profile profileID, err error) {
+	p := h.profile(profile)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p.stopped = true
+	p.lastError = err.Error()
+	p.lastErrorAt = time.Now()
+}
+
+type healthCheckedSource struct {
+	svidCredentialSource
+	recordError func(err error)
+}
+
+func (s *healthCheckedSource) exchange(ctx context.Context) (*exchangedCredentials, error) {
+	creds, err := s.svidCredentialSource.exchange(ctx)
+	if err != nil {
+		s.recordError(err)
+	}
+	return creds, err
+}
+
+// healthStatus is the document returned by the /status endpoint.
+type healthStatus struct {
+	Ready    bool                  `json:"ready"`
+	Profiles []profileHealthStatus `json:"profiles"`
+}
+
+type profileHealthStatus struct {
+	// Profile and Path are empty for commands which maintain a single set
+	// of credentials.
+	Profile       string     `json:"profile,omitempty"`
+	Path          string     `json:"path,omitempty"`
+	Ready         bool       `json:"ready"`
+	Problem       string     `json:"problem,omitempty"`
+	SVIDID        string     `json:"svid_id,omitempty"`
+	SVIDHint      string     `json:"svid_hint,omitempty"`
+	SVIDExpiresAt *time.Time `json:"svid_expires_at,omitempty"`
+	AWSExpiresAt  *time.Time `json:"aws_expires_at,omitempty"`
+	LastRenewalAt *time.Time `json:"last_renewal_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (h *healthChecker) status() healthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	status := healthStatus{
+		Ready:    len(h.profiles) > 0,
+		Profiles: make([]profileHealthStatus, 0, len(h.profiles)),
+	}
+	for _, p := range h.profiles {
+		problem := p.problem(now, h.maxStaleness, h.minTTL)
+		if problem != "" {
+			status.Ready = false
+		}
+		status.Profiles = append(status.Profiles, profileHealthStatus{
+			Profile:       p.id.name,
+			Path:          p.id.path,
+			Ready:         problem == "",
+			Problem:       problem,
+			SVIDID:        p.svidID,
+			SVIDHint:      p.svidHint,
+			SVIDExpiresAt: optionalTime(p.svidExpiresAt),
+			AWSExpiresAt:  optionalTime(p.awsExpiresAt),
+			LastRenewalAt: optionalTime(p.lastRenewal),
+			LastError:     p.lastError,
+			LastErrorAt:   optionalTime(p.lastErrorAt),
+		})
+	}
+	return status
+}
+
+// live returns false if credentials have previously been obtained for any
+// profile, but it has since become unhealthy. This indicates that renewal
+// has stopped, and that restarting the process may resolve it. Profiles whose
+// identity was revoked, or which stopped after an error that cannot be
+// resolved by retrying, do not count, as a restart would not resolve them.
+func (h *healthChecker) live() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for _, p := range h.profiles {
+		if p.renewed && !p.revoked && !p.stopped && p.problem(now, h.maxStaleness, h.minTTL) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *healthChecker) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !h.live() {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !h.status().Ready {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		status := h.status()
+		code := http.StatusOK
+		if !status.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, status)
+	})
+}
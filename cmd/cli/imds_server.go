@@ -0,0 +1,269 @@
+package cli
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	imdsTokenHeader    = "X-aws-ec2-metadata-token"
+	imdsTokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+	// imdsMaxTokenTTL is the maximum lifetime of an IMDSv2 session token, as
+	// enforced by the EC2 Instance Metadata Service.
+	imdsMaxTokenTTL = 6 * time.Hour
+	// imdsMaxTokens limits how many session tokens are held at once, so
+	// that clients requesting many long-lived tokens cannot exhaust memory.
+	imdsMaxTokens = 4096
+)
+
+type imdsServerFlags struct {
+	listenAddr  string
+	roleName    string
+	allowIMDSv1 bool
+	hopLimit    int
+}
+
+func (f *imdsServerFlags) addFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&f.listenAddr, "listen-addr", "127.0.0.1:1338", "The address the emulated Instance Metadata Service should listen on.")
+	cmd.PersistentFlags().StringVar(&f.roleName, "role-name", "aws-spiffe-workload-helper", "The name of the role exposed under the security-credentials path of the Instance Metadata Service.")
+	cmd.PersistentFlags().BoolVar(&f.allowIMDSv1, "allow-imdsv1", false, "If set, requests without an IMDSv2 session token will be served. By default, a session token is required.")
+	cmd.PersistentFlags().IntVar(&f.hopLimit, "hop-limit", 1, "The IP hop limit set on responses to IMDSv2 session token requests. Limits how many network hops the token can travel.")
+}
+
+func newIMDSServerCmd() (*cobra.Command, error) {
+	f := &imdsServerFlags{}
+	cmd := &cobra.Command{
+		Use:   "imds-server",
+		Short: `Serves AWS credentials obtained using an SVID from an emulation of the EC2 Instance Metadata Service.`,
+		Long:  `Serves AWS credentials obtained using an SVID from an emulation of the EC2 Instance Metadata Service (IMDSv1 and IMDSv2). This allows tools which only support the IMDS credential provider to use a SPIFFE identity. The credentials are renewed in the background. Use the x509 or jwt subcommand to select how the SVID is exchanged for AWS credentials.`,
+	}
+	f.addFlags(cmd)
+	df := &sharedDaemonFlags{}
+	df.addFlags(cmd.PersistentFlags())
+	if err := addSVIDSourceCmds(cmd, func(ctx context.Context, src svidCredentialSource, _ []string) error {
+		return runIMDSServer(ctx, f, df, src)
+	}); err != nil {
+		return nil, fmt.Errorf("adding source subcommands: %w", err)
+	}
+	return cmd, nil
+}
+
+func runIMDSServer(
+	ctx context.Context,
+	f *imdsServerFlags,
+	df *sharedDaemonFlags,
+	src svidCredentialSource,
+) error {
+	if err := df.validate(); err != nil {
+		return err
+	}
+	if f.hopLimit < 1 || f.hopLimit > 64 {
+		return fmt.Errorf("hop limit must be between 1 and 64, got %d", f.hopLimit)
+	}
+	slog.Info("Starting Instance Metadata Service server")
+	creds := newLatestCredentials()
+	srv := newIMDSServer(f, creds)
+
+	t := df.newTelemetry()
+	g, ctx := errgroup.WithContext(ctx)
+	t.serve(ctx, g)
+	g.Go(func() error {
+		src, onRenew, onRevoke := t.instrument(src, profileID{}, creds.set, creds.clear)
+		return renewCredentials(ctx, src, onRenew, onRevoke, &df.retry, &df.renewal)
+	})
+	g.Go(func() error {
+		return serveHTTP(ctx, f.listenAddr, srv.httpServer())
+	})
+	return g.Wait()
+}
+
+type connContextKey struct{}
+
+// imdsServer emulates the subset of the EC2 Instance Metadata Service used
+// by the AWS SDKs and CLIs to obtain credentials.
+type imdsServer struct {
+	creds       *latestCredentials
+	roleName    string
+	allowIMDSv1 bool
+	hopLimit    int
+
+	mu     sync.Mutex
+	tokens map[string]time.Time
+}
+
+func newIMDSServer(f *imdsServerFlags, creds *latestCredentials) *imdsServer {
+	return &imdsServer{
+		creds:       creds,
+		roleName:    f.roleName,
+		allowIMDSv1: f.allowIMDSv1,
+		hopLimit:    f.hopLimit,
+		tokens:      map[string]time.Time{},
+	}
+}
+
+func (s *imdsServer) httpServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /latest/api/token", s.handleToken)
+	mux.HandleFunc("GET /latest/meta-data/iam/security-credentials/{$}", s.requireToken(s.handleListRoles))
+	mux.HandleFunc("GET /latest/meta-data/iam/security-credentials/{role}", s.requireToken(s.handleCredentials))
+	return &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		// Make the connection available to handlers, so that the hop limit
+		// can be applied to token responses.
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
+	}
+}
+
+func (s *imdsServer) handleToken(w http.ResponseWriter, r *http.Request) {
+	// The EC2 IMDS rejects token requests which have passed through a proxy,
+	// as this would allow the token to escape the instance.
+	if r.Header.Get("X-Forwarded-For") != "" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	ttlSeconds, err := strconv.Atoi(r.Header.Get(imdsTokenTTLHeader))
+	if err != nil || ttlSeconds < 1 || time.Duration(ttlSeconds)*time.Second > imdsMaxTokenTTL {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		slog.Error("Failed to generate IMDS session token", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	s.addToken(token, time.Now().Add(time.Duration(ttlSeconds)*time.Second))
+
+	if c, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+		if err := setHopLimit(c, s.hopLimit); err != nil {
+			slog.Error("Failed to set hop limit on IMDS session token response", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		// The hop limit applies to everything later sent on the
+		// connection, so it is closed rather than reused for other
+		// responses.
+		w.Header().Set("Connection", "close")
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set(imdsTokenTTLHeader, strconv.Itoa(ttlSeconds))
+	_, _ = w.Write([]byte(token))
+}
+
+// addToken records a session token which expires at expiresAt. Expired tokens
+// are discarded, and if imdsMaxTokens are still held, the token closest to
+// expiring is evicted to make room. Clients whose token was evicted obtain a
+// new one when it is rejected, as they would once it expired.
+func (s *imdsServer) addToken(token string, expiresAt time.Time) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t, exp := range s.tokens {
+		if now.After(exp) {
+			delete(s.tokens, t)
+		}
+	}
+	if len(s.tokens) >= imdsMaxTokens {
+		var oldest string
+		var oldestExp time.Time
+		for t, exp := range s.tokens {
+			if oldest == "" || exp.Before(oldestExp) {
+				oldest, oldestExp = t, exp
+			}
+		}
+		delete(s.tokens, oldest)
+	}
+	s.tokens[token] = expiresAt
+}
+
+// requireToken wraps a handler to enforce that the request carries a valid
+// IMDSv2 session token, unless IMDSv1 has been allowed.
+func (s *imdsServer) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(imdsTokenHeader)
+		if token == "" && s.allowIMDSv1 {
+			next(w, r)
+			return
+		}
+
+		s.mu.Lock()
+		expiresAt, ok := s.tokens[token]
+		s.mu.Unlock()
+		if !ok || time.Now().After(expiresAt) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *imdsServer) handleListRoles(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(s.roleName))
+}
+
+// imdsCredentialsResponse is the document returned by the IMDS for a role
+// under the security-credentials path.
+type imdsCredentialsResponse struct {
+	Code            string `json:"Code"`
+	LastUpdated     string `json:"LastUpdated"`
+	Type            string `json:"Type"`
+	AccessKeyId     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	Expiration      string `json:"Expiration"`
+}
+
+func (s *imdsServer) handleCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.PathValue("role") != s.roleName {
+		http.NotFound(w, r)
+		return
+	}
+	creds, lastUpdated, err := s.creds.get(r.Context())
+	if err != nil {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, imdsCredentialsResponse{
+		Code:            "Success",
+		LastUpdated:     lastUpdated.UTC().Format(time.RFC3339),
+		Type:            "AWS-HMAC",
+		AccessKeyId:     creds.credentials.AccessKeyId,
+		SecretAccessKey: creds.credentials.SecretAccessKey,
+		Token:           creds.credentials.SessionToken,
+		Expiration:      creds.credentials.Expiration,
+	})
+}
+
+// setHopLimit sets the IP TTL (or IPv6 hop limit) of packets sent on the
+// connection.
+func setHopLimit(c net.Conn, hopLimit int) error {
+	addr, ok := c.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	if addr.IP.To4() != nil {
+		return ipv4.NewConn(c).SetTTL(hopLimit)
+	}
+	return ipv6.NewConn(c).SetHopLimit(hopLimit)
+}
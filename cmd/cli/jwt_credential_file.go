@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+)
+
+func newJWTCredentialFileOneshotCmd() (*cobra.Command, error) {
+	sf := &sharedJWTFlags{}
+	cf := &sharedCredentialFileFlags{}
+	cmd := &cobra.Command{
+		Use:   "jwt-credential-file-oneshot",
+		Short: `Exchanges a JWT SVID for a short-lived set of AWS credentials using AWS AssumeRoleWithWebIdentity. Writes the credentials to a file in the 'credential file' format expected by the AWS CLI and SDKs.`,
+		Long:  `Exchanges a JWT SVID for a short-lived set of AWS credentials using AWS AssumeRoleWithWebIdentity. Writes the credentials to a file in the 'credential file' format expected by the AWS CLI and SDKs.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return oneshotJWTCredentialFile(cmd.Context(), cf, sf)
+		},
+	}
+	if err := sf.addFlags(cmd); err != nil {
+		return nil, fmt.Errorf("adding shared flags: %w", err)
+	}
+	if err := cf.addFlags(cmd); err != nil {
+		return nil, fmt.Errorf("adding credential file flags: %w", err)
+	}
+
+	return cmd, nil
+}
+
+func oneshotJWTCredentialFile(
+	ctx context.Context,
+	cf *sharedCredentialFileFlags,
+	sf *sharedJWTFlags,
+) error {
+	client, err := newWorkloadAPIClient(ctx, sf.workloadAPIAddr)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := client.Close(); err != nil {
+			slog.Warn("Failed to close workload API client", "error", err)
+		}
+	}()
+
+	svid, err := fetchJWTSVID(ctx, client, sf)
+	if err != nil {
+		return err
+	}
+
+	credentials, err := exchangeJWTSVIDForAWSCredentials(ctx, client, sf, svid)
+	if err != nil {
+		return fmt.Errorf("exchanging JWT SVID for AWS credentials: %w", err)
+	}
+
+	creds, err := newExchangedJWTCredentials(credentials, sf.assumeRoles.roleARN(sf.roleARN), svid)
+	if err != nil {
+		return err
+	}
+
+	if err := cf.writeCredentials(creds); err != nil {
+		return err
+	}
+	slog.Info(
+		"Wrote AWS credential to file",
+		"path", cf.awsCredentialsPath,
+		"aws_expires_at", creds.expiresAt,
+	)
+	return nil
+}
+
+func newJWTCredentialFileCmd() (*cobra.Command, error) {
+	sf := &sharedJWTFlags{}
+	cf := &sharedCredentialFileFlags{}
+	df := &sharedDaemonFlags{}
+	cmd := &cobra.Command{
+		Use:   "jwt-credential-file",
+		Short: `On a regular basis, this daemon exchanges a JWT SVID for a short-lived set of AWS credentials using AWS AssumeRoleWithWebIdentity. Writes the credentials to a file in the 'credential file' format expected by the AWS CLI and SDKs.`,
+		Long:  `On a regular basis, this daemon exchanges a JWT SVID for a short-lived set of AWS credentials using AWS AssumeRoleWithWebIdentity. Writes the credentials to a file in the 'credential file' format expected by the AWS CLI and SDKs. By default, the exchange is repeated when either the AWS credentials or the JWT SVID are more than 50% of the way through their lifetime. See --renewal-policy.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return daemonJWTCredentialFile(cmd.Context(), cf, sf, df)
+		},
+	}
+	if err := sf.addFlags(cmd); err != nil {
+		return nil, fmt.Errorf("adding shared flags: %w", err)
+	}
+	if err := cf.addFlags(cmd); err != nil {
+		return nil, fmt.Errorf("adding credential file flags: %w", err)
+	}
+	cf.addDaemonFlags(cmd)
+	df.addFlags(cmd.Flags())
+
+	return cmd, nil
+}
+
+func daemonJWTCredentialFile(
+	ctx context.Context,
+	cf *sharedCredentialFileFlags,
+	sf *sharedJWTFlags,
+	df *sharedDaemonFlags,
+) error {
+	if err := df.validate(); err != nil {
+		return err
+	}
+	slog.Info("Starting AWS credential file daemon")
+	t := df.newTelemetry()
+	g, ctx := errgroup.WithContext(ctx)
+	t.serve(ctx, g)
+	g.Go(func() error {
+		src, err := newJWTCredentialSource(ctx, sf)
+		if err != nil {
+			return err
+		}
+		defer src.close()
+
+		instrumented, write, remove := t.instrument(
+			src,
+			profileID{},
+			t.metrics.instrumentFileWrite(cf.writeRenewedCredentials, src.kind(), profileID{}),
+			cf.removeCredentials,
+		)
+		return cf.renewCredentialsFile(ctx, instrumented, write, remove, &df.retry, &df.renewal)
+	})
+	return g.Wait()
+}
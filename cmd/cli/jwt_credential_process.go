@@ -4,16 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
-	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spiffe/aws-spiffe-workload-helper/internal"
-	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/aws-spiffe-workload-helper/vendoredaws"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
 func newJWTCredentialProcessCmd() (*cobra.Command, error) {
 	sf := &sharedJWTFlags{}
+	cf := &sharedCacheFlags{}
 	cmd := &cobra.Command{
 		Use:   "jwt-credential-process",
 		Short: `Exchanges an JWT SVID for a short-lived set of AWS credentials using AWS AssumeRoleWithWebIdentity. Compatible with the AWS credential process functionality.`,
@@ -34,38 +36,26 @@ func newJWTCredentialProcessCmd() (*cobra.Command, error) {
 				}
 			}()
 
-			params := jwtsvid.Params{
-				Audience: sf.audience,
-			}
-			svids, err := client.FetchJWTSVIDs(ctx, params)
-			if err != nil {
-				return fmt.Errorf("fetching jwt: %w", err)
-			}
-			svid := svids[0]
-			if sf.hint != "" {
-				hints := make([]string, len(svids))
-				found := false
-				for i, s := range svids {
-					if s.Hint == sf.hint {
-						found = true
-						svid = s
-						break
+			// JWT SVIDs are minted on request rather than rotated, so the
+			// cache is checked before one is fetched, and the cached
+			// credentials are only tied to the flags.
+			credentials, err := cf.cachedExchange(
+				cmd.Flags(), spiffeid.ID{}, "",
+				sf.assumeRoles.sessionDuration(time.Duration(sf.sessionDuration)*time.Second),
+				func() (vendoredaws.CredentialProcessOutput, error) {
+					svid, err := fetchJWTSVID(ctx, client, sf)
+					if err != nil {
+						return vendoredaws.CredentialProcessOutput{}, err
 					}
-					hints[i] = s.Hint
-				}
-				if !found {
-					return fmt.Errorf("could not find the specified SVID. Available hints [%s]", strings.Join(hints, ", "))
-				}
-			} else if len(svids) > 1 {
-				slog.Warn("Received multiple SVIDs, but, no hint matcher was set. Selecting the first SVID.")
-			}
-			// TODO(strideynet): Implement SVID selection mechanism, for now,
-			// we'll just use the first returned SVID (a.k.a the default).
-			slog.Debug("Fetched JWT SVID", "svid", jwtSVIDValue(svid))
-
-			credentials, err := exchangeJWTSVIDForAWSCredentials(sf, svid)
+					credentials, err := exchangeJWTSVIDForAWSCredentials(ctx, client, sf, svid)
+					if err != nil {
+						return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("exchanging JWT SVID for AWS credentials: %w", err)
+					}
+					return credentials, nil
+				},
+			)
 			if err != nil {
-				return fmt.Errorf("exchanging JWT SVID for AWS credentials: %w", err)
+				return err
 			}
 
 			out, err := json.Marshal(credentials)
@@ -82,6 +72,7 @@ func newJWTCredentialProcessCmd() (*cobra.Command, error) {
 	if err := sf.addFlags(cmd); err != nil {
 		return nil, fmt.Errorf("adding shared flags: %w", err)
 	}
+	cf.addFlags(cmd)
 
 	return cmd, nil
 }
@@ -0,0 +1,174 @@
+package cli
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const metricsNamespace = "aws_spiffe_workload_helper"
+
+// credentialMetricsLabels are the labels applied to all credential metrics.
+// The profile and path labels are only set by commands which maintain several
+// sets of credentials.
+var credentialMetricsLabels = []string{"source", "profile", "path"}
+
+func credentialLabels(kind string, profile profileID) prometheus.Labels {
+	return prometheus.Labels{"source": kind, "profile": profile.name, "path": profile.path}
+}
+
+// credentialMetrics are the metrics exposed by the long-running commands
+// about the renewal of AWS credentials.
+type credentialMetrics struct {
+	registry *prometheus.Registry
+
+	exchangeAttempts     *prometheus.CounterVec
+	exchangeSuccesses    *prometheus.CounterVec
+	exchangeFailures     *prometheus.CounterVec
+	exchangeDuration     *prometheus.HistogramVec
+	lastExchangeSuccess  *prometheus.GaugeVec
+	awsCredentialsExpiry *prometheus.GaugeVec
+	svidExpiry           *prometheus.GaugeVec
+	svidRotations        *prometheus.CounterVec
+	fileWriteFailures    *prometheus.CounterVec
+}
+
+func newCredentialMetrics() *credentialMetrics {
+	m := &credentialMetrics{
+		registry: prometheus.NewRegistry(),
+		exchangeAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "exchange_attempts_total",
+			Help:      "The number of attempts to exchange an SVID for AWS credentials.",
+		}, credentialMetricsLabels),
+		exchangeSuccesses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "exchange_successes_total",
+			Help:      "The number of successful exchanges of an SVID for AWS credentials.",
+		}, credentialMetricsLabels),
+		exchangeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "exchange_failures_total",
+			Help:      "The number of failed exchanges of an SVID for AWS credentials, by class of error.",
+		}, append([]string{"class"}, credentialMetricsLabels...)),
+		exchangeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "exchange_duration_seconds",
+			Help:      "The time taken to exchange an SVID for AWS credentials, including failed attempts.",
+			Buckets:   prometheus.DefBuckets,
+		}, credentialMetricsLabels),
+		lastExchangeSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_exchange_success_timestamp_seconds",
+			Help:      "The Unix time at which an SVID was last successfully exchanged for AWS credentials.",
+		}, credentialMetricsLabels),
+		awsCredentialsExpiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "aws_credentials_expiry_timestamp_seconds",
+			Help:      "The Unix time at which the current AWS credentials expire.",
+		}, credentialMetricsLabels),
+		svidExpiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "svid_expiry_timestamp_seconds",
+			Help:      "The Unix time at which the SVID last exchanged for AWS credentials expires.",
+		}, credentialMetricsLabels),
+		svidRotations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "svid_rotations_total",
+			Help:      "The number of times a different SVID has been exchanged to the one previously exchanged.",
+		}, credentialMetricsLabels),
+		fileWriteFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "credentials_file_write_failures_total",
+			Help:      "The number of failures writing AWS credentials to a credentials file.",
+		}, credentialMetricsLabels),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.exchangeAttempts,
+		m.exchangeSuccesses,
+		m.exchangeFailures,
+		m.exchangeDuration,
+		m.lastExchangeSuccess,
+		m.awsCredentialsExpiry,
+		m.svidExpiry,
+		m.svidRotations,
+		m.fileWriteFailures,
+	)
+	return m
+}
+
+// instrumentSource wraps src so that the outcome of each exchange is
+// recorded.
+func (m *credentialMetrics) instrumentSource(
+	src svidCredentialSource,
+	profile profileID,
+) svidCredentialSource {
+	labels := credentialLabels(src.kind(), profile)
+	// Initialize the counters, so that they are exported before the first
+	// exchange completes.
+	m.exchangeAttempts.With(labels)
+	m.exchangeSuccesses.With(labels)
+	m.svidRotations.With(labels)
+	return &instrumentedCredentialSource{
+		svidCredentialSource: src,
+		metrics:              m,
+		labels:               labels,
+	}
+}
+
+// instrumentFileWrite wraps a function which writes renewed credentials to
+// a credentials file, so that failures are recorded.
+func (m *credentialMetrics) instrumentFileWrite(
+	write func(creds *exchangedCredentials) error,
+	kind string,
+	profile profileID,
+) func(creds *exchangedCredentials) error {
+	labels := credentialLabels(kind, profile)
+	m.fileWriteFailures.With(labels)
+	return func(creds *exchangedCredentials) error {
+		err := write(creds)
+		if err != nil {
+			m.fileWriteFailures.With(labels).Inc()
+		}
+		return err
+	}
+}
+
+type instrumentedCredentialSource struct {
+	svidCredentialSource
+	metrics *credentialMetrics
+	labels  prometheus.Labels
+	// last is the previous successful exchange, used to detect rotation of
+	// the SVID. It is only accessed by the renewal loop.
+	last *exchangedCredentials
+}
+
+func (s *instrumentedCredentialSource) exchange(ctx context.Context) (*exchangedCredentials, error) {
+	m := s.metrics
+	m.exchangeAttempts.With(s.labels).Inc()
+	start := time.Now()
+	creds, err := s.svidCredentialSource.exchange(ctx)
+	m.exchangeDuration.With(s.labels).Observe(time.Since(start).Seconds())
+	if err != nil {
+		failureLabels := prometheus.Labels{"class": errorClass(err)}
+		for k, v := range s.labels {
+			failureLabels[k] = v
+		}
+		m.exchangeFailures.With(failureLabels).Inc()
+		return nil, err
+	}
+
+	m.exchangeSuccesses.With(s.labels).Inc()
+	m.lastExchangeSuccess.With(s.labels).SetToCurrentTime()
+	m.awsCredentialsExpiry.With(s.labels).Set(float64(creds.expiresAt.Unix()))
+	m.svidExpiry.With(s.labels).Set(float64(creds.svidExpiresAt.Unix()))
+	if s.last != nil && (s.last.svidID != creds.svidID || !s.last.svidExpiresAt.Equal(creds.svidExpiresAt)) {
+		m.svidRotations.With(s.labels).Inc()
+	}
+	s.last = creds
+	return creds, nil
+}
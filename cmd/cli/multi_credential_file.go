@@ -0,0 +1,447 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spiffe/aws-spiffe-workload-helper/credentialprovider"
+	"github.com/spiffe/aws-spiffe-workload-helper/internal"
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/yaml.v3"
+)
+
+// profileRestartDelay is how long a profile waits before being restarted
+// after it fails.
+const profileRestartDelay = 30 * time.Second
+
+// profilesFile is the document read from the --profiles-file of the
+// multi-credential-file command.
+type profilesFile struct {
+	// WorkloadAPIAddr is the default Workload API address for profiles which
+	// do not specify one.
+	WorkloadAPIAddr string `yaml:"workload_api_addr"`
+	// AWSCredentialsPath is the default credentials file for profiles which
+	// do not specify one.
+	AWSCredentialsPath string `yaml:"aws_credentials_path"`
+	// AWSCredentialsMode is the default permissions, in octal, that
+	// credentials files are written with.
+	AWSCredentialsMode string `yaml:"aws_credentials_mode"`
+	// AWSCredentialsOwner is the default UID, and optionally GID, that
+	// credentials files are written with.
+	AWSCredentialsOwner string `yaml:"aws_credentials_owner"`
+	// AWSCredentialsMetadata is whether metadata describing the credentials
+	// is written alongside them, for profiles which do not specify it.
+	AWSCredentialsMetadata bool            `yaml:"aws_credentials_metadata"`
+	Profiles               []profileConfig `yaml:"profiles"`
+
+	// mode and owner are parsed from AWSCredentialsMode and
+	// AWSCredentialsOwner.
+	mode  os.FileMode
+	owner *internal.FileOwner
+}
+
+// profileConfig configures a single profile maintained by the
+// multi-credential-file command.
+type profileConfig struct {
+	// Name is the name of the profile within the AWS credentials file.
+	Name string `yaml:"name"`
+	// Type is either "x509" or "jwt", and selects how the SVID is exchanged
+	// for AWS credentials.
+	Type               string `yaml:"type"`
+	AWSCredentialsPath string `yaml:"aws_credentials_path"`
+	// AWSCredentialsMode, AWSCredentialsOwner and AWSCredentialsMetadata
+	// override the top-level settings of the same name. Profiles sharing a
+	// credentials file must agree on its mode and owner.
+	AWSCredentialsMode     string `yaml:"aws_credentials_mode"`
+	AWSCredentialsOwner    string `yaml:"aws_credentials_owner"`
+	AWSCredentialsMetadata *bool  `yaml:"aws_credentials_metadata"`
+	WorkloadAPIAddr        string `yaml:"workload_api_addr"`
+	Hint                   string `yaml:"hint"`
+	SPIFFEID               string `yaml:"spiffe_id"`
+	RoleARN                string `yaml:"role_arn"`
+	RoleSessionName        string `yaml:"role_session_name"`
+	SessionDuration        int    `yaml:"session_duration"`
+	Endpoint               string `yaml:"endpoint"`
+
+	// X509 only.
+	Region         string `yaml:"region"`
+	ProfileARN     string `yaml:"profile_arn"`
+	TrustAnchorARN string `yaml:"trust_anchor_arn"`
+
+	// JWT only.
+	Audience       string        `yaml:"audience"`
+	ExtraAudiences []string      `yaml:"extra_audiences"`
+	ValidateJWT    bool          `yaml:"validate_jwt"`
+	JWTMinLifetime time.Duration `yaml:"jwt_min_lifetime"`
+	// Policy is an inline session policy, or the path to a file containing
+	// one.
+	Policy     string   `yaml:"policy"`
+	PolicyARNs []string `yaml:"policy_arns"`
+	ProviderID string   `yaml:"provider_id"`
+	// policy is loaded from Policy.
+	policy string
+	// roleSessionName is parsed from RoleSessionName.
+	roleSessionName roleSessionName
+	// mode, owner and metadata are how the credentials file is written,
+	// from the profile or the top level of the file.
+	mode     os.FileMode
+	owner    *internal.FileOwner
+	metadata bool
+
+	// AssumeRoles are chained after the SVID has been exchanged, in order.
+	AssumeRoles []assumeRoleHop `yaml:"assume_roles"`
+}
+
+func loadProfilesFile(path string) (*profilesFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading profiles file: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	pf := &profilesFile{}
+	if err := dec.Decode(pf); err != nil {
+		return nil, fmt.Errorf("parsing profiles file: %w", err)
+	}
+
+	if len(pf.Profiles) == 0 {
+		return nil, errors.New("profiles file must contain at least one profile")
+	}
+	pf.mode = internal.DefaultAWSFileMode
+	if pf.AWSCredentialsMode != "" {
+		if pf.mode, err = parseFileMode(pf.AWSCredentialsMode); err != nil {
+			return nil, fmt.Errorf("aws_credentials_mode: %w", err)
+		}
+	}
+	if pf.AWSCredentialsOwner != "" {
+		if pf.owner, err = parseFileOwner(pf.AWSCredentialsOwner); err != nil {
+			return nil, fmt.Errorf("aws_credentials_owner: %w", err)
+		}
+	}
+	seen := map[profileID]bool{}
+	// files holds the first profile written to each credentials file, so
+	// that the others can be checked against its mode and owner.
+	files := map[string]*profileConfig{}
+	for i := range pf.Profiles {
+		p := &pf.Profiles[i]
+		if p.AWSCredentialsPath == "" {
+			p.AWSCredentialsPath = pf.AWSCredentialsPath
+		}
+		if p.WorkloadAPIAddr == "" {
+			p.WorkloadAPIAddr = pf.WorkloadAPIAddr
+		}
+		if p.SessionDuration == 0 {
+			p.SessionDuration = 3600
+		}
+		if err := p.applyFileSettings(pf); err != nil {
+			return nil, fmt.Errorf("profile %d (%q): %w", i, p.Name, err)
+		}
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("profile %d (%q): %w", i, p.Name, err)
+		}
+		if seen[p.id()] {
+			return nil, fmt.Errorf("profile %q is defined more than once for %q", p.Name, p.AWSCredentialsPath)
+		}
+		seen[p.id()] = true
+		if first, ok := files[p.AWSCredentialsPath]; !ok {
+			files[p.AWSCredentialsPath] = p
+		} else if first.mode != p.mode || !sameFileOwner(first.owner, p.owner) {
+			return nil, fmt.Errorf(
+				"profiles %q and %q share %q, but set a different aws_credentials_mode or aws_credentials_owner",
+				first.Name, p.Name, p.AWSCredentialsPath,
+			)
+		}
+	}
+	return pf, nil
+}
+
+// applyFileSettings sets how the credentials file of the profile is written,
+// from the settings of the profile or, where it does not set them, the top
+// level of the profiles file.
+func (p *profileConfig) applyFileSettings(pf *profilesFile) error {
+	var err error
+	p.mode = pf.mode
+	if p.AWSCredentialsMode != "" {
+		if p.mode, err = parseFileMode(p.AWSCredentialsMode); err != nil {
+			return fmt.Errorf("aws_credentials_mode: %w", err)
+		}
+	}
+	p.owner = pf.owner
+	if p.AWSCredentialsOwner != "" {
+		if p.owner, err = parseFileOwner(p.AWSCredentialsOwner); err != nil {
+			return fmt.Errorf("aws_credentials_owner: %w", err)
+		}
+	}
+	p.metadata = pf.AWSCredentialsMetadata
+	if p.AWSCredentialsMetadata != nil {
+		p.metadata = *p.AWSCredentialsMetadata
+	}
+	return nil
+}
+
+func sameFileOwner(a, b *internal.FileOwner) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// id identifies the profile in the metrics and health state.
+func (p *profileConfig) id() profileID {
+	return profileID{path: p.AWSCredentialsPath, name: p.Name}
+}
+
+func (p *profileConfig) validate() error {
+	if p.Name == "" {
+		return errors.New("name is required")
+	}
+	if p.AWSCredentialsPath == "" {
+		return errors.New("aws_credentials_path is required")
+	}
+	type field struct{ name, value string }
+	var required []field
+	switch p.Type {
+	case "x509":
+		required = []field{
+			{"role_arn", p.RoleARN},
+			{"profile_arn", p.ProfileARN},
+			{"trust_anchor_arn", p.TrustAnchorARN},
+		}
+	case "jwt":
+		required = []field{
+			{"audience", p.Audience},
+			{"endpoint", p.Endpoint},
+		}
+	default:
+		return fmt.Errorf("type must be one of x509 or jwt, got %q", p.Type)
+	}
+	for _, f := range required {
+		if f.value == "" {
+			return fmt.Errorf("%s is required for %s profiles", f.name, p.Type)
+		}
+	}
+	roleSessionName, err := parseRoleSessionName(p.RoleSessionName)
+	if err != nil {
+		return fmt.Errorf("role_session_name: %w", err)
+	}
+	p.roleSessionName = roleSessionName
+	selector := svidSelector{hint: p.Hint, spiffeID: p.SPIFFEID}
+	if err := selector.validate(); err != nil {
+		return fmt.Errorf("spiffe_id: %w", err)
+	}
+	if p.Type == "jwt" {
+		if _, err := selector.subject(); err != nil {
+			return fmt.Errorf("spiffe_id: %w", err)
+		}
+		if p.JWTMinLifetime < 0 {
+			return fmt.Errorf("jwt_min_lifetime must not be negative, got %s", p.JWTMinLifetime)
+		}
+		if p.Policy != "" {
+			policy, err := loadSessionPolicy(p.Policy)
+			if err != nil {
+				return fmt.Errorf("policy: %w", err)
+			}
+			p.policy = policy
+		}
+		if err := credentialprovider.ValidateSessionPolicyARNs(p.PolicyARNs); err != nil {
+			return fmt.Errorf("policy_arns: %w", err)
+		}
+	} else if len(p.ExtraAudiences) > 0 {
+		return errors.New("extra_audiences is only supported for jwt profiles")
+	} else if p.ValidateJWT || p.JWTMinLifetime != 0 {
+		return errors.New("validate_jwt and jwt_min_lifetime are only supported for jwt profiles")
+	} else if p.Policy != "" || len(p.PolicyARNs) > 0 || p.ProviderID != "" {
+		return errors.New("policy, policy_arns and provider_id are only supported for jwt profiles")
+	}
+	for i, hop := range p.AssumeRoles {
+		if hop.RoleARN == "" {
+			return fmt.Errorf("assume_roles[%d]: role_arn is required", i)
+		}
+		if err := hop.validate(); err != nil {
+			return fmt.Errorf("assume_roles[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// newSource creates the credential source described by the profile.
+func (p *profileConfig) newSource(ctx context.Context) (svidCredentialSource, error) {
+	if p.Type == "jwt" {
+		jwtMinLifetime := p.JWTMinLifetime
+		if jwtMinLifetime == 0 {
+			jwtMinLifetime = defaultJWTMinLifetime
+		}
+		return newJWTCredentialSource(ctx, &sharedJWTFlags{
+			roleARN:         p.RoleARN,
+			audience:        p.Audience,
+			extraAudiences:  p.ExtraAudiences,
+			endpoint:        p.Endpoint,
+			sessionDuration: p.SessionDuration,
+			roleSessionName: p.roleSessionName,
+			workloadAPIAddr: p.WorkloadAPIAddr,
+			hint:            p.Hint,
+			spiffeID:        p.SPIFFEID,
+			assumeRoles:     p.AssumeRoles,
+			validateJWT:     p.ValidateJWT,
+			jwtMinLifetime:  jwtMinLifetime,
+			policy:          p.policy,
+			policyARNs:      p.PolicyARNs,
+			providerID:      p.ProviderID,
+		})
+	}
+	return newX509CredentialSource(ctx, &sharedX509Flags{
+		roleARN:         p.RoleARN,
+		region:          p.Region,
+		profileARN:      p.ProfileARN,
+		sessionDuration: p.SessionDuration,
+		trustAnchorARN:  p.TrustAnchorARN,
+		roleSessionName: p.roleSessionName,
+		workloadAPIAddr: p.WorkloadAPIAddr,
+		endpoint:        p.Endpoint,
+		hint:            p.Hint,
+		spiffeID:        p.SPIFFEID,
+		assumeRoles:     p.AssumeRoles,
+	})
+}
+
+func newMultiCredentialFileCmd() (*cobra.Command, error) {
+	var (
+		profilesPath string
+		force        bool
+		removeOnExit bool
+	)
+	df := &sharedDaemonFlags{}
+	cmd := &cobra.Command{
+		Use:   "multi-credential-file",
+		Short: `On a regular basis, this daemon exchanges SVIDs for several sets of AWS credentials. Writes each set of credentials to a named profile in a file in the 'credential file' format expected by the AWS CLI and SDKs.`,
+		Long:  `On a regular basis, this daemon exchanges SVIDs for several sets of AWS credentials, as described by a profiles file. Writes each set of credentials to a named profile in a file in the 'credential file' format expected by the AWS CLI and SDKs. Each profile is renewed independently, and a failing profile is retried without affecting the others.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			pf, err := loadProfilesFile(profilesPath)
+			if err != nil {
+				return err
+			}
+			return daemonMultiCredentialFile(cmd.Context(), pf, force, removeOnExit, df)
+		},
+	}
+	cmd.Flags().StringVar(&profilesPath, "profiles-file", "", "The path to a YAML file describing the profiles to maintain.")
+	if err := cmd.MarkFlagRequired("profiles-file"); err != nil {
+		return nil, fmt.Errorf("marking profiles-file flag as required: %w", err)
+	}
+	cmd.Flags().BoolVar(&force, "force", false, "If set, failures loading the existing AWS credentials files will be ignored and the contents overwritten.")
+	cmd.Flags().BoolVar(&removeOnExit, "remove-on-exit", false, "If set, each profile is removed from its AWS credentials file when the daemon exits.")
+	df.addFlags(cmd.Flags())
+	return cmd, nil
+}
+
+func daemonMultiCredentialFile(
+	ctx context.Context,
+	pf *profilesFile,
+	force bool,
+	removeOnExit bool,
+	df *sharedDaemonFlags,
+) error {
+	if err := df.validate(); err != nil {
+		return err
+	}
+	slog.Info("Starting AWS credential file daemon", "profiles", len(pf.Profiles))
+
+	// Profiles may share a credentials file, so writes are serialized to
+	// prevent one profile's write from discarding another's.
+	var writeMu sync.Mutex
+	t := df.newTelemetry()
+	g, ctx := errgroup.WithContext(ctx)
+	t.serve(ctx, g)
+	for _, p := range pf.Profiles {
+		cf := &sharedCredentialFileFlags{
+			awsCredentialsPath: p.AWSCredentialsPath,
+			profileName:        p.Name,
+			force:              force,
+			removeOnExit:       removeOnExit,
+			mode:               p.mode,
+			owner:              p.owner,
+			metadata:           p.metadata,
+		}
+		// Register the profile up front, so that the command is not ready
+		// until every profile has written its credentials.
+		t.health.profile(p.id())
+		write := t.metrics.instrumentFileWrite(func(creds *exchangedCredentials) error {
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			return cf.writeRenewedCredentials(creds)
+		}, p.Type, p.id())
+		remove := func() error {
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			return cf.removeCredentials()
+		}
+
+		g.Go(func() error {
+			if cf.removeOnExit {
+				defer func() {
+					if err := remove(); err != nil {
+						slog.Error("Failed to remove profile", "profile", p.Name, "error", err)
+					}
+				}()
+			}
+			for {
+				err := runProfile(ctx, p, t, write, remove, &df.retry, &df.renewal)
+				if ctx.Err() != nil {
+					return nil
+				}
+				if !isRetryable(err) {
+					// Restarting cannot resolve the error without a
+					// change in configuration, so the profile is
+					// stopped for good. The other profiles continue.
+					t.health.stop(p.id(), err)
+					slog.Error(
+						"Profile failed with an error that cannot be resolved by retrying, it will not be restarted",
+						"profile", p.Name,
+						"path", p.AWSCredentialsPath,
+						"error", err,
+					)
+					return nil
+				}
+				t.health.recordError(p.id(), err)
+				slog.Error(
+					"Profile failed, it will be restarted",
+					"profile", p.Name,
+					"path", p.AWSCredentialsPath,
+					"error", err,
+					"restart_in", profileRestartDelay,
+				)
+				select {
+				case <-time.After(profileRestartDelay):
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		})
+	}
+	return g.Wait()
+}
+
+func runProfile(
+	ctx context.Context,
+	p profileConfig,
+	t *daemonTelemetry,
+	write func(creds *exchangedCredentials) error,
+	remove func() error,
+	retry *retryPolicy,
+	renewal *internal.RenewalPolicy,
+) error {
+	slog.Info("Starting profile", "profile", p.Name, "type", p.Type)
+	src, err := p.newSource(ctx)
+	if err != nil {
+		return err
+	}
+	defer src.close()
+	instrumented, write, remove := t.instrument(src, p.id(), write, remove)
+	return renewCredentials(ctx, instrumented, write, remove, retry, renewal)
+}
@@ -0,0 +1,19 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spiffe/aws-spiffe-workload-helper/internal"
+)
+
+// addRenewalFlags adds the flags which configure when the long-running
+// commands renew AWS credentials.
+func addRenewalFlags(flags *pflag.FlagSet, p *internal.RenewalPolicy) {
+	flags.StringVar(&p.Policy, "renewal-policy", internal.RenewalPolicyFraction, fmt.Sprintf("When to renew the AWS credentials. One of %v: 'fraction' renews once --renewal-fraction of their remaining lifetime has passed, 'interval' renews every --renewal-interval, 'before-expiry' renews --renewal-before-expiry before they expire and 'svid' renews when the SVID is rotated. Credentials are always renewed when the SVID is rotated.", internal.RenewalPolicies))
+	flags.Float64Var(&p.Fraction, "renewal-fraction", 0.5, "With the 'fraction' renewal policy, the fraction of the remaining lifetime of the AWS credentials after which they are renewed.")
+	flags.DurationVar(&p.Interval, "renewal-interval", 15*time.Minute, "With the 'interval' renewal policy, how often the AWS credentials are renewed.")
+	flags.DurationVar(&p.BeforeExpiry, "renewal-before-expiry", 10*time.Minute, "With the 'before-expiry' renewal policy, how long before the AWS credentials expire they are renewed.")
+	flags.Float64Var(&p.Jitter, "renewal-jitter", 0, "If set, each renewal is brought forward by a random amount of up to this fraction of the time until it is due, e.g. 0.1 for up to 10%. This prevents many instances started at once from renewing at the same instant.")
+}
@@ -0,0 +1,152 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spiffe/aws-spiffe-workload-helper/credentialprovider"
+)
+
+// Give-up policies, which determine when the long-running commands stop
+// retrying a failed renewal and exit.
+const (
+	// giveUpNever retries all failures indefinitely.
+	giveUpNever = "never"
+	// giveUpFatal exits as soon as a failure that cannot be resolved by
+	// retrying occurs, e.g. access being denied.
+	giveUpFatal = "fatal"
+	// giveUpExpired exits on fatal failures, and once the last credentials
+	// that were obtained have expired.
+	giveUpExpired = "expired"
+)
+
+var giveUpPolicies = []string{giveUpNever, giveUpFatal, giveUpExpired}
+
+// fatalAWSErrorCodes are error codes returned by AWS which indicate that
+// retrying the request will not succeed without a change in configuration.
+var fatalAWSErrorCodes = []string{
+	"AccessDenied",
+	"AccessDeniedException",
+	"InvalidParameterValue",
+	"MalformedPolicyDocument",
+	"PackedPolicyTooLarge",
+	"RegionDisabledException",
+	"ResourceNotFoundException",
+	"ValidationError",
+	"ValidationException",
+}
+
+// retryableAWSErrorCodes are error codes returned by AWS which are not
+// identified as transient by credentialprovider.APIError, but which are
+// resolved by retrying.
+var retryableAWSErrorCodes = []string{
+	// The identity provider could not be reached by STS.
+	"IDPCommunicationError",
+	// A fresh SVID is fetched on each attempt.
+	"ExpiredTokenException",
+}
+
+// fatalError marks an error which cannot be resolved by retrying, such as
+// a misconfiguration detected before a request is made.
+type fatalError struct {
+	err error
+}
+
+func (e *fatalError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fatalError) Unwrap() error {
+	return e.err
+}
+
+// isRetryable returns whether a failed renewal may succeed if it is retried.
+// Throttling, network errors and server errors are retryable, whereas errors
+// indicating that the request is invalid or not permitted are not. Errors
+// which cannot be identified are treated as retryable.
+func isRetryable(err error) bool {
+	var fe *fatalError
+	if errors.As(err, &fe) {
+		return false
+	}
+	var apiErr *credentialprovider.APIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.Transient():
+			return true
+		case slices.Contains(retryableAWSErrorCodes, apiErr.Code()):
+			return true
+		case slices.Contains(fatalAWSErrorCodes, apiErr.Code()):
+			return false
+		}
+		return apiErr.StatusCode() == 0
+	}
+	return true
+}
+
+// retryPolicy controls how the long-running commands retry failed renewals.
+type retryPolicy struct {
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	giveUp         string
+	// maxElapsed is how long renewals may fail consecutively before giving
+	// up. If zero, there is no limit.
+	maxElapsed time.Duration
+}
+
+func (p *retryPolicy) addFlags(flags *pflag.FlagSet) {
+	flags.DurationVar(&p.initialBackoff, "retry-initial-backoff", time.Second, "How long to wait before retrying the first failed renewal. The wait doubles with each consecutive failure.")
+	flags.DurationVar(&p.maxBackoff, "retry-max-backoff", 5*time.Minute, "The longest wait between retries of failed renewals.")
+	flags.StringVar(&p.giveUp, "retry-give-up", giveUpFatal, "When to stop retrying failed renewals and exit. One of 'never', 'fatal' (on errors that cannot be resolved by retrying, e.g. access denied) or 'expired' (on fatal errors, or once the last credentials obtained have expired).")
+	flags.DurationVar(&p.maxElapsed, "retry-max-elapsed", 0, "If set, stop retrying and exit once renewals have failed consecutively for this long.")
+}
+
+func (p *retryPolicy) validate() error {
+	if !slices.Contains(giveUpPolicies, p.giveUp) {
+		return fmt.Errorf("retry-give-up must be one of %v, got %q", giveUpPolicies, p.giveUp)
+	}
+	if p.initialBackoff <= 0 {
+		return fmt.Errorf("retry-initial-backoff must be positive, got %s", p.initialBackoff)
+	}
+	if p.maxBackoff < p.initialBackoff {
+		return fmt.Errorf("retry-max-backoff must not be less than retry-initial-backoff, got %s", p.maxBackoff)
+	}
+	return nil
+}
+
+// backoff returns how long to wait before the next attempt, given the number
+// of consecutive failures so far. The wait grows exponentially up to the
+// maximum, and is jittered so that many helpers failing at once do not retry
+// in lockstep.
+func (p *retryPolicy) backoff(failures int) time.Duration {
+	d := p.initialBackoff
+	for i := 1; i < failures && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.maxBackoff)
+	return d/2 + rand.N(d/2+1)
+}
+
+// shouldGiveUp returns whether to stop retrying after err, given when
+// renewals started failing and the last credentials successfully obtained,
+// which may be nil.
+func (p *retryPolicy) shouldGiveUp(
+	err error,
+	failingSince time.Time,
+	last *exchangedCredentials,
+) bool {
+	if p.maxElapsed > 0 && time.Since(failingSince) >= p.maxElapsed {
+		return true
+	}
+	switch p.giveUp {
+	case giveUpFatal:
+		return !isRetryable(err)
+	case giveUpExpired:
+		return !isRetryable(err) || (last != nil && time.Now().After(last.expiresAt))
+	}
+	return false
+}
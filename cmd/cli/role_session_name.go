@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// roleSessionNameData is the data available to a --role-session-name
+// template.
+type roleSessionNameData struct {
+	// SPIFFEID is the SPIFFE ID of the SVID, e.g.
+	// spiffe://example.org/ns/default/sa/app.
+	SPIFFEID string
+	// TrustDomain is the trust domain of the SVID, e.g. example.org.
+	TrustDomain string
+	// Path is the path of the SPIFFE ID, without the leading slash, e.g.
+	// ns/default/sa/app.
+	Path string
+	// Hint is the hint of the SVID, if the Workload API set one.
+	Hint string
+	// Hostname is the hostname of the machine.
+	Hostname string
+	// PodName is the value of the POD_NAME environment variable, which is
+	// typically set using the Kubernetes downward API. If unset, it is the
+	// hostname, which Kubernetes sets to the pod name by default.
+	PodName string
+}
+
+// isRoleSessionNameTemplate returns whether s is a template, rather than a
+// static role session name which is used as given.
+func isRoleSessionNameTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// roleSessionName is a role session name, which may be a template rendered
+// from the SVID. The zero value is an empty static name.
+type roleSessionName struct {
+	value string
+	// tmpl is the parsed template, or nil if value is a static name.
+	tmpl *template.Template
+}
+
+// parseRoleSessionName parses s as a role session name. Templates are parsed
+// up front, so that syntax errors are reported before any SVID is fetched.
+func parseRoleSessionName(s string) (roleSessionName, error) {
+	if !isRoleSessionNameTemplate(s) {
+		return roleSessionName{value: s}, nil
+	}
+	tmpl, err := template.New("role-session-name").
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"env": os.Getenv}).
+		Parse(s)
+	if err != nil {
+		return roleSessionName{}, fmt.Errorf("parsing role session name template: %w", err)
+	}
+	return roleSessionName{value: s, tmpl: tmpl}, nil
+}
+
+// render renders the role session name for the SVID with the given SPIFFE ID
+// and hint. The result is made a valid role session name by replacing
+// disallowed characters and truncating it, so that it is not rejected by AWS.
+// Static role session names are returned unchanged.
+func (n roleSessionName) render(id spiffeid.ID, hint string) (string, error) {
+	if n.tmpl == nil {
+		return n.value, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("determining hostname: %w", err)
+	}
+	podName := os.Getenv("POD_NAME")
+	if podName == "" {
+		podName = hostname
+	}
+	data := roleSessionNameData{
+		SPIFFEID:    id.String(),
+		TrustDomain: id.TrustDomain().Name(),
+		Path:        strings.TrimPrefix(id.Path(), "/"),
+		Hint:        hint,
+		Hostname:    hostname,
+		PodName:     podName,
+	}
+	var buf bytes.Buffer
+	if err := n.tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("rendering role session name template: %w", err)
+	}
+
+	name := sanitizeSTSIdentifier(buf.String())
+	// AWS requires role session names of at least two characters.
+	if len(name) < 2 {
+		return "", fmt.Errorf("role session name template %q rendered %q, which is shorter than 2 characters", n.value, name)
+	}
+	return name, nil
+}
+
+// roleSessionNameFlag is a flag holding a role session name, which is parsed
+// when the flag is set.
+type roleSessionNameFlag struct {
+	name *roleSessionName
+}
+
+func (f *roleSessionNameFlag) Set(s string) error {
+	name, err := parseRoleSessionName(s)
+	if err != nil {
+		return err
+	}
+	*f.name = name
+	return nil
+}
+
+func (f *roleSessionNameFlag) String() string {
+	return f.name.value
+}
+
+func (f *roleSessionNameFlag) Type() string {
+	return "string"
+}
+
+const roleSessionNameFlagUsage = "The identifier for the role session. Optional. " +
+	"May be a Go template, rendered from the SVID, using {{.SPIFFEID}}, {{.TrustDomain}}, {{.Path}}, {{.Hint}}, {{.Hostname}}, {{.PodName}} and {{env \"NAME\"}}. " +
+	"Characters which AWS does not allow are replaced with '-', and the result is truncated to 64 characters."
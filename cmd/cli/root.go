@@ -1,22 +1,26 @@
 package cli
 
 import (
-	"encoding/xml"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
-	"net/http"
-	"net/url"
+	"os"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/spf13/cobra"
-	awsspiffe "github.com/spiffe/aws-spiffe-workload-helper"
+	"github.com/spiffe/aws-spiffe-workload-helper/credentialprovider"
+	"github.com/spiffe/aws-spiffe-workload-helper/internal"
 	"github.com/spiffe/aws-spiffe-workload-helper/vendoredaws"
 	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
 	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
 func NewRootCmd(version string) (*cobra.Command, error) {
 	var debug bool
+	var configPath string
 	rootCmd := &cobra.Command{
 		Use:     "aws-spiffe-workload-helper",
 		Short:   `A light-weight tool intended to assist in providing a workload with credentials for AWS using its SPIFFE identity.`,
@@ -24,10 +28,15 @@ func NewRootCmd(version string) (*cobra.Command, error) {
 		Version: version,
 	}
 	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "Enable debug logging")
-	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+	rootCmd.PersistentFlags().StringVar(&configPath, "config", "", "Path to a YAML file, or a TOML file if it has a .toml extension, to read settings from. Settings are named after flags, with dashes replaced by underscores. Flags, and AWS_SPIFFE_* environment variables, take precedence over the file.")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if err := applyConfig(cmd); err != nil {
+			return err
+		}
 		if debug {
 			slog.SetLogLoggerLevel(slog.LevelDebug)
 		}
+		return nil
 	}
 
 	x509CredentialProcessCmd, err := newX509CredentialProcessCmd()
@@ -54,6 +63,60 @@ func NewRootCmd(version string) (*cobra.Command, error) {
 	}
 	rootCmd.AddCommand(JWTCredentialProcessCmd)
 
+	jwtCredentialFileCmd, err := newJWTCredentialFileCmd()
+	if err != nil {
+		return nil, fmt.Errorf("initializing jwt-credential-file command: %w", err)
+	}
+	rootCmd.AddCommand(jwtCredentialFileCmd)
+
+	jwtCredentialFileOneshotCmd, err := newJWTCredentialFileOneshotCmd()
+	if err != nil {
+		return nil, fmt.Errorf("initializing jwt-credential-file-oneshot command: %w", err)
+	}
+	rootCmd.AddCommand(jwtCredentialFileOneshotCmd)
+
+	multiCredentialFileCmd, err := newMultiCredentialFileCmd()
+	if err != nil {
+		return nil, fmt.Errorf("initializing multi-credential-file command: %w", err)
+	}
+	rootCmd.AddCommand(multiCredentialFileCmd)
+
+	imdsServerCmd, err := newIMDSServerCmd()
+	if err != nil {
+		return nil, fmt.Errorf("initializing imds-server command: %w", err)
+	}
+	rootCmd.AddCommand(imdsServerCmd)
+
+	containerCredentialsServerCmd, err := newContainerCredentialsServerCmd()
+	if err != nil {
+		return nil, fmt.Errorf("initializing container-credentials-server command: %w", err)
+	}
+	rootCmd.AddCommand(containerCredentialsServerCmd)
+
+	signingProxyCmd, err := newSigningProxyCmd()
+	if err != nil {
+		return nil, fmt.Errorf("initializing signing-proxy command: %w", err)
+	}
+	rootCmd.AddCommand(signingProxyCmd)
+
+	configureCmd, err := newConfigureCmd()
+	if err != nil {
+		return nil, fmt.Errorf("initializing configure command: %w", err)
+	}
+	rootCmd.AddCommand(configureCmd)
+
+	execCmd, err := newExecCmd()
+	if err != nil {
+		return nil, fmt.Errorf("initializing exec command: %w", err)
+	}
+	rootCmd.AddCommand(execCmd)
+
+	envCmd, err := newEnvCmd()
+	if err != nil {
+		return nil, fmt.Errorf("initializing env command: %w", err)
+	}
+	rootCmd.AddCommand(envCmd)
+
 	return rootCmd, nil
 }
 
@@ -63,9 +126,28 @@ type sharedX509Flags struct {
 	profileARN      string
 	sessionDuration int
 	trustAnchorARN  string
-	roleSessionName string
+	roleSessionName roleSessionName
 	workloadAPIAddr string
 	endpoint        string
+	// hint and spiffeID select the X509 SVID to use. If both are empty, the
+	// default SVID is used.
+	hint        string
+	spiffeID    string
+	assumeRoles assumeRoleChain
+}
+
+func (f *sharedX509Flags) selector() svidSelector {
+	return svidSelector{hint: f.hint, spiffeID: f.spiffeID}
+}
+
+// selectX509SVID selects the X509 SVID configured by the flags from those
+// issued to the workload.
+func (f *sharedX509Flags) selectX509SVID(x509Ctx *workloadapi.X509Context) (*x509svid.SVID, error) {
+	selector := f.selector()
+	if err := selector.validate(); err != nil {
+		return nil, err
+	}
+	return selector.selectX509SVID(x509Ctx.SVIDs, nil)
 }
 
 func (f *sharedX509Flags) addFlags(cmd *cobra.Command) error {
@@ -83,9 +165,12 @@ func (f *sharedX509Flags) addFlags(cmd *cobra.Command) error {
 	if err := cmd.MarkFlagRequired("trust-anchor-arn"); err != nil {
 		return fmt.Errorf("marking trust-anchor-arn flag as required: %w", err)
 	}
-	cmd.Flags().StringVar(&f.roleSessionName, "role-session-name", "", "The identifier for the role session. Optional.")
+	cmd.Flags().Var(&roleSessionNameFlag{name: &f.roleSessionName}, "role-session-name", roleSessionNameFlagUsage)
 	cmd.Flags().StringVar(&f.workloadAPIAddr, "workload-api-addr", "", "Overrides the address of the Workload API endpoint that will be use to fetch the X509 SVID. If unspecified, the value from the SPIFFE_ENDPOINT_SOCKET environment variable will be used.")
 	cmd.Flags().StringVar(&f.endpoint, "endpoint", "", "Overrides the Roles Anywhere API endpoint URL. Optional.")
+	cmd.Flags().Var(&assumeRoleFlag{chain: &f.assumeRoles}, "assume-role", assumeRoleFlagUsage)
+	cmd.Flags().StringVar(&f.hint, "hint", "", "If set, selects the X509 SVID with this hint. Optional.")
+	cmd.Flags().StringVar(&f.spiffeID, "spiffe-id", "", "If set, selects the X509 SVID with this SPIFFE ID. May be a glob pattern, e.g. spiffe://example.org/db/*, where * does not match /. Optional.")
 	return nil
 }
 
@@ -94,9 +179,30 @@ type sharedJWTFlags struct {
 	audience        string
 	endpoint        string
 	sessionDuration int
-	roleSessionName string
+	roleSessionName roleSessionName
 	workloadAPIAddr string
-	hint            string
+	// extraAudiences are requested in the JWT SVID alongside audience, for
+	// STS-compatible services which expect a different audience.
+	extraAudiences []string
+	// hint and spiffeID select the JWT SVID to use. If both are empty, the
+	// default SVID is used.
+	hint        string
+	spiffeID    string
+	assumeRoles assumeRoleChain
+	// validateJWT enables validation of the JWT SVID against the JWT bundles
+	// from the Workload API before it is sent to STS. jwtMinLifetime is the
+	// remaining lifetime the JWT SVID must have to pass validation.
+	validateJWT    bool
+	jwtMinLifetime time.Duration
+	// policy and policyARNs restrict the permissions of the role for the
+	// session.
+	policy     string
+	policyARNs []string
+	providerID string
+}
+
+func (f *sharedJWTFlags) selector() svidSelector {
+	return svidSelector{hint: f.hint, spiffeID: f.spiffeID}
 }
 
 func (f *sharedJWTFlags) addFlags(cmd *cobra.Command) error {
@@ -109,114 +215,337 @@ func (f *sharedJWTFlags) addFlags(cmd *cobra.Command) error {
 		return fmt.Errorf("marking endpoint flag as required: %w", err)
 	}
 	cmd.Flags().IntVar(&f.sessionDuration, "session-duration", 3600, "The duration, in seconds, of the resulting session. Optional. Can range from 15 minutes (900) to 12 hours (43200).")
-	cmd.Flags().StringVar(&f.roleSessionName, "role-session-name", "", "The identifier for the role session. Optional.")
+	cmd.Flags().Var(&roleSessionNameFlag{name: &f.roleSessionName}, "role-session-name", roleSessionNameFlagUsage)
 	cmd.Flags().StringVar(&f.workloadAPIAddr, "workload-api-addr", "", "Overrides the address of the Workload API endpoint that will be use to fetch the X509 SVID. If unspecified, the value from the SPIFFE_ENDPOINT_SOCKET environment variable will be used.")
 	cmd.Flags().StringVar(&f.roleARN, "role-arn", "", "The ARN of the role to assume.")
 	cmd.Flags().StringVar(&f.hint, "hint", "", "Hint to use to find the SVID.")
+	cmd.Flags().StringVar(&f.spiffeID, "spiffe-id", "", "If set, requests the JWT SVID for this SPIFFE ID. May be a glob pattern, e.g. spiffe://example.org/db/*, where * does not match /, in which case the SVIDs for all SPIFFE IDs are requested and the first match is used. Optional.")
+	cmd.Flags().StringArrayVar(&f.extraAudiences, "extra-audience", nil, "An additional audience to request in the JWT SVID. Can be repeated. Optional.")
+	cmd.Flags().BoolVar(&f.validateJWT, "validate-jwt", false, "If set, the JWT SVID is validated against the JWT bundles from the Workload API before it is sent to STS. The signature, audience and expiry are checked.")
+	cmd.Flags().Var(&sessionPolicyFlag{policy: &f.policy}, "policy", "An inline session policy, as a JSON document or the path to a file containing one, which restricts the permissions of the role for the session. Optional.")
+	cmd.Flags().Var(&policyARNsFlag{arns: &f.policyARNs}, "policy-arn", "The ARN of a managed policy which restricts the permissions of the role for the session. Can be repeated up to 10 times. Optional.")
+	cmd.Flags().StringVar(&f.providerID, "provider-id", "", "The domain of the identity provider, which is only required by OAuth 2.0 providers. Optional.")
+	cmd.Flags().DurationVar(&f.jwtMinLifetime, "jwt-min-lifetime", defaultJWTMinLifetime, "The minimum remaining lifetime of the JWT SVID for it to pass validation with --validate-jwt.")
+	cmd.Flags().Var(&assumeRoleFlag{chain: &f.assumeRoles}, "assume-role", assumeRoleFlagUsage)
+	return nil
+}
+
+// addSVIDSourceCmds adds `x509` and `jwt` subcommands to cmd. Each subcommand
+// accepts the flags for its flow, and passes a source of AWS credentials
+// obtained using that flow to run, along with any positional arguments.
+func addSVIDSourceCmds(
+	cmd *cobra.Command,
+	run func(ctx context.Context, src svidCredentialSource, args []string) error,
+) error {
+	x509Flags := &sharedX509Flags{}
+	x509Cmd := &cobra.Command{
+		Use:   "x509",
+		Short: `Exchanges an X509 SVID for AWS credentials using AWS Roles Anywhere.`,
+		Long:  `Exchanges an X509 SVID for AWS credentials using AWS Roles Anywhere.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src, err := newX509CredentialSource(cmd.Context(), x509Flags)
+			if err != nil {
+				return err
+			}
+			defer src.close()
+			return run(cmd.Context(), src, args)
+		},
+	}
+	if err := x509Flags.addFlags(x509Cmd); err != nil {
+		return fmt.Errorf("adding shared flags: %w", err)
+	}
+	cmd.AddCommand(x509Cmd)
+
+	jwtFlags := &sharedJWTFlags{}
+	jwtCmd := &cobra.Command{
+		Use:   "jwt",
+		Short: `Exchanges a JWT SVID for AWS credentials using AWS AssumeRoleWithWebIdentity.`,
+		Long:  `Exchanges a JWT SVID for AWS credentials using AWS AssumeRoleWithWebIdentity.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src, err := newJWTCredentialSource(cmd.Context(), jwtFlags)
+			if err != nil {
+				return err
+			}
+			defer src.close()
+			return run(cmd.Context(), src, args)
+		},
+	}
+	if err := jwtFlags.addFlags(jwtCmd); err != nil {
+		return fmt.Errorf("adding shared flags: %w", err)
+	}
+	cmd.AddCommand(jwtCmd)
+
 	return nil
 }
 
+type sharedCredentialFileFlags struct {
+	awsCredentialsPath string
+	profileName        string
+	force              bool
+	replace            bool
+	mode               os.FileMode
+	owner              *internal.FileOwner
+	metadata           bool
+	removeOnExit       bool
+}
+
+func (f *sharedCredentialFileFlags) addFlags(cmd *cobra.Command) error {
+	cmd.Flags().StringVar(&f.awsCredentialsPath, "aws-credentials-path", "", "The path to the AWS credentials file to write.")
+	if err := cmd.MarkFlagRequired("aws-credentials-path"); err != nil {
+		return fmt.Errorf("marking aws-credentials-path flag as required: %w", err)
+	}
+	cmd.Flags().StringVar(&f.profileName, "aws-profile", "default", "The name of the profile to write the credentials to within the AWS credentials file.")
+	cmd.Flags().BoolVar(&f.force, "force", false, "If set, failures loading the existing AWS credentials file will be ignored and the contents overwritten.")
+	cmd.Flags().BoolVar(&f.replace, "replace", false, "If set, the AWS credentials file will be replaced if it exists. This will remove any profiles not written by this tool.")
+	f.mode = internal.DefaultAWSFileMode
+	cmd.Flags().Var(&fileModeFlag{mode: &f.mode}, "aws-credentials-mode", "The permissions, in octal, to write the AWS credentials file with.")
+	cmd.Flags().Var(&fileOwnerFlag{owner: &f.owner}, "aws-credentials-owner", "If set, the numeric UID, and optionally GID, to write the AWS credentials file with, e.g. 1000:1000. Typically requires root. Useful when writing credentials for a workload running as a different user.")
+	cmd.Flags().BoolVar(&f.metadata, "aws-credentials-metadata", false, "If set, metadata describing the credentials, such as when they expire and the SPIFFE ID they were obtained with, is written to the profile alongside them.")
+	return nil
+}
+
+// addDaemonFlags adds the flags which only apply to the daemons which keep
+// the AWS credentials file up to date.
+func (f *sharedCredentialFileFlags) addDaemonFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&f.removeOnExit, "remove-on-exit", false, "If set, the profile is removed from the AWS credentials file when the daemon exits, or the whole file is removed if --replace is set. This prevents the credentials from remaining usable once the daemon is no longer running.")
+}
+
+func (f *sharedCredentialFileFlags) fileConfig() internal.AWSCredentialsFileConfig {
+	return internal.AWSCredentialsFileConfig{
+		Path:        f.awsCredentialsPath,
+		ProfileName: f.profileName,
+		Force:       f.force,
+		ReplaceFile: f.replace,
+		Mode:        f.mode,
+		Owner:       f.owner,
+	}
+}
+
+// writeCredentials writes the AWS credentials to disk in the format that the
+// AWS CLI/SDK expects for a credentials file.
+func (f *sharedCredentialFileFlags) writeCredentials(
+	creds *exchangedCredentials,
+) error {
+	profile := internal.AWSCredentialsFileProfile{
+		AWSAccessKeyID:     creds.credentials.AccessKeyId,
+		AWSSecretAccessKey: creds.credentials.SecretAccessKey,
+		AWSSessionToken:    creds.credentials.SessionToken,
+	}
+	if f.metadata {
+		profile.AccountID = creds.accountID
+		profile.Expiration = creds.expiresAt
+		profile.SPIFFEID = creds.svidID.String()
+		profile.RoleARN = creds.roleARN
+		profile.ManagedBy = internal.AWSCredentialsFileManagedBy
+	}
+	err := internal.UpsertAWSCredentialsFileProfile(
+		slog.Default(),
+		f.fileConfig(),
+		profile,
+	)
+	if err != nil {
+		return fmt.Errorf("writing credentials to file: %w", err)
+	}
+	return nil
+}
+
+// writeRenewedCredentials writes a set of credentials renewed by one of the
+// daemons to the AWS credentials file.
+func (f *sharedCredentialFileFlags) writeRenewedCredentials(
+	creds *exchangedCredentials,
+) error {
+	slog.Debug(
+		"Writing AWS credentials to file",
+		"path", f.awsCredentialsPath,
+		"profile", f.profileName,
+	)
+	if err := f.writeCredentials(creds); err != nil {
+		return err
+	}
+	slog.Info(
+		"Wrote AWS credentials to file",
+		"path", f.awsCredentialsPath,
+		"profile", f.profileName,
+		"aws_expires_at", creds.expiresAt,
+		"svid", creds.svidValue(),
+	)
+	return nil
+}
+
+// removeCredentials removes the credentials written by writeCredentials from
+// the AWS credentials file. Its signature allows it to be passed directly to
+// renewCredentials.
+func (f *sharedCredentialFileFlags) removeCredentials() error {
+	if err := internal.RemoveAWSCredentialsFileProfile(slog.Default(), f.fileConfig()); err != nil {
+		return fmt.Errorf("removing credentials from file: %w", err)
+	}
+	slog.Info(
+		"Removed AWS credentials from file",
+		"path", f.awsCredentialsPath,
+		"profile", f.profileName,
+	)
+	return nil
+}
+
+// renewCredentialsFile keeps the AWS credentials file up to date using
+// renewCredentials, with write and remove wrapping writeRenewedCredentials
+// and removeCredentials. If configured to, the credentials are removed once
+// renewal stops.
+func (f *sharedCredentialFileFlags) renewCredentialsFile(
+	ctx context.Context,
+	src svidCredentialSource,
+	write func(creds *exchangedCredentials) error,
+	remove func() error,
+	retry *retryPolicy,
+	renewal *internal.RenewalPolicy,
+) error {
+	err := renewCredentials(ctx, src, write, remove, retry, renewal)
+	if f.removeOnExit {
+		if removeErr := f.removeCredentials(); removeErr != nil {
+			err = errors.Join(err, removeErr)
+		}
+	}
+	return err
+}
+
 func exchangeX509SVIDForAWSCredentials(
+	ctx context.Context,
 	sf *sharedX509Flags,
 	svid *x509svid.SVID,
 ) (vendoredaws.CredentialProcessOutput, error) {
-	signer := &awsspiffe.X509SVIDSigner{
-		SVID: svid,
+	// Malformed ARNs are detected before any request is made, so are marked
+	// as fatal to avoid retrying a request that can never succeed.
+	for _, a := range []string{sf.roleARN, sf.profileARN, sf.trustAnchorARN} {
+		if _, err := arn.Parse(a); err != nil {
+			return vendoredaws.CredentialProcessOutput{}, &fatalError{err: fmt.Errorf("parsing ARN %q: %w", a, err)}
+		}
 	}
-	signatureAlgorithm, err := signer.SignatureAlgorithm()
+	// An invalid template cannot be fixed by retrying either.
+	roleSessionName, err := sf.roleSessionName.render(svid.ID, svid.Hint)
 	if err != nil {
-		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("getting signature algorithm: %w", err)
+		return vendoredaws.CredentialProcessOutput{}, &fatalError{err: err}
 	}
-	credentials, err := vendoredaws.GenerateCredentials(&vendoredaws.CredentialsOpts{
-		RoleArn:           sf.roleARN,
-		ProfileArnStr:     sf.profileARN,
-		Region:            sf.region,
-		RoleSessionName:   sf.roleSessionName,
-		TrustAnchorArnStr: sf.trustAnchorARN,
-		SessionDuration:   sf.sessionDuration,
-		Endpoint:          sf.endpoint,
-	}, signer, signatureAlgorithm)
+	credentials, err := credentialprovider.ExchangeX509SVID(ctx, svid, credentialprovider.X509Config{
+		RoleARN:         sf.roleARN,
+		ProfileARN:      sf.profileARN,
+		TrustAnchorARN:  sf.trustAnchorARN,
+		Region:          sf.region,
+		Endpoint:        sf.endpoint,
+		RoleSessionName: roleSessionName,
+		SessionDuration: time.Duration(sf.sessionDuration) * time.Second,
+	})
 	if err != nil {
-		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("generating credentials: %w", err)
+		return vendoredaws.CredentialProcessOutput{}, err
 	}
 	slog.Debug(
 		"Generated AWS credentials",
 		"expiration", credentials.Expiration,
 	)
-	return credentials, nil
-}
-
-type AssumeRoleWithWebIdentityResponse struct {
-	XMLName                         xml.Name                        `xml:"https://sts.amazonaws.com/doc/2011-06-15/ AssumeRoleWithWebIdentityResponse"`
-	AssumeRoleWithWebIdentityResult AssumeRoleWithWebIdentityResult `xml:"AssumeRoleWithWebIdentityResult"`
-	ResponseMetadata                struct{}                        `xml:"ResponseMetadata"` // Empty struct if no fields are needed
+	return sf.assumeRoles.assume(ctx, credentials, svid.ID)
 }
 
-type AssumeRoleWithWebIdentityResult struct {
-	AssumedRoleUser AssumedRoleUser `xml:"AssumedRoleUser"`
-	Credentials     Credentials     `xml:"Credentials"`
-}
-
-type AssumedRoleUser struct {
-	Arn          string `xml:"Arn"`
-	AssumeRoleId string `xml:"AssumeRoleId"`
-}
-
-type Credentials struct {
-	AccessKeyId     string `xml:"AccessKeyId"`
-	SecretAccessKey string `xml:"SecretAccessKey"`
-	Expiration      string `xml:"Expiration"`
-	SessionToken    string `xml:"SessionToken"`
-}
-
-func exchangeJWTSVIDForAWSCredentials(sf *sharedJWTFlags, svid *jwtsvid.SVID) (vendoredaws.CredentialProcessOutput, error) {
-	token := svid.Marshal()
-	u, err := url.Parse(sf.endpoint)
-	if err != nil {
-		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("error parsing URL: %v", err)
+// fetchJWTSVID fetches a JWT SVID for the configured audiences from the
+// Workload API. If a SPIFFE ID or hint is configured, the first SVID matching
+// them is selected, otherwise the first SVID returned (a.k.a the default) is
+// used.
+func fetchJWTSVID(
+	ctx context.Context,
+	client *workloadapi.Client,
+	sf *sharedJWTFlags,
+) (*jwtsvid.SVID, error) {
+	selector := sf.selector()
+	if err := selector.validate(); err != nil {
+		return nil, err
 	}
-	queryParams := u.Query()
-	queryParams.Add("Action", "AssumeRoleWithWebIdentity")
-	queryParams.Add("WebIdentityToken", token)
-	queryParams.Add("Version", "2011-06-15")
-	queryParams.Add("DurationSeconds", fmt.Sprintf("%d", sf.sessionDuration))
-	if sf.roleARN != "" {
-		queryParams.Add("RoleArn", sf.roleARN)
+	subject, err := selector.subject()
+	if err != nil {
+		return nil, err
 	}
-	if sf.roleSessionName != "" {
-		queryParams.Add("RoleSessionName", sf.roleSessionName)
+	params := jwtsvid.Params{
+		Audience:       sf.audience,
+		ExtraAudiences: sf.extraAudiences,
+		Subject:        subject,
 	}
-	u.RawQuery = queryParams.Encode()
-	req, err := http.NewRequest("POST", u.String(), nil)
+	svids, err := client.FetchJWTSVIDs(ctx, params)
 	if err != nil {
-		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("error making new request: %v", err)
+		return nil, fmt.Errorf("fetching jwt: %w", err)
 	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	svid, err := selector.selectJWTSVID(svids)
 	if err != nil {
-		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("error performing the sts request: %v", err)
+		return nil, err
+	}
+	if len(svids) > 1 && selector == (svidSelector{}) {
+		slog.Warn("Received multiple SVIDs, but, no hint or SPIFFE ID matcher was set. Selecting the first SVID.")
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	slog.Debug("Fetched JWT SVID", "svid", jwtSVIDValue(svid))
+	return svid, nil
+}
+
+// defaultJWTMinLifetime leaves time for the JWT SVID to be sent to STS, and
+// for any retries, before it expires.
+const defaultJWTMinLifetime = time.Minute
+
+// validateJWTSVID checks the signature of svid against the JWT bundles from
+// the Workload API, and that it is for the configured audiences and will not
+// expire before the exchange completes. This gives a precise error, where STS
+// would reject the token with an opaque InvalidIdentityToken error.
+func validateJWTSVID(
+	ctx context.Context,
+	client *workloadapi.Client,
+	sf *sharedJWTFlags,
+	svid *jwtsvid.SVID,
+) error {
+	bundles, err := client.FetchJWTBundles(ctx)
 	if err != nil {
-		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("error reading response: %v", err)
+		return fmt.Errorf("fetching JWT bundles: %w", err)
+	}
+	// ParseAndValidate checks that the token has not expired, and contains
+	// at least one of the audiences, so each is checked separately.
+	for _, aud := range append([]string{sf.audience}, sf.extraAudiences...) {
+		if _, err := jwtsvid.ParseAndValidate(svid.Marshal(), bundles, []string{aud}); err != nil {
+			return err
+		}
+	}
+	if remaining := time.Until(svid.Expiry); remaining < sf.jwtMinLifetime {
+		return fmt.Errorf(
+			"JWT SVID expires at %s, in %s, which is less than the minimum lifetime of %s",
+			svid.Expiry.UTC().Format(time.RFC3339), remaining.Round(time.Second), sf.jwtMinLifetime,
+		)
 	}
-	if resp.StatusCode != 200 {
-		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("error performing the sts request: %d: %s: %s", resp.StatusCode, http.StatusText(resp.StatusCode), body)
+	return nil
+}
+
+func exchangeJWTSVIDForAWSCredentials(
+	ctx context.Context,
+	client *workloadapi.Client,
+	sf *sharedJWTFlags,
+	svid *jwtsvid.SVID,
+) (vendoredaws.CredentialProcessOutput, error) {
+	if sf.validateJWT {
+		if err := validateJWTSVID(ctx, client, sf, svid); err != nil {
+			return vendoredaws.CredentialProcessOutput{}, classifyError(
+				errorClassSVIDValidation, fmt.Errorf("validating JWT SVID: %w", err),
+			)
+		}
 	}
-	var stsResponse AssumeRoleWithWebIdentityResponse
-	err = xml.Unmarshal(body, &stsResponse)
+	roleSessionName, err := sf.roleSessionName.render(svid.ID, svid.Hint)
 	if err != nil {
-		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("error parsing xml respopse: %v", err)
+		return vendoredaws.CredentialProcessOutput{}, &fatalError{err: err}
 	}
-	cpo := vendoredaws.CredentialProcessOutput{
-		Version:         1,
-		AccessKeyId:     stsResponse.AssumeRoleWithWebIdentityResult.Credentials.AccessKeyId,
-		SecretAccessKey: stsResponse.AssumeRoleWithWebIdentityResult.Credentials.SecretAccessKey,
-		SessionToken:    stsResponse.AssumeRoleWithWebIdentityResult.Credentials.SessionToken,
-		Expiration:      stsResponse.AssumeRoleWithWebIdentityResult.Credentials.Expiration,
+	credentials, err := credentialprovider.ExchangeJWTSVID(ctx, svid, credentialprovider.JWTConfig{
+		RoleARN:         sf.roleARN,
+		Audience:        sf.audience,
+		Endpoint:        sf.endpoint,
+		RoleSessionName: roleSessionName,
+		SessionDuration: time.Duration(sf.sessionDuration) * time.Second,
+		Policy:          sf.policy,
+		PolicyARNs:      sf.policyARNs,
+		ProviderID:      sf.providerID,
+	})
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, err
 	}
-	return cpo, nil
+	return sf.assumeRoles.assume(ctx, credentials, svid.ID)
 }
 
 func svidValue(svid *x509svid.SVID) slog.Value {
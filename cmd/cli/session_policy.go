@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spiffe/aws-spiffe-workload-helper/credentialprovider"
+)
+
+// loadSessionPolicy returns the session policy described by s, which is
+// either an inline JSON document or the path to a file containing one. The
+// policy is validated, so that it is not rejected by STS after the SVID has
+// been fetched.
+func loadSessionPolicy(s string) (string, error) {
+	policy := s
+	if !strings.HasPrefix(strings.TrimSpace(s), "{") {
+		b, err := os.ReadFile(s)
+		if err != nil {
+			return "", fmt.Errorf("reading session policy file: %w", err)
+		}
+		policy = string(b)
+	}
+	if err := credentialprovider.ValidateSessionPolicy(policy); err != nil {
+		return "", err
+	}
+	return policy, nil
+}
+
+// sessionPolicyFlag is a flag holding a session policy, given either inline
+// or as the path to a file.
+type sessionPolicyFlag struct {
+	policy *string
+	// value is the flag as it was given, so that a path is passed through by
+	// the configure command rather than the contents of the file.
+	value string
+}
+
+func (f *sessionPolicyFlag) Set(s string) error {
+	policy, err := loadSessionPolicy(s)
+	if err != nil {
+		return err
+	}
+	*f.policy = policy
+	f.value = s
+	return nil
+}
+
+func (f *sessionPolicyFlag) String() string {
+	return f.value
+}
+
+func (f *sessionPolicyFlag) Type() string {
+	return "json|path"
+}
+
+// policyARNsFlag is a repeatable flag holding the ARNs of managed session
+// policies.
+type policyARNsFlag struct {
+	arns *[]string
+}
+
+func (f *policyARNsFlag) Set(s string) error {
+	arns := append(*f.arns, s)
+	if err := credentialprovider.ValidateSessionPolicyARNs(arns); err != nil {
+		return err
+	}
+	*f.arns = arns
+	return nil
+}
+
+func (f *policyARNsFlag) String() string {
+	if len(*f.arns) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(*f.arns, " ") + "]"
+}
+
+// GetSlice returns the ARNs passed to each flag, in order.
+func (f *policyARNsFlag) GetSlice() []string {
+	return *f.arns
+}
+
+func (f *policyARNsFlag) Type() string {
+	return "stringArray"
+}
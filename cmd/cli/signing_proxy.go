@@ -0,0 +1,248 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+)
+
+// signingProxyStrippedHeaders are removed from incoming requests, as they
+// would conflict with the signature added by the proxy.
+var signingProxyStrippedHeaders = []string{
+	"Authorization",
+	"X-Amz-Date",
+	"X-Amz-Security-Token",
+	"X-Amz-Content-Sha256",
+}
+
+// defaultSigningProxyMaxBodySize limits the memory used to sign a request.
+const defaultSigningProxyMaxBodySize = 10 << 20
+
+// contentSHA256Services are the services which require the hash of the
+// payload to be sent in the X-Amz-Content-Sha256 header.
+var contentSHA256Services = []string{
+	"glacier",
+	"s3",
+	"s3-object-lambda",
+	"s3-outposts",
+}
+
+type signingProxyFlags struct {
+	listenAddr     string
+	upstream       string
+	signingService string
+	signingRegion  string
+	host           string
+	allowHeaders   []string
+	maxBodySize    int64
+}
+
+func (f *signingProxyFlags) addFlags(cmd *cobra.Command) error {
+	cmd.PersistentFlags().StringVar(&f.listenAddr, "listen-addr", "127.0.0.1:1340", "The address the signing proxy should listen on.")
+	cmd.PersistentFlags().StringVar(&f.upstream, "upstream", "", "The URL of the AWS service endpoint that requests are forwarded to. Required.")
+	if err := cmd.MarkPersistentFlagRequired("upstream"); err != nil {
+		return fmt.Errorf("marking upstream flag as required: %w", err)
+	}
+	cmd.PersistentFlags().StringVar(&f.signingService, "signing-service", "", "The name of the AWS service that requests are signed for, e.g. 'aps' or 'es'. Required.")
+	if err := cmd.MarkPersistentFlagRequired("signing-service"); err != nil {
+		return fmt.Errorf("marking signing-service flag as required: %w", err)
+	}
+	cmd.PersistentFlags().StringVar(&f.signingRegion, "signing-region", "", "The AWS region that requests are signed for. Required.")
+	if err := cmd.MarkPersistentFlagRequired("signing-region"); err != nil {
+		return fmt.Errorf("marking signing-region flag as required: %w", err)
+	}
+	cmd.PersistentFlags().StringVar(&f.host, "host", "", "Overrides the Host header of forwarded requests. Defaults to the host of the upstream URL.")
+	cmd.PersistentFlags().StringArrayVar(&f.allowHeaders, "allow-header", nil, "A header which is forwarded to the upstream. Can be repeated. If unset, all headers are forwarded.")
+	cmd.PersistentFlags().Int64Var(&f.maxBodySize, "max-body-size", defaultSigningProxyMaxBodySize, "The largest request body, in bytes, that is forwarded. Request bodies are held in memory to be signed, and larger requests are rejected with 413 Request Entity Too Large.")
+	return nil
+}
+
+func newSigningProxyCmd() (*cobra.Command, error) {
+	f := &signingProxyFlags{}
+	cmd := &cobra.Command{
+		Use:   "signing-proxy",
+		Short: `Forwards HTTP requests to an AWS service, signing them with AWS credentials obtained using an SVID.`,
+		Long:  `Forwards plain HTTP requests from local applications to an AWS service, signing them with SigV4 using AWS credentials obtained using an SVID. This allows applications without an AWS SDK to authenticate to AWS using a SPIFFE identity. The credentials are renewed in the background. Use the x509 or jwt subcommand to select how the SVID is exchanged for AWS credentials.`,
+	}
+	if err := f.addFlags(cmd); err != nil {
+		return nil, fmt.Errorf("adding signing proxy flags: %w", err)
+	}
+	df := &sharedDaemonFlags{}
+	df.addFlags(cmd.PersistentFlags())
+	if err := addSVIDSourceCmds(cmd, func(ctx context.Context, src svidCredentialSource, _ []string) error {
+		return runSigningProxy(ctx, f, df, src)
+	}); err != nil {
+		return nil, fmt.Errorf("adding source subcommands: %w", err)
+	}
+	return cmd, nil
+}
+
+func runSigningProxy(
+	ctx context.Context,
+	f *signingProxyFlags,
+	df *sharedDaemonFlags,
+	src svidCredentialSource,
+) error {
+	if err := df.validate(); err != nil {
+		return err
+	}
+	if f.maxBodySize <= 0 {
+		return fmt.Errorf("max-body-size must be positive, got %d", f.maxBodySize)
+	}
+	upstream, err := url.Parse(f.upstream)
+	if err != nil {
+		return fmt.Errorf("parsing upstream URL: %w", err)
+	}
+	if upstream.Scheme == "" || upstream.Host == "" {
+		return fmt.Errorf("upstream must be an absolute URL, got %q", f.upstream)
+	}
+	slog.Info(
+		"Starting signing proxy",
+		"upstream", upstream.String(),
+		"signing_service", f.signingService,
+		"signing_region", f.signingRegion,
+	)
+	creds := newLatestCredentials()
+	proxy := newSigningProxy(f, upstream, creds)
+
+	t := df.newTelemetry()
+	g, ctx := errgroup.WithContext(ctx)
+	t.serve(ctx, g)
+	g.Go(func() error {
+		src, onRenew, onRevoke := t.instrument(src, profileID{}, creds.set, creds.clear)
+		return renewCredentials(ctx, src, onRenew, onRevoke, &df.retry, &df.renewal)
+	})
+	g.Go(func() error {
+		return serveHTTP(ctx, f.listenAddr, &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// The body is read into memory to be signed, so its size is
+				// limited.
+				r.Body = http.MaxBytesReader(w, r.Body, f.maxBodySize)
+				proxy.ServeHTTP(w, r)
+			}),
+			ReadHeaderTimeout: 10 * time.Second,
+		})
+	})
+	return g.Wait()
+}
+
+func newSigningProxy(
+	f *signingProxyFlags,
+	upstream *url.URL,
+	creds *latestCredentials,
+) *httputil.ReverseProxy {
+	allowed := map[string]bool{}
+	for _, h := range f.allowHeaders {
+		allowed[http.CanonicalHeaderKey(h)] = true
+	}
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(upstream)
+			if f.host != "" {
+				pr.Out.Host = f.host
+			}
+			for _, h := range signingProxyStrippedHeaders {
+				pr.Out.Header.Del(h)
+			}
+			if len(allowed) > 0 {
+				for h := range pr.Out.Header {
+					if !allowed[h] {
+						pr.Out.Header.Del(h)
+					}
+				}
+			}
+		},
+		Transport: &signingTransport{
+			creds:   creds,
+			signer:  v4.NewSigner(),
+			service: f.signingService,
+			region:  f.signingRegion,
+			next:    http.DefaultTransport,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				slog.Warn(
+					"Rejected request with a body larger than the maximum",
+					"method", r.Method,
+					"path", r.URL.Path,
+					"max_body_size", maxBytesErr.Limit,
+				)
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			slog.Error(
+				"Failed to forward request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"error", err,
+			)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// signingTransport signs requests with SigV4 using the latest credentials
+// before passing them to the next transport.
+type signingTransport struct {
+	creds   *latestCredentials
+	signer  *v4.Signer
+	service string
+	region  string
+	next    http.RoundTripper
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	creds, _, err := t.creds.get(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	// The payload must be hashed to sign the request, so the body is read
+	// into memory and replaced.
+	var body []byte
+	if req.Body != nil {
+		body, err = io.ReadAll(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("reading request body: %w", err)
+		}
+		if err := req.Body.Close(); err != nil {
+			return nil, fmt.Errorf("closing request body: %w", err)
+		}
+		req.ContentLength = int64(len(body))
+		req.Body = http.NoBody
+		if len(body) > 0 {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+	}
+
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	if slices.Contains(contentSHA256Services, t.service) {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	err = t.signer.SignHTTP(req.Context(), aws.Credentials{
+		AccessKeyID:     creds.credentials.AccessKeyId,
+		SecretAccessKey: creds.credentials.SecretAccessKey,
+		SessionToken:    creds.credentials.SessionToken,
+	}, req, payloadHash, t.service, t.region, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("signing request: %w", err)
+	}
+	return t.next.RoundTrip(req)
+}
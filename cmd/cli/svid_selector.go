@@ -0,0 +1,124 @@
+package cli
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// svidSelector selects one of the SVIDs issued to the workload. If no
+// criteria are set, the default SVID is selected.
+type svidSelector struct {
+	// hint, if set, must be equal to the hint of the SVID.
+	hint string
+	// spiffeID, if set, must match the SPIFFE ID of the SVID, either exactly
+	// or as a pattern accepted by path.Match, e.g.
+	// spiffe://example.org/db/*.
+	spiffeID string
+}
+
+func (s svidSelector) validate() error {
+	if _, err := path.Match(s.spiffeID, ""); err != nil {
+		return fmt.Errorf("invalid SPIFFE ID pattern %q: %w", s.spiffeID, err)
+	}
+	return nil
+}
+
+// subject returns the SPIFFE ID to request a JWT SVID for, if spiffeID is an
+// exact SPIFFE ID rather than a pattern. Otherwise, it returns the zero ID,
+// and the SVIDs for all of the workload's identities are requested.
+func (s svidSelector) subject() (spiffeid.ID, error) {
+	if s.spiffeID == "" || strings.ContainsAny(s.spiffeID, `*?[\`) {
+		return spiffeid.ID{}, nil
+	}
+	id, err := spiffeid.FromString(s.spiffeID)
+	if err != nil {
+		return spiffeid.ID{}, fmt.Errorf("invalid SPIFFE ID %q: %w", s.spiffeID, err)
+	}
+	return id, nil
+}
+
+func (s svidSelector) matches(id spiffeid.ID, hint string) bool {
+	if s.hint != "" && hint != s.hint {
+		return false
+	}
+	if s.spiffeID != "" {
+		// The pattern has been validated, so the error can be ignored.
+		if ok, _ := path.Match(s.spiffeID, id.String()); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (s svidSelector) String() string {
+	var criteria []string
+	if s.hint != "" {
+		criteria = append(criteria, fmt.Sprintf("hint %q", s.hint))
+	}
+	if s.spiffeID != "" {
+		criteria = append(criteria, fmt.Sprintf("SPIFFE ID %q", s.spiffeID))
+	}
+	if len(criteria) == 0 {
+		return "any criteria"
+	}
+	return strings.Join(criteria, " and ")
+}
+
+// noMatchError describes the SVIDs which are available when none of them
+// matches the selector.
+func (s svidSelector) noMatchError(kind string, ids []spiffeid.ID, hints []string) error {
+	available := make([]string, len(ids))
+	for i, id := range ids {
+		available[i] = fmt.Sprintf("%s (hint %q)", id, hints[i])
+	}
+	return fmt.Errorf("no %s SVID matches %s, available SVIDs: [%s]", kind, s, strings.Join(available, ", "))
+}
+
+// selectX509SVID returns the first of svids which matches the selector. If
+// previous is set, and an SVID with the same SPIFFE ID and hint still
+// matches, it is returned instead, so that the same identity continues to be
+// used when the Workload API reorders the SVIDs.
+func (s svidSelector) selectX509SVID(svids []*x509svid.SVID, previous *x509svid.SVID) (*x509svid.SVID, error) {
+	var candidates []*x509svid.SVID
+	for _, svid := range svids {
+		if s.matches(svid.ID, svid.Hint) {
+			candidates = append(candidates, svid)
+		}
+	}
+	if len(candidates) == 0 {
+		ids := make([]spiffeid.ID, len(svids))
+		hints := make([]string, len(svids))
+		for i, svid := range svids {
+			ids[i], hints[i] = svid.ID, svid.Hint
+		}
+		return nil, s.noMatchError("X509", ids, hints)
+	}
+	if previous != nil {
+		for _, svid := range candidates {
+			if svid.ID == previous.ID && svid.Hint == previous.Hint {
+				return svid, nil
+			}
+		}
+	}
+	return candidates[0], nil
+}
+
+// selectJWTSVID returns the first of svids which matches the selector.
+func (s svidSelector) selectJWTSVID(svids []*jwtsvid.SVID) (*jwtsvid.SVID, error) {
+	for _, svid := range svids {
+		if s.matches(svid.ID, svid.Hint) {
+			return svid, nil
+		}
+	}
+	ids := make([]spiffeid.ID, len(svids))
+	hints := make([]string, len(svids))
+	for i, svid := range svids {
+		ids[i], hints[i] = svid.ID, svid.Hint
+	}
+	return nil, s.noMatchError("JWT", ids, hints)
+}
@@ -4,14 +4,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spiffe/aws-spiffe-workload-helper/internal"
+	"github.com/spiffe/aws-spiffe-workload-helper/vendoredaws"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
 func newX509CredentialProcessCmd() (*cobra.Command, error) {
 	sf := &sharedX509Flags{}
+	cf := &sharedCacheFlags{}
 	cmd := &cobra.Command{
 		Use:   "x509-credential-process",
 		Short: `Exchanges an X509 SVID for a short-lived set of AWS credentials using AWS Roles Anywhere. Compatible with the AWS credential process functionality.`,
@@ -36,12 +39,19 @@ func newX509CredentialProcessCmd() (*cobra.Command, error) {
 			if err != nil {
 				return fmt.Errorf("fetching x509 context: %w", err)
 			}
-			// TODO(strideynet): Implement SVID selection mechanism, for now,
-			// we'll just use the first returned SVID (a.k.a the default).
-			svid := x509Ctx.DefaultSVID()
+			svid, err := sf.selectX509SVID(x509Ctx)
+			if err != nil {
+				return err
+			}
 			slog.Debug("Fetched X509 SVID", "svid", svidValue(svid))
 
-			credentials, err := exchangeX509SVIDForAWSCredentials(sf, svid)
+			credentials, err := cf.cachedExchange(
+				cmd.Flags(), svid.ID, x509SVIDFingerprint(svid),
+				sf.assumeRoles.sessionDuration(time.Duration(sf.sessionDuration)*time.Second),
+				func() (vendoredaws.CredentialProcessOutput, error) {
+					return exchangeX509SVIDForAWSCredentials(ctx, sf, svid)
+				},
+			)
 			if err != nil {
 				return fmt.Errorf("exchanging X509 SVID for AWS credentials: %w", err)
 			}
@@ -60,6 +70,7 @@ func newX509CredentialProcessCmd() (*cobra.Command, error) {
 	if err := sf.addFlags(cmd); err != nil {
 		return nil, fmt.Errorf("adding shared flags: %w", err)
 	}
+	cf.addFlags(cmd)
 
 	return cmd, nil
 }
@@ -0,0 +1,160 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errIdentityRevoked is returned when the Workload API no longer issues the
+// SVID that was being exchanged for AWS credentials, e.g. because the
+// registration entry for the workload was deleted.
+var errIdentityRevoked = errors.New("workload identity has been revoked: the Workload API no longer issues an SVID for this workload")
+
+// isIdentityRevoked returns whether err indicates that the Workload API no
+// longer issues an SVID to the workload. The Workload API returns
+// PermissionDenied when no identity is issued to the caller.
+func isIdentityRevoked(err error) bool {
+	return errors.Is(err, errIdentityRevoked) || status.Code(err) == codes.PermissionDenied
+}
+
+// x509SVIDWatcher holds the latest X509 SVID received from the Workload API.
+// It is used in place of workloadapi.X509Source, which keeps returning the
+// last SVID it received after the Workload API stops issuing one, so that
+// credentials obtained using a revoked identity can be removed promptly.
+type x509SVIDWatcher struct {
+	selector svidSelector
+
+	mu   sync.RWMutex
+	svid *x509svid.SVID
+	// err is set when the selected SVID is no longer issued.
+	err error
+	// followed is the SVID most recently selected, which continues to be
+	// selected across rotations.
+	followed *x509svid.SVID
+
+	updates   chan struct{}
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// watchX509SVID starts watching the Workload API for X509 SVIDs. It blocks
+// until the first SVIDs have been received, and returns an error if none of
+// them are selected by selector.
+func watchX509SVID(
+	ctx context.Context,
+	client *workloadapi.Client,
+	selector svidSelector,
+) (*x509SVIDWatcher, error) {
+	if err := selector.validate(); err != nil {
+		return nil, err
+	}
+	watchCtx, cancel := context.WithCancel(ctx)
+	w := &x509SVIDWatcher{
+		selector: selector,
+		updates:  make(chan struct{}, 1),
+		ready:    make(chan struct{}),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	watchErr := make(chan error, 1)
+	go func() {
+		defer close(w.done)
+		watchErr <- client.WatchX509Context(watchCtx, w)
+	}()
+
+	select {
+	case <-w.ready:
+		// The initial SVID is not an update, so it should not trigger an
+		// immediate renewal.
+		select {
+		case <-w.updates:
+		default:
+		}
+		w.mu.RLock()
+		err := w.err
+		w.mu.RUnlock()
+		if err != nil {
+			w.close()
+			return nil, err
+		}
+		return w, nil
+	case err := <-watchErr:
+		cancel()
+		return nil, fmt.Errorf("watching X509 SVIDs: %w", err)
+	case <-ctx.Done():
+		w.close()
+		return nil, ctx.Err()
+	}
+}
+
+// OnX509ContextUpdate implements workloadapi.X509ContextWatcher.
+func (w *x509SVIDWatcher) OnX509ContextUpdate(c *workloadapi.X509Context) {
+	w.mu.Lock()
+	svid, err := w.selector.selectX509SVID(c.SVIDs, w.followed)
+	// If no SVID is selected any longer, the identity has been revoked even
+	// though the workload may have others.
+	w.svid = svid
+	w.err = err
+	if svid != nil {
+		w.followed = svid
+	}
+	w.mu.Unlock()
+	w.readyOnce.Do(func() {
+		close(w.ready)
+	})
+	w.notify()
+}
+
+// OnX509ContextWatchError implements workloadapi.X509ContextWatcher. Errors
+// other than revocation are retried by the client, and the last SVID is kept
+// until then.
+func (w *x509SVIDWatcher) OnX509ContextWatchError(err error) {
+	if !isIdentityRevoked(err) {
+		return
+	}
+	w.mu.Lock()
+	w.svid = nil
+	w.err = err
+	w.mu.Unlock()
+	w.notify()
+}
+
+func (w *x509SVIDWatcher) notify() {
+	select {
+	case w.updates <- struct{}{}:
+	default:
+	}
+}
+
+// get returns the latest selected SVID, or an error wrapping
+// errIdentityRevoked if it is no longer issued.
+func (w *x509SVIDWatcher) get() (*x509svid.SVID, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.err != nil {
+		return nil, fmt.Errorf("%w: %w", errIdentityRevoked, w.err)
+	}
+	return w.svid, nil
+}
+
+// updated returns a channel which receives when the SVID is rotated or
+// revoked.
+func (w *x509SVIDWatcher) updated() <-chan struct{} {
+	return w.updates
+}
+
+// close stops watching the Workload API.
+func (w *x509SVIDWatcher) close() {
+	w.cancel()
+	<-w.done
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spiffe/aws-spiffe-workload-helper/cmd/cli"
 )
@@ -18,7 +22,16 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := rootCmd.Execute(); err != nil {
+	// The long-lived commands shut down gracefully when the context is
+	// cancelled, e.g. removing credentials they have written.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = rootCmd.ExecuteContext(ctx)
+	stop()
+	if err != nil {
+		var exitErr *cli.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		slog.Error("Encountered a fatal error during execution", "error", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,164 @@
+package credentialprovider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/spiffe/aws-spiffe-workload-helper/vendoredaws"
+)
+
+// stsSigningName is the service name used when signing requests to the STS
+// API.
+const stsSigningName = "sts"
+
+// stsPartition describes where the STS API is found for the roles in a
+// partition.
+type stsPartition struct {
+	// region is used when no region is configured.
+	region string
+	// dnsSuffix is the suffix of the regional STS endpoints.
+	dnsSuffix string
+}
+
+// stsPartitions are the partitions whose STS endpoints are known, keyed by
+// the partition of the role ARN.
+var stsPartitions = map[string]stsPartition{
+	"aws":        {region: "us-east-1", dnsSuffix: "amazonaws.com"},
+	"aws-cn":     {region: "cn-north-1", dnsSuffix: "amazonaws.com.cn"},
+	"aws-us-gov": {region: "us-gov-west-1", dnsSuffix: "amazonaws.com"},
+	"aws-iso":    {region: "us-iso-east-1", dnsSuffix: "c2s.ic.gov"},
+	"aws-iso-b":  {region: "us-isob-east-1", dnsSuffix: "sc2s.sgov.gov"},
+}
+
+// AssumeRoleConfig configures a call to sts:AssumeRole.
+type AssumeRoleConfig struct {
+	// RoleARN is the ARN of the role to assume. Required.
+	RoleARN string
+	// RoleSessionName is the identifier for the role session. Required.
+	RoleSessionName string
+	// ExternalID is presented to the trust policy of the role. Optional.
+	ExternalID string
+	// SourceIdentity is the source identity of the session. Optional.
+	SourceIdentity string
+	// Policy is an inline session policy, as a JSON document, which further
+	// restricts the permissions of the role for the session. Optional.
+	Policy string
+	// Tags are the session tags, keyed by tag key. Optional.
+	Tags map[string]string
+	// SessionDuration is the lifetime of the credentials. Defaults to one
+	// hour.
+	SessionDuration time.Duration
+	// Region is the region of the STS API, which the request is signed for.
+	// Defaults to the main region of the partition of RoleARN, e.g.
+	// us-east-1 for the aws partition.
+	Region string
+	// Endpoint overrides the URL of the STS API. Defaults to the regional
+	// endpoint of Region.
+	Endpoint string
+	// Timeout limits how long the call may take, including retries of
+	// transient errors. Defaults to 30 seconds.
+	Timeout time.Duration
+}
+
+// resolve returns the region and endpoint of the STS API to call.
+func (cfg AssumeRoleConfig) resolve() (region string, endpoint string, err error) {
+	roleARN, err := arn.Parse(cfg.RoleARN)
+	if err != nil {
+		return "", "", fmt.Errorf("parsing role ARN: %w", err)
+	}
+	partition, known := stsPartitions[roleARN.Partition]
+	region = cfg.Region
+	if region == "" {
+		if !known {
+			return "", "", fmt.Errorf("region is required for roles in partition %q", roleARN.Partition)
+		}
+		region = partition.region
+	}
+	endpoint = cfg.Endpoint
+	if endpoint == "" {
+		if !known {
+			return "", "", fmt.Errorf("endpoint is required for roles in partition %q", roleARN.Partition)
+		}
+		endpoint = fmt.Sprintf("https://%s.%s.%s", stsSigningName, region, partition.dnsSuffix)
+	}
+	return region, endpoint, nil
+}
+
+// ValidateAssumeRoleConfig checks that the role ARN of cfg can be parsed, and
+// that the region and endpoint of the STS API can be determined. This allows
+// a misconfiguration to be caught before any credentials are obtained.
+func ValidateAssumeRoleConfig(cfg AssumeRoleConfig) error {
+	_, _, err := cfg.resolve()
+	return err
+}
+
+// AssumeRole calls the STS AssumeRole API, signing the request with creds.
+// Transient errors, such as throttling, are retried. Errors returned by STS
+// are returned as an *APIError.
+func AssumeRole(
+	ctx context.Context,
+	creds vendoredaws.CredentialProcessOutput,
+	cfg AssumeRoleConfig,
+) (vendoredaws.CredentialProcessOutput, error) {
+	region, endpoint, err := cfg.resolve()
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, err
+	}
+	form := url.Values{}
+	form.Set("Action", "AssumeRole")
+	form.Set("Version", "2011-06-15")
+	form.Set("RoleArn", cfg.RoleARN)
+	form.Set("RoleSessionName", cfg.RoleSessionName)
+	if cfg.ExternalID != "" {
+		form.Set("ExternalId", cfg.ExternalID)
+	}
+	if cfg.SourceIdentity != "" {
+		form.Set("SourceIdentity", cfg.SourceIdentity)
+	}
+	if cfg.Policy != "" {
+		form.Set("Policy", cfg.Policy)
+	}
+	if cfg.SessionDuration != 0 {
+		form.Set("DurationSeconds", strconv.Itoa(int(cfg.SessionDuration/time.Second)))
+	}
+	tagKeys := make([]string, 0, len(cfg.Tags))
+	for k := range cfg.Tags {
+		tagKeys = append(tagKeys, k)
+	}
+	slices.Sort(tagKeys)
+	for i, k := range tagKeys {
+		form.Set(fmt.Sprintf("Tags.member.%d.Key", i+1), k)
+		form.Set(fmt.Sprintf("Tags.member.%d.Value", i+1), cfg.Tags[k])
+	}
+
+	signer := v4.NewSigner()
+	sign := func(req *http.Request, body []byte) error {
+		sum := sha256.Sum256(body)
+		return signer.SignHTTP(req.Context(), aws.Credentials{
+			AccessKeyID:     creds.AccessKeyId,
+			SecretAccessKey: creds.SecretAccessKey,
+			SessionToken:    creds.SessionToken,
+		}, req, hex.EncodeToString(sum[:]), stsSigningName, region, time.Now())
+	}
+	out, err := withSTSRetries(ctx, cfg.Timeout, func(ctx context.Context) (vendoredaws.CredentialProcessOutput, error) {
+		var resp assumeRoleResponse
+		if err := postSTS(ctx, endpoint, form, sign, &resp); err != nil {
+			return vendoredaws.CredentialProcessOutput{}, err
+		}
+		return resp.AssumeRoleResult.Credentials.output(), nil
+	})
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("assuming role: %w", err)
+	}
+	return out, nil
+}
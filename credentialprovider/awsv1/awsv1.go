@@ -0,0 +1,71 @@
+// Package awsv1 adapts a credentialprovider.Provider for use with the AWS SDK
+// for Go v1. It is kept separate from the credentialprovider package, so that
+// programs which only use the AWS SDK for Go v2 do not depend on v1.
+//
+//	sess, err := session.NewSession(aws.NewConfig().WithCredentials(
+//		credentials.NewCredentials(awsv1.New(provider)),
+//	))
+package awsv1
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/spiffe/aws-spiffe-workload-helper/credentialprovider"
+)
+
+// Errors returned by the AWS APIs can be handled in the same way as errors
+// returned by the AWS SDK for Go v1.
+var _ awserr.RequestFailure = (*credentialprovider.APIError)(nil)
+
+// Provider adapts a credentialprovider.Provider for use with the AWS SDK for
+// Go v1. It implements credentials.ProviderWithContext and
+// credentials.Expirer.
+type Provider struct {
+	p *credentialprovider.Provider
+}
+
+var (
+	_ credentials.ProviderWithContext = (*Provider)(nil)
+	_ credentials.Expirer             = (*Provider)(nil)
+)
+
+// New returns an adapter for p. The adapter shares its cache with p.
+func New(p *credentialprovider.Provider) *Provider {
+	return &Provider{p: p}
+}
+
+// Retrieve returns the cached AWS credentials, or obtains new ones if they
+// have expired or the SVID has been rotated.
+func (v *Provider) Retrieve() (credentials.Value, error) {
+	return v.RetrieveWithContext(context.Background())
+}
+
+// RetrieveWithContext is the same as Retrieve, but the exchange is abandoned
+// if ctx is cancelled.
+func (v *Provider) RetrieveWithContext(ctx credentials.Context) (credentials.Value, error) {
+	creds, err := v.p.Retrieve(ctx)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	return credentials.Value{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		ProviderName:    creds.Source,
+	}, nil
+}
+
+// IsExpired returns whether the credentials must be renewed, either because
+// they are within the expiry window of expiring, or because the SVID has been
+// rotated.
+func (v *Provider) IsExpired() bool {
+	return v.p.Expired()
+}
+
+// ExpiresAt returns when the cached credentials expire.
+func (v *Provider) ExpiresAt() time.Time {
+	return v.p.ExpiresAt()
+}
@@ -0,0 +1,114 @@
+package credentialprovider
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Error codes returned by STS AssumeRoleWithWebIdentity, as returned by
+// APIError.Code.
+const (
+	// ErrCodeExpiredToken is returned when the JWT SVID has expired.
+	ErrCodeExpiredToken = "ExpiredTokenException"
+	// ErrCodeIDPCommunicationError is returned when STS could not reach the
+	// OIDC provider to validate the JWT SVID. It is transient.
+	ErrCodeIDPCommunicationError = "IDPCommunicationError"
+	// ErrCodeIDPRejectedClaim is returned when the OIDC provider rejected
+	// the claims in the JWT SVID.
+	ErrCodeIDPRejectedClaim = "IDPRejectedClaim"
+	// ErrCodeInvalidIdentityToken is returned when the JWT SVID could not
+	// be validated, e.g. because its issuer or audience is not trusted.
+	ErrCodeInvalidIdentityToken = "InvalidIdentityToken"
+	// ErrCodeMalformedPolicyDocument is returned when a session policy is
+	// invalid.
+	ErrCodeMalformedPolicyDocument = "MalformedPolicyDocument"
+	// ErrCodePackedPolicyTooLarge is returned when session policies and
+	// tags exceed the size limit.
+	ErrCodePackedPolicyTooLarge = "PackedPolicyTooLarge"
+	// ErrCodeRegionDisabled is returned when STS is not activated in the
+	// region.
+	ErrCodeRegionDisabled = "RegionDisabledException"
+)
+
+// throttlingErrorCodes are error codes returned by AWS when a request has
+// been throttled.
+var throttlingErrorCodes = []string{
+	"EC2ThrottledException",
+	"PriorRequestNotComplete",
+	"ProvisionedThroughputExceededException",
+	"RequestLimitExceeded",
+	"RequestThrottled",
+	"RequestThrottledException",
+	"ThrottledException",
+	"Throttling",
+	"ThrottlingException",
+	"TooManyRequestsException",
+	"TransactionInProgressException",
+}
+
+// timeoutErrorCodes are error codes returned by AWS when a request timed out.
+var timeoutErrorCodes = []string{
+	"RequestTimeout",
+	"RequestTimeoutException",
+}
+
+// APIError is returned when the Roles Anywhere or STS API rejects a request.
+// Its methods match those of awserr.RequestFailure from the AWS SDK for Go
+// v1, so that it can be handled in the same way as errors returned by the SDK.
+type APIError struct {
+	// Status is the HTTP status code of the response.
+	Status int
+	// ErrorCode is the type of the error, e.g. AccessDeniedException.
+	ErrorCode string
+	// ErrorMessage is the message describing the error.
+	ErrorMessage string
+	// RequestIDValue is the ID AWS assigned to the request.
+	RequestIDValue string
+}
+
+// Error implements error.
+func (e *APIError) Error() string {
+	code := e.ErrorCode
+	if code == "" {
+		code = http.StatusText(e.Status)
+	}
+	msg := fmt.Sprintf("%s: %s", code, e.ErrorMessage)
+	if e.ErrorMessage == "" {
+		msg = code
+	}
+	msg = fmt.Sprintf("%s (status code: %d", msg, e.Status)
+	if e.RequestIDValue != "" {
+		msg += ", request id: " + e.RequestIDValue
+	}
+	return msg + ")"
+}
+
+// Throttled returns whether the request was rejected because too many
+// requests have been made.
+func (e *APIError) Throttled() bool {
+	return e.Status == http.StatusTooManyRequests || slices.Contains(throttlingErrorCodes, e.ErrorCode)
+}
+
+// Transient returns whether the request may succeed if it is retried, as it
+// was throttled, timed out or failed due to a server error.
+func (e *APIError) Transient() bool {
+	return e.Throttled() || slices.Contains(timeoutErrorCodes, e.ErrorCode) || e.Status >= 500
+}
+
+// Code returns the type of the error. Implements awserr.Error.
+func (e *APIError) Code() string { return e.ErrorCode }
+
+// Message returns the message describing the error. Implements awserr.Error.
+func (e *APIError) Message() string { return e.ErrorMessage }
+
+// OrigErr always returns nil. Implements awserr.Error.
+func (e *APIError) OrigErr() error { return nil }
+
+// StatusCode returns the HTTP status code of the response. Implements
+// awserr.RequestFailure.
+func (e *APIError) StatusCode() int { return e.Status }
+
+// RequestID returns the ID AWS assigned to the request. Implements
+// awserr.RequestFailure.
+func (e *APIError) RequestID() string { return e.RequestIDValue }
@@ -0,0 +1,149 @@
+package credentialprovider
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+
+	awsspiffe "github.com/spiffe/aws-spiffe-workload-helper"
+	"github.com/spiffe/aws-spiffe-workload-helper/vendoredaws"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// defaultSessionDuration is used when no session duration is configured.
+const defaultSessionDuration = time.Hour
+
+// defaultSTSEndpoint is used by the JWT flow when no endpoint is configured.
+const defaultSTSEndpoint = "https://sts.amazonaws.com"
+
+// defaultTimeout limits each exchange, including retries, when no timeout is
+// configured.
+const defaultTimeout = 30 * time.Second
+
+// userAgent is sent with every request to AWS.
+var userAgent = fmt.Sprintf("aws-spiffe-workload-helper (%s; %s; %s)", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+
+// httpClient is shared by all requests to AWS, so that connections are
+// reused across renewals.
+var httpClient = &http.Client{
+	Transport: newTransport(),
+}
+
+func newTransport() *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	return tr
+}
+
+// X509Config configures the exchange of an X509 SVID for AWS credentials
+// using AWS Roles Anywhere.
+type X509Config struct {
+	// RoleARN is the ARN of the role to obtain credentials for. Required.
+	RoleARN string
+	// ProfileARN is the ARN of the Roles Anywhere profile. Required.
+	ProfileARN string
+	// TrustAnchorARN is the ARN of the Roles Anywhere trust anchor. Required.
+	TrustAnchorARN string
+	// Region overrides the region of the Roles Anywhere API. Defaults to the
+	// region of the trust anchor.
+	Region string
+	// Endpoint overrides the URL of the Roles Anywhere API.
+	Endpoint string
+	// RoleSessionName is the identifier for the role session. Optional.
+	RoleSessionName string
+	// SessionDuration is the lifetime of the credentials. Defaults to one
+	// hour.
+	SessionDuration time.Duration
+	// Timeout limits how long the exchange may take. Defaults to 30
+	// seconds.
+	Timeout time.Duration
+	// ExpiryWindow is how long before the credentials expire that a Provider
+	// considers them to have expired, so that they are renewed before they
+	// can be rejected by AWS.
+	ExpiryWindow time.Duration
+}
+
+// JWTConfig configures the exchange of a JWT SVID for AWS credentials using
+// sts:AssumeRoleWithWebIdentity.
+type JWTConfig struct {
+	// RoleARN is the ARN of the role to obtain credentials for.
+	RoleARN string
+	// Audience is the audience of the JWT SVID, which must be trusted by the
+	// IAM OIDC provider. Required.
+	Audience string
+	// Endpoint overrides the URL of the STS API. Defaults to
+	// https://sts.amazonaws.com.
+	Endpoint string
+	// RoleSessionName is the identifier for the role session. Optional.
+	RoleSessionName string
+	// SessionDuration is the lifetime of the credentials. Defaults to one
+	// hour.
+	SessionDuration time.Duration
+	// Policy is an inline session policy, as a JSON document, which further
+	// restricts the permissions of the role for the session. Optional.
+	Policy string
+	// PolicyARNs are the ARNs of managed policies which further restrict the
+	// permissions of the role for the session. At most 10. Optional.
+	PolicyARNs []string
+	// ProviderID is the domain of the identity provider, which is only
+	// required by OAuth 2.0 providers. Optional.
+	ProviderID string
+	// Timeout limits how long the exchange may take, including retries of
+	// transient errors. Defaults to 30 seconds.
+	Timeout time.Duration
+	// ExpiryWindow is how long before the credentials expire that a Provider
+	// considers them to have expired, so that they are renewed before they
+	// can be rejected by AWS.
+	ExpiryWindow time.Duration
+}
+
+func sessionDurationSeconds(d time.Duration) int {
+	if d == 0 {
+		d = defaultSessionDuration
+	}
+	return int(d / time.Second)
+}
+
+// ExchangeX509SVID exchanges an X509 SVID for AWS credentials using the
+// AWS Roles Anywhere CreateSession API. Errors returned by Roles Anywhere are
+// returned as an *APIError.
+func ExchangeX509SVID(
+	ctx context.Context,
+	svid *x509svid.SVID,
+	cfg X509Config,
+) (vendoredaws.CredentialProcessOutput, error) {
+	signer := &awsspiffe.X509SVIDSigner{
+		SVID: svid,
+	}
+	credentials, err := createSession(ctx, signer, cfg)
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("creating session: %w", err)
+	}
+	return credentials, nil
+}
+
+// ExchangeJWTSVID exchanges a JWT SVID for AWS credentials using the STS
+// AssumeRoleWithWebIdentity API. Transient errors, such as throttling, are
+// retried. Errors returned by STS are returned as an *APIError.
+func ExchangeJWTSVID(
+	ctx context.Context,
+	svid *jwtsvid.SVID,
+	cfg JWTConfig,
+) (vendoredaws.CredentialProcessOutput, error) {
+	// Invalid session policies are reported locally, as STS would reject
+	// them without a precise error.
+	if err := validateSessionPolicies(cfg); err != nil {
+		return vendoredaws.CredentialProcessOutput{}, err
+	}
+	creds, err := withSTSRetries(ctx, cfg.Timeout, func(ctx context.Context) (vendoredaws.CredentialProcessOutput, error) {
+		return assumeRoleWithWebIdentity(ctx, svid.Marshal(), cfg)
+	})
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("assuming role with web identity: %w", err)
+	}
+	return creds, nil
+}
@@ -0,0 +1,220 @@
+// Package credentialprovider provides AWS SDK credential providers which
+// obtain AWS credentials by exchanging an SVID from the SPIFFE Workload API.
+// This allows Go programs to authenticate to AWS using their SPIFFE identity
+// without running the aws-spiffe-workload-helper binary.
+//
+// A Provider implements aws.CredentialsProvider from the AWS SDK for Go v2:
+//
+//	source, err := workloadapi.NewX509Source(ctx)
+//	// ...
+//	cfg, err := config.LoadDefaultConfig(ctx, config.WithCredentialsProvider(
+//		credentialprovider.NewX509Provider(source, credentialprovider.X509Config{
+//			RoleARN:        "arn:aws:iam::123456789012:role/example",
+//			ProfileARN:     "arn:aws:rolesanywhere:us-east-1:123456789012:profile/example",
+//			TrustAnchorARN: "arn:aws:rolesanywhere:us-east-1:123456789012:trust-anchor/example",
+//		}),
+//	))
+//
+// The awsv1 package adapts a Provider for use with the AWS SDK for Go v1.
+package credentialprovider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/spiffe/aws-spiffe-workload-helper/vendoredaws"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// Provider retrieves AWS credentials by exchanging an SVID.
+//
+// Credentials are cached until they are within the configured expiry window
+// of expiring. For the X509 flow, they are also renewed as soon as the SVID
+// held by the source is rotated, so that the credentials are always obtained
+// with the current SVID. As the Provider caches credentials itself, it does
+// not need to be wrapped with an aws.CredentialsCache, though it is safe to
+// do so.
+//
+// A Provider is safe for concurrent use.
+type Provider struct {
+	name         string
+	expiryWindow time.Duration
+	// exchange fetches an SVID and exchanges it for AWS credentials. It also
+	// returns the SVID that was exchanged, for comparison with current.
+	exchange func(ctx context.Context) (vendoredaws.CredentialProcessOutput, []byte, error)
+	// current returns the SVID currently held by the source, or nil if the
+	// source does not hold one.
+	current func() []byte
+	// refreshing is held whilst credentials are obtained, so that concurrent
+	// callers share the result of a single exchange. It is a channel rather
+	// than a mutex, so that waiting callers can give up when their context
+	// is cancelled.
+	refreshing chan struct{}
+
+	// mu guards the cached credentials. It is not held during exchanges.
+	mu     sync.Mutex
+	creds  aws.Credentials
+	svid   []byte
+	cached bool
+}
+
+var _ aws.CredentialsProvider = (*Provider)(nil)
+
+// NewX509Provider returns a Provider which exchanges the X509 SVID held by
+// source for AWS credentials using AWS Roles Anywhere. The source is
+// typically a *workloadapi.X509Source.
+func NewX509Provider(source x509svid.Source, cfg X509Config) *Provider {
+	fetch := func() (*x509svid.SVID, error) {
+		svid, err := source.GetX509SVID()
+		if err != nil {
+			return nil, fmt.Errorf("fetching X509 SVID: %w", err)
+		}
+		return svid, nil
+	}
+	return &Provider{
+		name:         "SPIFFEX509Provider",
+		expiryWindow: cfg.ExpiryWindow,
+		refreshing:   make(chan struct{}, 1),
+		exchange: func(ctx context.Context) (vendoredaws.CredentialProcessOutput, []byte, error) {
+			svid, err := fetch()
+			if err != nil {
+				return vendoredaws.CredentialProcessOutput{}, nil, err
+			}
+			creds, err := ExchangeX509SVID(ctx, svid, cfg)
+			if err != nil {
+				return vendoredaws.CredentialProcessOutput{}, nil, fmt.Errorf("exchanging X509 SVID for AWS credentials: %w", err)
+			}
+			return creds, svid.Certificates[0].Raw, nil
+		},
+		current: func() []byte {
+			svid, err := fetch()
+			if err != nil {
+				return nil
+			}
+			return svid.Certificates[0].Raw
+		},
+	}
+}
+
+// NewJWTProvider returns a Provider which exchanges a JWT SVID fetched from
+// source for AWS credentials using sts:AssumeRoleWithWebIdentity. The source
+// is typically a *workloadapi.JWTSource or *workloadapi.Client.
+//
+// JWT SVIDs are minted on request, so a new SVID is fetched each time the
+// credentials are renewed.
+func NewJWTProvider(source jwtsvid.Source, cfg JWTConfig) *Provider {
+	return &Provider{
+		name:         "SPIFFEJWTProvider",
+		expiryWindow: cfg.ExpiryWindow,
+		refreshing:   make(chan struct{}, 1),
+		exchange: func(ctx context.Context) (vendoredaws.CredentialProcessOutput, []byte, error) {
+			svid, err := source.FetchJWTSVID(ctx, jwtsvid.Params{Audience: cfg.Audience})
+			if err != nil {
+				return vendoredaws.CredentialProcessOutput{}, nil, fmt.Errorf("fetching JWT SVID: %w", err)
+			}
+			creds, err := ExchangeJWTSVID(ctx, svid, cfg)
+			if err != nil {
+				return vendoredaws.CredentialProcessOutput{}, nil, fmt.Errorf("exchanging JWT SVID for AWS credentials: %w", err)
+			}
+			return creds, nil, nil
+		},
+	}
+}
+
+// Retrieve returns the cached AWS credentials, or obtains new ones if they
+// have expired or the SVID has been rotated. It implements
+// aws.CredentialsProvider. If ctx is cancelled, whilst waiting for another
+// caller's exchange or during its own, an error is returned.
+func (p *Provider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	if creds, ok := p.cachedCredentials(); ok {
+		return creds, nil
+	}
+	select {
+	case p.refreshing <- struct{}{}:
+	case <-ctx.Done():
+		return aws.Credentials{}, ctx.Err()
+	}
+	defer func() { <-p.refreshing }()
+	// The credentials may have been renewed by another caller whilst this
+	// one was waiting.
+	if creds, ok := p.cachedCredentials(); ok {
+		return creds, nil
+	}
+
+	out, svid, err := p.exchange(ctx)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	expires, err := time.Parse(time.RFC3339, out.Expiration)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("parsing expiration time: %w", err)
+	}
+	creds := aws.Credentials{
+		AccessKeyID:     out.AccessKeyId,
+		SecretAccessKey: out.SecretAccessKey,
+		SessionToken:    out.SessionToken,
+		Source:          p.name,
+		CanExpire:       true,
+		Expires:         expires,
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.creds = creds
+	p.svid = svid
+	p.cached = true
+	return creds, nil
+}
+
+// cachedCredentials returns the cached credentials, and whether they can be
+// used without being renewed.
+func (p *Provider) cachedCredentials() (aws.Credentials, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.expiredLocked() {
+		return aws.Credentials{}, false
+	}
+	return p.creds, true
+}
+
+// Invalidate discards the cached credentials, so that new credentials are
+// obtained by the next call to Retrieve.
+func (p *Provider) Invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cached = false
+}
+
+// Expired returns whether the cached credentials must be renewed, either
+// because they are within the expiry window of expiring, or because the SVID
+// has been rotated.
+func (p *Provider) Expired() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.expiredLocked()
+}
+
+// ExpiresAt returns when the cached credentials expire, or the zero time if
+// no credentials have been obtained.
+func (p *Provider) ExpiresAt() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.creds.Expires
+}
+
+func (p *Provider) expiredLocked() bool {
+	if !p.cached {
+		return true
+	}
+	if !time.Now().Add(p.expiryWindow).Before(p.creds.Expires) {
+		return true
+	}
+	if p.current != nil && !bytes.Equal(p.current(), p.svid) {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package credentialprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	awsspiffe "github.com/spiffe/aws-spiffe-workload-helper"
+	"github.com/spiffe/aws-spiffe-workload-helper/vendoredaws"
+)
+
+// rolesAnywhereSigningName is the service name used when signing requests to
+// the Roles Anywhere API.
+const rolesAnywhereSigningName = "rolesanywhere"
+
+type createSessionRequest struct {
+	DurationSeconds int    `json:"durationSeconds"`
+	RoleSessionName string `json:"roleSessionName,omitempty"`
+}
+
+type createSessionResponse struct {
+	CredentialSet []struct {
+		Credentials struct {
+			AccessKeyID     string `json:"accessKeyId"`
+			SecretAccessKey string `json:"secretAccessKey"`
+			SessionToken    string `json:"sessionToken"`
+			Expiration      string `json:"expiration"`
+		} `json:"credentials"`
+	} `json:"credentialSet"`
+}
+
+// rolesAnywhereErrorResponse is the body returned by Roles Anywhere when a
+// request fails. Depending on the error, the fields may be capitalised.
+type rolesAnywhereErrorResponse struct {
+	Type         string `json:"__type"`
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	MessageUpper string `json:"Message"`
+}
+
+// newAPIError converts a failed Roles Anywhere response into an *APIError.
+func newAPIError(resp *http.Response, body []byte) *APIError {
+	apiErr := &APIError{
+		Status:         resp.StatusCode,
+		RequestIDValue: resp.Header.Get("X-Amzn-Requestid"),
+	}
+	var errResp rolesAnywhereErrorResponse
+	if err := json.Unmarshal(body, &errResp); err != nil {
+		apiErr.ErrorMessage = strings.TrimSpace(string(body))
+	} else {
+		apiErr.ErrorMessage = errResp.Message
+		if apiErr.ErrorMessage == "" {
+			apiErr.ErrorMessage = errResp.MessageUpper
+		}
+		apiErr.ErrorCode = errResp.Code
+		if apiErr.ErrorCode == "" {
+			apiErr.ErrorCode = errResp.Type
+		}
+	}
+	if errType := resp.Header.Get("X-Amzn-Errortype"); errType != "" {
+		apiErr.ErrorCode = errType
+	}
+	// Error types may be qualified with a namespace and suffixed with
+	// additional information, e.g. "aws.protocoltests#AccessDeniedException:http://...".
+	apiErr.ErrorCode, _, _ = strings.Cut(apiErr.ErrorCode, ":")
+	if i := strings.LastIndex(apiErr.ErrorCode, "#"); i >= 0 {
+		apiErr.ErrorCode = apiErr.ErrorCode[i+1:]
+	}
+	return apiErr
+}
+
+// createSession calls the Roles Anywhere CreateSession API, authenticating
+// with the X509 SVID held by signer. The call is limited to cfg.Timeout,
+// which defaults to defaultTimeout.
+func createSession(
+	ctx context.Context,
+	signer *awsspiffe.X509SVIDSigner,
+	cfg X509Config,
+) (vendoredaws.CredentialProcessOutput, error) {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	trustAnchorARN, err := arn.Parse(cfg.TrustAnchorARN)
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("parsing trust anchor ARN: %w", err)
+	}
+	profileARN, err := arn.Parse(cfg.ProfileARN)
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("parsing profile ARN: %w", err)
+	}
+	if trustAnchorARN.Region != profileARN.Region {
+		return vendoredaws.CredentialProcessOutput{}, errors.New("trust anchor and profile regions don't match")
+	}
+	region := cfg.Region
+	if region == "" {
+		region = trustAnchorARN.Region
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.%s.amazonaws.com", rolesAnywhereSigningName, region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("parsing endpoint: %w", err)
+	}
+	u.Path = "/sessions"
+	u.RawQuery = url.Values{
+		"profileArn":     {cfg.ProfileARN},
+		"roleArn":        {cfg.RoleARN},
+		"trustAnchorArn": {cfg.TrustAnchorARN},
+	}.Encode()
+
+	body, err := json.Marshal(createSessionRequest{
+		DurationSeconds: sessionDurationSeconds(cfg.SessionDuration),
+		RoleSessionName: cfg.RoleSessionName,
+	})
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("marshaling request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+
+	signatureAlgorithm, err := signer.SignatureAlgorithm()
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("getting signature algorithm: %w", err)
+	}
+	certificate, err := signer.Certificate()
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("getting certificate: %w", err)
+	}
+	// The chain is optional, so it is omitted if it cannot be found.
+	chain, _ := signer.CertificateChain()
+	if err := vendoredaws.SignRequest(
+		req, bytes.NewReader(body), signer, signatureAlgorithm, region, rolesAnywhereSigningName, certificate, chain,
+	); err != nil {
+		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("signing request: %w", err)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("reading response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return vendoredaws.CredentialProcessOutput{}, newAPIError(resp, respBody)
+	}
+
+	var out createSessionResponse
+	if err := json.Unmarshal(respBody, &out); err != nil {
+		return vendoredaws.CredentialProcessOutput{}, fmt.Errorf("parsing response: %w", err)
+	}
+	if len(out.CredentialSet) == 0 {
+		return vendoredaws.CredentialProcessOutput{}, errors.New("unable to obtain temporary security credentials from CreateSession")
+	}
+	creds := out.CredentialSet[0].Credentials
+	return vendoredaws.CredentialProcessOutput{
+		Version:         1,
+		AccessKeyId:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		Expiration:      creds.Expiration,
+	}, nil
+}
@@ -0,0 +1,63 @@
+package credentialprovider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+const (
+	// maxSessionPolicySize is the largest inline session policy, in
+	// characters, that STS accepts.
+	maxSessionPolicySize = 2048
+	// maxSessionPolicyARNs is the largest number of managed session policies
+	// that STS accepts.
+	maxSessionPolicyARNs = 10
+)
+
+// ValidateSessionPolicy checks that policy, an inline session policy, is a
+// JSON object within the size limit of STS. This allows a policy which STS
+// would reject with MalformedPolicyDocument to be caught before the SVID is
+// exchanged. An empty policy is valid.
+func ValidateSessionPolicy(policy string) error {
+	if policy == "" {
+		return nil
+	}
+	if n := len([]rune(policy)); n > maxSessionPolicySize {
+		return fmt.Errorf("session policy is %d characters, more than the maximum of %d", n, maxSessionPolicySize)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(policy), &doc); err != nil {
+		return fmt.Errorf("session policy is not a JSON object: %w", err)
+	}
+	return nil
+}
+
+// ValidateSessionPolicyARNs checks that arns, the ARNs of managed session
+// policies, are valid IAM policy ARNs, and that there are no more than STS
+// accepts.
+func ValidateSessionPolicyARNs(arns []string) error {
+	if len(arns) > maxSessionPolicyARNs {
+		return fmt.Errorf("%d session policy ARNs given, more than the maximum of %d", len(arns), maxSessionPolicyARNs)
+	}
+	for _, a := range arns {
+		parsed, err := arn.Parse(a)
+		if err != nil {
+			return fmt.Errorf("parsing session policy ARN %q: %w", a, err)
+		}
+		if parsed.Service != "iam" {
+			return fmt.Errorf("session policy ARN %q is not an IAM policy", a)
+		}
+	}
+	return nil
+}
+
+// validateSessionPolicies checks the session policies of cfg.
+func validateSessionPolicies(cfg JWTConfig) error {
+	return errors.Join(
+		ValidateSessionPolicy(cfg.Policy),
+		ValidateSessionPolicyARNs(cfg.PolicyARNs),
+	)
+}
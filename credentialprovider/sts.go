@@ -0,0 +1,208 @@
+package credentialprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spiffe/aws-spiffe-workload-helper/vendoredaws"
+)
+
+const (
+	// stsMaxAttempts is how many times a request to STS is attempted when
+	// it fails with a transient error.
+	stsMaxAttempts = 3
+	// stsRetryBackoff is how long to wait before the first retry. It
+	// doubles with each retry.
+	stsRetryBackoff = 200 * time.Millisecond
+)
+
+// stsCredentials are the credentials returned by the STS AssumeRole APIs.
+type stsCredentials struct {
+	AccessKeyId     string `xml:"AccessKeyId"`
+	SecretAccessKey string `xml:"SecretAccessKey"`
+	Expiration      string `xml:"Expiration"`
+	SessionToken    string `xml:"SessionToken"`
+}
+
+func (c stsCredentials) output() vendoredaws.CredentialProcessOutput {
+	return vendoredaws.CredentialProcessOutput{
+		Version:         1,
+		AccessKeyId:     c.AccessKeyId,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.SessionToken,
+		Expiration:      c.Expiration,
+	}
+}
+
+type assumeRoleWithWebIdentityResponse struct {
+	XMLName                         xml.Name `xml:"https://sts.amazonaws.com/doc/2011-06-15/ AssumeRoleWithWebIdentityResponse"`
+	AssumeRoleWithWebIdentityResult struct {
+		Credentials stsCredentials `xml:"Credentials"`
+	} `xml:"AssumeRoleWithWebIdentityResult"`
+}
+
+type assumeRoleResponse struct {
+	XMLName          xml.Name `xml:"https://sts.amazonaws.com/doc/2011-06-15/ AssumeRoleResponse"`
+	AssumeRoleResult struct {
+		Credentials stsCredentials `xml:"Credentials"`
+	} `xml:"AssumeRoleResult"`
+}
+
+// stsErrorResponse is the body returned by STS when a request fails.
+type stsErrorResponse struct {
+	XMLName xml.Name `xml:"ErrorResponse"`
+	Error   struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+	RequestID string `xml:"RequestId"`
+}
+
+// newSTSAPIError converts a failed STS response into an *APIError.
+func newSTSAPIError(resp *http.Response, body []byte) *APIError {
+	var errResp stsErrorResponse
+	if err := xml.Unmarshal(body, &errResp); err != nil || errResp.Error.Code == "" {
+		return &APIError{
+			Status:         resp.StatusCode,
+			ErrorMessage:   strings.TrimSpace(string(body)),
+			RequestIDValue: resp.Header.Get("X-Amzn-Requestid"),
+		}
+	}
+	return &APIError{
+		Status:         resp.StatusCode,
+		ErrorCode:      errResp.Error.Code,
+		ErrorMessage:   errResp.Error.Message,
+		RequestIDValue: errResp.RequestID,
+	}
+}
+
+// isTransientSTSError returns whether a failed request to STS may succeed if
+// it is retried.
+func isTransientSTSError(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		// The request could not be sent, or the response could not be
+		// read.
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	return apiErr.Code() == ErrCodeIDPCommunicationError || apiErr.Transient()
+}
+
+// assumeRoleWithWebIdentity calls the STS AssumeRoleWithWebIdentity API. The
+// token is sent in a form-encoded POST body, rather than in the query string,
+// so that it is not recorded in proxy or access logs.
+func assumeRoleWithWebIdentity(
+	ctx context.Context,
+	token string,
+	cfg JWTConfig,
+) (vendoredaws.CredentialProcessOutput, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = defaultSTSEndpoint
+	}
+	form := url.Values{}
+	form.Set("Action", "AssumeRoleWithWebIdentity")
+	form.Set("Version", "2011-06-15")
+	form.Set("WebIdentityToken", token)
+	form.Set("DurationSeconds", strconv.Itoa(sessionDurationSeconds(cfg.SessionDuration)))
+	if cfg.RoleARN != "" {
+		form.Set("RoleArn", cfg.RoleARN)
+	}
+	if cfg.RoleSessionName != "" {
+		form.Set("RoleSessionName", cfg.RoleSessionName)
+	}
+	if cfg.Policy != "" {
+		form.Set("Policy", cfg.Policy)
+	}
+	for i, a := range cfg.PolicyARNs {
+		form.Set(fmt.Sprintf("PolicyArns.member.%d.arn", i+1), a)
+	}
+	if cfg.ProviderID != "" {
+		form.Set("ProviderId", cfg.ProviderID)
+	}
+	var out assumeRoleWithWebIdentityResponse
+	if err := postSTS(ctx, endpoint, form, nil, &out); err != nil {
+		return vendoredaws.CredentialProcessOutput{}, err
+	}
+	return out.AssumeRoleWithWebIdentityResult.Credentials.output(), nil
+}
+
+// postSTS sends a form-encoded request to the STS API at endpoint, and
+// decodes the response into out. If sign is set, it is called to sign the
+// request with the encoded form as the body.
+func postSTS(
+	ctx context.Context,
+	endpoint string,
+	form url.Values,
+	sign func(req *http.Request, body []byte) error,
+	out any,
+) error {
+	body := []byte(form.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	req.Header.Set("User-Agent", userAgent)
+	if sign != nil {
+		if err := sign(req, body); err != nil {
+			return fmt.Errorf("signing request: %w", err)
+		}
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return newSTSAPIError(resp, respBody)
+	}
+	if err := xml.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("parsing response: %w", err)
+	}
+	return nil
+}
+
+// withSTSRetries calls call until it succeeds, fails with an error which is
+// not transient, or has been attempted stsMaxAttempts times. The attempts are
+// limited to timeout in total, which defaults to defaultTimeout.
+func withSTSRetries(
+	ctx context.Context,
+	timeout time.Duration,
+	call func(ctx context.Context) (vendoredaws.CredentialProcessOutput, error),
+) (vendoredaws.CredentialProcessOutput, error) {
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for attempt := 1; ; attempt++ {
+		creds, err := call(ctx)
+		if err == nil {
+			return creds, nil
+		}
+		if attempt == stsMaxAttempts || !isTransientSTSError(err) {
+			return vendoredaws.CredentialProcessOutput{}, err
+		}
+		select {
+		case <-ctx.Done():
+			return vendoredaws.CredentialProcessOutput{}, err
+		case <-time.After(stsRetryBackoff << (attempt - 1)):
+		}
+	}
+}
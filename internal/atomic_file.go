@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to the file at path with the given permissions.
+// The data is written to a temporary file in the same directory, synced to
+// disk and then renamed over the target, so that readers never observe a
+// partially written file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return WriteFileAtomicWithOwner(path, data, perm, nil)
+}
+
+// FileOwner is the owner and group of a file. As with os.Chown, an ID of -1
+// leaves that ID unchanged.
+type FileOwner struct {
+	UID int
+	GID int
+}
+
+// WriteFileAtomicWithOwner is the same as WriteFileAtomic, but if owner is
+// non-nil the owner and group of the file are also set before it is renamed
+// over the target. Changing the owner typically requires privileges, and is
+// not supported on Windows.
+func WriteFileAtomicWithOwner(path string, data []byte, perm os.FileMode, owner *FileOwner) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if err := tmp.Chmod(perm); err != nil {
+		return fmt.Errorf("setting permissions on temporary file: %w", err)
+	}
+	if owner != nil {
+		if err := tmp.Chown(owner.UID, owner.GID); err != nil {
+			return fmt.Errorf("setting owner of temporary file: %w", err)
+		}
+	}
+	if _, err := tmp.Write(data); err != nil {
+		return fmt.Errorf("writing temporary file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("syncing temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing temporary file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("renaming temporary file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"log/slog"
+
+	"gopkg.in/ini.v1"
+)
+
+// AWSConfigFileProfile is a profile in the AWS config file which obtains
+// credentials from a credential process.
+type AWSConfigFileProfile struct {
+	// CredentialProcess is the command line to run to obtain credentials.
+	CredentialProcess string
+	// Region is the default region for the profile. If empty, any region
+	// already configured for the profile is left unchanged.
+	Region string
+}
+
+// awsConfigFileSectionName returns the name of the section for a profile in
+// the AWS config file. Unlike the credentials file, the sections of named
+// profiles are prefixed with "profile".
+func awsConfigFileSectionName(profileName string) string {
+	if profileName == "" || profileName == "default" {
+		return "default"
+	}
+	return "profile " + profileName
+}
+
+// UpsertAWSConfigFileProfile writes the provided profile to the AWS config
+// file. Other settings of an existing profile are left unchanged.
+// See https://docs.aws.amazon.com/cli/v1/userguide/cli-configure-files.html
+func UpsertAWSConfigFileProfile(
+	log *slog.Logger,
+	cfg AWSCredentialsFileConfig,
+	p AWSConfigFileProfile,
+) error {
+	return updateAWSFile(log, cfg, "AWS config file", func(f *ini.File) {
+		sec := f.Section(awsConfigFileSectionName(cfg.ProfileName))
+		sec.Key("credential_process").SetValue(p.CredentialProcess)
+		if p.Region != "" {
+			sec.Key("region").SetValue(p.Region)
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSConfigFile_Write(t *testing.T) {
+	log := slog.Default()
+
+	profile := AWSConfigFileProfile{
+		CredentialProcess: `/usr/bin/aws-spiffe-workload-helper jwt-credential-process --audience "my audience"`,
+		Region:            "eu-west-1",
+	}
+
+	preExistingContents := []byte(`[profile pre-existing]
+region = us-east-1
+output = json
+`)
+
+	tests := []struct {
+		name                 string
+		existingFileContents []byte
+		config               AWSCredentialsFileConfig
+		profile              AWSConfigFileProfile
+		want                 []byte
+		wantErr              string
+	}{
+		{
+			name:    "no pre-existing file - default profile",
+			config:  AWSCredentialsFileConfig{},
+			profile: profile,
+			want: []byte(`[default]
+credential_process = /usr/bin/aws-spiffe-workload-helper jwt-credential-process --audience "my audience"
+region             = eu-west-1
+`),
+		},
+		{
+			name: "no pre-existing file - named profile",
+			config: AWSCredentialsFileConfig{
+				ProfileName: "my-profile",
+			},
+			profile: profile,
+			want: []byte(`[profile my-profile]
+credential_process = /usr/bin/aws-spiffe-workload-helper jwt-credential-process --audience "my audience"
+region             = eu-west-1
+`),
+		},
+		{
+			name: "pre-existing file, profile name clash keeps other settings",
+			config: AWSCredentialsFileConfig{
+				ProfileName: "pre-existing",
+			},
+			profile:              profile,
+			existingFileContents: preExistingContents,
+			want: []byte(`[profile pre-existing]
+region             = eu-west-1
+output             = json
+credential_process = /usr/bin/aws-spiffe-workload-helper jwt-credential-process --audience "my audience"
+`),
+		},
+		{
+			name: "pre-existing file, no region leaves region unchanged",
+			config: AWSCredentialsFileConfig{
+				ProfileName: "pre-existing",
+			},
+			profile: AWSConfigFileProfile{
+				CredentialProcess: profile.CredentialProcess,
+			},
+			existingFileContents: preExistingContents,
+			want: []byte(`[profile pre-existing]
+region             = us-east-1
+output             = json
+credential_process = /usr/bin/aws-spiffe-workload-helper jwt-credential-process --audience "my audience"
+`),
+		},
+		{
+			name: "pre-existing file with replace mode",
+			config: AWSCredentialsFileConfig{
+				ReplaceFile: true,
+			},
+			profile:              profile,
+			existingFileContents: preExistingContents,
+			want: []byte(`[default]
+credential_process = /usr/bin/aws-spiffe-workload-helper jwt-credential-process --audience "my audience"
+region             = eu-west-1
+`),
+		},
+		{
+			name:                 "pre-existing file with garbage",
+			config:               AWSCredentialsFileConfig{},
+			profile:              profile,
+			existingFileContents: []byte(`dduhufd`),
+			wantErr:              "key-value delimiter not found",
+		},
+		{
+			name: "pre-existing file with garbage, --force",
+			config: AWSCredentialsFileConfig{
+				Force: true,
+			},
+			profile:              profile,
+			existingFileContents: []byte(`dduhufd`),
+			want: []byte(`[default]
+credential_process = /usr/bin/aws-spiffe-workload-helper jwt-credential-process --audience "my audience"
+region             = eu-west-1
+`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			configPath := filepath.Join(tmp, "config")
+			cfg := tt.config
+			cfg.Path = configPath
+
+			if tt.existingFileContents != nil {
+				require.NoError(t, os.WriteFile(configPath, tt.existingFileContents, 0600))
+			}
+
+			err := UpsertAWSConfigFileProfile(
+				log,
+				cfg,
+				tt.profile,
+			)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			got, err := os.ReadFile(configPath)
+			require.NoError(t, err)
+
+			require.Equal(t, string(tt.want), string(got))
+		})
+	}
+}
@@ -1,25 +1,77 @@
 package internal
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"gopkg.in/ini.v1"
 )
 
+// DefaultAWSFileMode is the permissions with which AWS credentials and config
+// files are written, unless configured otherwise.
+const DefaultAWSFileMode os.FileMode = 0600
+
 type AWSCredentialsFileConfig struct {
 	Path        string
 	ProfileName string
 	Force       bool
 	ReplaceFile bool
+	// Mode is the permissions the file is written with. Defaults to
+	// DefaultAWSFileMode.
+	Mode os.FileMode
+	// Owner is the owner and group the file is written with. If nil, the
+	// file is owned by the user running the process.
+	Owner *FileOwner
 }
 
 type AWSCredentialsFileProfile struct {
 	AWSAccessKeyID     string
 	AWSSecretAccessKey string
 	AWSSessionToken    string
+
+	// The remaining fields are optional metadata describing the credentials.
+	// They are written alongside the credentials if set. If the profile was
+	// previously written with metadata by this tool, as recorded by
+	// x_managed_by, unset fields are removed from the profile, so that
+	// metadata from a previous write is not left behind. Otherwise, keys
+	// which are not set are left alone, as they may have been added by hand.
+
+	// AccountID is the AWS account the credentials belong to. It is written
+	// as aws_account_id, which is understood by the AWS SDKs.
+	AccountID string
+	// Expiration is when the credentials expire. It is written as
+	// x_security_token_expires, in RFC 3339 format.
+	Expiration time.Time
+	// SPIFFEID is the SPIFFE ID of the SVID exchanged for the credentials.
+	SPIFFEID string
+	// RoleARN is the ARN of the role the credentials are for.
+	RoleARN string
+	// ManagedBy names the tool which wrote the credentials. It is written as
+	// x_managed_by, and should be AWSCredentialsFileManagedBy.
+	ManagedBy string
+}
+
+// AWSCredentialsFileManagedBy is written to x_managed_by in profiles written
+// with metadata, to identify the tool which maintains them.
+const AWSCredentialsFileManagedBy = "aws-spiffe-workload-helper"
+
+// setOrDeleteKey sets key within sec to value. If value is empty, the key is
+// removed if remove is set, and otherwise left alone.
+func setOrDeleteKey(sec *ini.Section, key, value string, remove bool) {
+	if value == "" {
+		if remove {
+			sec.DeleteKey(key)
+		}
+		return
+	}
+	sec.Key(key).SetValue(value)
 }
 
 func ensureDirectory(fpath string) error {
@@ -32,9 +84,12 @@ func ensureDirectory(fpath string) error {
 	return nil
 }
 
-func loadAWSCredentialsFile(
+// loadAWSFile loads an AWS credentials or config file for modification.
+// description names the file in log messages.
+func loadAWSFile(
 	log *slog.Logger,
 	cfg AWSCredentialsFileConfig,
+	description string,
 ) (*ini.File, error) {
 	if cfg.ReplaceFile {
 		return ini.Empty(), nil
@@ -58,7 +113,7 @@ func loadAWSCredentialsFile(
 	// If force mode is enabled, ignore the error and return an empty file.
 	if cfg.Force {
 		log.Warn(
-			"When loading the existing AWS credentials file, an error occurred. As --force is set, the file will be overwritten.",
+			fmt.Sprintf("When loading the existing %s, an error occurred. As --force is set, the file will be overwritten.", description),
 			"error", err,
 			"path", cfg.Path,
 		)
@@ -67,11 +122,67 @@ func loadAWSCredentialsFile(
 
 	// Otherwise, fail...
 	log.Error(
-		"When loading the existing AWS credentials file, an error occurred. Use --force to ignore errors and attempt to overwrite.",
+		fmt.Sprintf("When loading the existing %s, an error occurred. Use --force to ignore errors and attempt to overwrite.", description),
 		"error", err,
 		"path", cfg.Path,
 	)
-	return nil, fmt.Errorf("loading existing aws credentials file: %w", err)
+	return nil, fmt.Errorf("loading existing %s: %w", strings.ToLower(description), err)
+}
+
+// lockAWSFile calls fn while holding an advisory lock on a lock file
+// alongside an AWS credentials or config file, so that processes writing
+// different profiles to the same file do not discard each other's changes.
+func lockAWSFile(cfg AWSCredentialsFileConfig, description string, fn func() error) (err error) {
+	unlock, err := LockFile(cfg.Path + ".lock")
+	if err != nil {
+		return fmt.Errorf("locking %s: %w", strings.ToLower(description), err)
+	}
+	defer func() {
+		if unlockErr := unlock(); unlockErr != nil && err == nil {
+			err = fmt.Errorf("unlocking %s: %w", strings.ToLower(description), unlockErr)
+		}
+	}()
+	return fn()
+}
+
+// updateAWSFile loads an AWS credentials or config file, modifies it with
+// update and saves it, while holding the lock for the file. The file is
+// written atomically, so that readers never observe a partially written file.
+func updateAWSFile(
+	log *slog.Logger,
+	cfg AWSCredentialsFileConfig,
+	description string,
+	update func(f *ini.File),
+) error {
+	return lockAWSFile(cfg, description, func() error {
+		f, err := loadAWSFile(log, cfg, description)
+		if err != nil {
+			return err
+		}
+		update(f)
+
+		var buf bytes.Buffer
+		if _, err := f.WriteTo(&buf); err != nil {
+			return fmt.Errorf("encoding %s: %w", strings.ToLower(description), err)
+		}
+		mode := cfg.Mode
+		if mode == 0 {
+			mode = DefaultAWSFileMode
+		}
+		if err := WriteFileAtomicWithOwner(cfg.Path, buf.Bytes(), mode, cfg.Owner); err != nil {
+			return fmt.Errorf("saving %s: %w", strings.ToLower(description), err)
+		}
+		return nil
+	})
+}
+
+// awsCredentialsFileSectionName returns the name of the section holding a
+// profile in the AWS credentials file.
+func awsCredentialsFileSectionName(profileName string) string {
+	if profileName == "" {
+		return "default"
+	}
+	return profileName
 }
 
 // UpsertAWSCredentialsFileProfile writes the provided AWS credentials profile to the AWS credentials file.
@@ -81,23 +192,51 @@ func UpsertAWSCredentialsFileProfile(
 	cfg AWSCredentialsFileConfig,
 	p AWSCredentialsFileProfile,
 ) error {
-	f, err := loadAWSCredentialsFile(log, cfg)
-	if err != nil {
-		return fmt.Errorf("loading existing aws credentials: %w", err)
-	}
+	return updateAWSFile(log, cfg, "AWS credentials file", func(f *ini.File) {
+		sec := f.Section(awsCredentialsFileSectionName(cfg.ProfileName))
 
-	sectionName := "default"
-	if cfg.ProfileName != "" {
-		sectionName = cfg.ProfileName
-	}
-	sec := f.Section(sectionName)
+		sec.Key("aws_secret_access_key").SetValue(p.AWSSecretAccessKey)
+		sec.Key("aws_access_key_id").SetValue(p.AWSAccessKeyID)
+		sec.Key("aws_session_token").SetValue(p.AWSSessionToken)
 
-	sec.Key("aws_secret_access_key").SetValue(p.AWSSecretAccessKey)
-	sec.Key("aws_access_key_id").SetValue(p.AWSAccessKeyID)
-	sec.Key("aws_session_token").SetValue(p.AWSSessionToken)
+		// Metadata is only removed from profiles this tool previously wrote
+		// metadata to.
+		managed := sec.HasKey("x_managed_by") &&
+			sec.Key("x_managed_by").String() == AWSCredentialsFileManagedBy
+		setOrDeleteKey(sec, "aws_account_id", p.AccountID, managed)
+		var expiration string
+		if !p.Expiration.IsZero() {
+			expiration = p.Expiration.UTC().Format(time.RFC3339)
+		}
+		setOrDeleteKey(sec, "x_security_token_expires", expiration, managed)
+		setOrDeleteKey(sec, "x_spiffe_id", p.SPIFFEID, managed)
+		setOrDeleteKey(sec, "x_role_arn", p.RoleARN, managed)
+		setOrDeleteKey(sec, "x_managed_by", p.ManagedBy, managed)
+	})
+}
 
-	if err := f.SaveTo(cfg.Path); err != nil {
-		return fmt.Errorf("saving aws credentials file: %w", err)
+// RemoveAWSCredentialsFileProfile removes a profile written by
+// UpsertAWSCredentialsFileProfile from the AWS credentials file. If
+// cfg.ReplaceFile is set, the file only contains profiles written by this
+// tool, so the whole file is removed instead. It is not an error for the file
+// or profile not to exist.
+func RemoveAWSCredentialsFileProfile(
+	log *slog.Logger,
+	cfg AWSCredentialsFileConfig,
+) error {
+	const description = "AWS credentials file"
+	if _, err := os.Stat(cfg.Path); errors.Is(err, fs.ErrNotExist) {
+		return nil
 	}
-	return nil
+	if cfg.ReplaceFile {
+		return lockAWSFile(cfg, description, func() error {
+			if err := os.Remove(cfg.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("removing aws credentials file: %w", err)
+			}
+			return nil
+		})
+	}
+	return updateAWSFile(log, cfg, description, func(f *ini.File) {
+		f.DeleteSection(awsCredentialsFileSectionName(cfg.ProfileName))
+	})
 }
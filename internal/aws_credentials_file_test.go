@@ -1,12 +1,18 @@
 package internal
 
 import (
+	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/ini.v1"
 )
 
 func TestAWSCredentialsFile_Write(t *testing.T) {
@@ -18,6 +24,13 @@ func TestAWSCredentialsFile_Write(t *testing.T) {
 		AWSSessionToken:    "ijklmnop",
 	}
 
+	metadataProfile := defaultProfile
+	metadataProfile.AccountID = "123456789012"
+	metadataProfile.Expiration = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	metadataProfile.SPIFFEID = "spiffe://example.org/workload"
+	metadataProfile.RoleARN = "arn:aws:iam::123456789012:role/example"
+	metadataProfile.ManagedBy = AWSCredentialsFileManagedBy
+
 	preExistingContents := []byte(`[pre-existing]
 aws_secret_access_key = foo
 aws_access_key_id     = bar
@@ -103,6 +116,87 @@ aws_session_token     = ijklmnop
 			existingFileContents: []byte(`dduhufd`),
 			wantErr:              "key-value delimiter not found",
 		},
+		{
+			name:    "no pre-existing file - metadata",
+			config:  AWSCredentialsFileConfig{},
+			profile: metadataProfile,
+			want: []byte(`[default]
+aws_secret_access_key    = abcdefgh
+aws_access_key_id        = 1234567890
+aws_session_token        = ijklmnop
+aws_account_id           = 123456789012
+x_security_token_expires = 2024-01-02T03:04:05Z
+x_spiffe_id              = spiffe://example.org/workload
+x_role_arn               = arn:aws:iam::123456789012:role/example
+x_managed_by             = aws-spiffe-workload-helper
+`),
+		},
+		{
+			name:    "pre-existing metadata is removed when not set",
+			config:  AWSCredentialsFileConfig{},
+			profile: defaultProfile,
+			existingFileContents: []byte(`[default]
+aws_secret_access_key    = foo
+aws_access_key_id        = bar
+aws_session_token        = bizz
+aws_account_id           = 123456789012
+x_security_token_expires = 2024-01-02T03:04:05Z
+x_spiffe_id              = spiffe://example.org/workload
+x_role_arn               = arn:aws:iam::123456789012:role/example
+x_managed_by             = aws-spiffe-workload-helper
+`),
+			want: []byte(`[default]
+aws_secret_access_key = abcdefgh
+aws_access_key_id     = 1234567890
+aws_session_token     = ijklmnop
+`),
+		},
+		{
+			name:    "pre-existing keys are kept when not managed by this tool",
+			config:  AWSCredentialsFileConfig{},
+			profile: defaultProfile,
+			existingFileContents: []byte(`[default]
+aws_secret_access_key = foo
+aws_access_key_id     = bar
+aws_session_token     = bizz
+aws_account_id        = 123456789012
+x_role_arn            = arn:aws:iam::123456789012:role/example
+x_managed_by          = another-tool
+`),
+			want: []byte(`[default]
+aws_secret_access_key = abcdefgh
+aws_access_key_id     = 1234567890
+aws_session_token     = ijklmnop
+aws_account_id        = 123456789012
+x_role_arn            = arn:aws:iam::123456789012:role/example
+x_managed_by          = another-tool
+`),
+		},
+		{
+			name:   "pre-existing keys are kept when writing metadata to a profile not managed by this tool",
+			config: AWSCredentialsFileConfig{},
+			profile: AWSCredentialsFileProfile{
+				AWSAccessKeyID:     "1234567890",
+				AWSSecretAccessKey: "abcdefgh",
+				AWSSessionToken:    "ijklmnop",
+				SPIFFEID:           "spiffe://example.org/workload",
+				ManagedBy:          AWSCredentialsFileManagedBy,
+			},
+			existingFileContents: []byte(`[default]
+aws_secret_access_key = foo
+aws_access_key_id     = bar
+aws_session_token     = bizz
+aws_account_id        = 123456789012
+`),
+			want: []byte(`[default]
+aws_secret_access_key = abcdefgh
+aws_access_key_id     = 1234567890
+aws_session_token     = ijklmnop
+aws_account_id        = 123456789012
+x_spiffe_id           = spiffe://example.org/workload
+x_managed_by          = aws-spiffe-workload-helper
+`),
+		},
 		{
 			name: "pre-existing file with garbage, --force",
 			config: AWSCredentialsFileConfig{
@@ -146,3 +240,133 @@ aws_session_token     = ijklmnop
 		})
 	}
 }
+
+func TestAWSCredentialsFile_Mode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on Windows")
+	}
+	profile := AWSCredentialsFileProfile{
+		AWSAccessKeyID:     "1234567890",
+		AWSSecretAccessKey: "abcdefgh",
+		AWSSessionToken:    "ijklmnop",
+	}
+	credentialPath := filepath.Join(t.TempDir(), "credentials")
+
+	// An existing file is replaced with one with the configured mode.
+	require.NoError(t, os.WriteFile(credentialPath, nil, 0644))
+	require.NoError(t, UpsertAWSCredentialsFileProfile(slog.Default(), AWSCredentialsFileConfig{
+		Path: credentialPath,
+	}, profile))
+	info, err := os.Stat(credentialPath)
+	require.NoError(t, err)
+	require.Equal(t, DefaultAWSFileMode, info.Mode().Perm())
+
+	require.NoError(t, UpsertAWSCredentialsFileProfile(slog.Default(), AWSCredentialsFileConfig{
+		Path:  credentialPath,
+		Mode:  0640,
+		Owner: &FileOwner{UID: -1, GID: os.Getgid()},
+	}, profile))
+	info, err = os.Stat(credentialPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+}
+
+func TestAWSCredentialsFile_ConcurrentWrites(t *testing.T) {
+	credentialPath := filepath.Join(t.TempDir(), "credentials")
+
+	// Each writer upserts its own profile. As the load-modify-save cycle is
+	// locked, none of the profiles should be lost.
+	const writers = 10
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := UpsertAWSCredentialsFileProfile(slog.Default(), AWSCredentialsFileConfig{
+				Path:        credentialPath,
+				ProfileName: fmt.Sprintf("profile-%d", i),
+			}, AWSCredentialsFileProfile{
+				AWSAccessKeyID: fmt.Sprintf("key-%d", i),
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	f, err := ini.Load(credentialPath)
+	require.NoError(t, err)
+	for i := range writers {
+		assert.Equal(t, fmt.Sprintf("key-%d", i), f.Section(fmt.Sprintf("profile-%d", i)).Key("aws_access_key_id").String())
+	}
+}
+
+func TestAWSCredentialsFile_Remove(t *testing.T) {
+	existingContents := []byte(`[other]
+aws_secret_access_key = foo
+aws_access_key_id     = bar
+aws_session_token     = bizz
+
+[default]
+aws_secret_access_key = abcdefgh
+aws_access_key_id     = 1234567890
+aws_session_token     = ijklmnop
+`)
+
+	tests := []struct {
+		name                 string
+		existingFileContents []byte
+		config               AWSCredentialsFileConfig
+		want                 []byte
+	}{
+		{
+			name:                 "removes profile",
+			existingFileContents: existingContents,
+			config:               AWSCredentialsFileConfig{},
+			want: []byte(`[other]
+aws_secret_access_key = foo
+aws_access_key_id     = bar
+aws_session_token     = bizz
+`),
+		},
+		{
+			name:                 "profile does not exist",
+			existingFileContents: existingContents,
+			config: AWSCredentialsFileConfig{
+				ProfileName: "missing",
+			},
+			want: existingContents,
+		},
+		{
+			name:                 "removes file in replace mode",
+			existingFileContents: existingContents,
+			config: AWSCredentialsFileConfig{
+				ReplaceFile: true,
+			},
+		},
+		{
+			name:   "file does not exist",
+			config: AWSCredentialsFileConfig{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			credentialPath := filepath.Join(t.TempDir(), "credentials")
+			cfg := tt.config
+			cfg.Path = credentialPath
+
+			if tt.existingFileContents != nil {
+				require.NoError(t, os.WriteFile(credentialPath, tt.existingFileContents, 0600))
+			}
+
+			require.NoError(t, RemoveAWSCredentialsFileProfile(slog.Default(), cfg))
+
+			got, err := os.ReadFile(credentialPath)
+			if tt.want == nil {
+				require.ErrorIs(t, err, os.ErrNotExist)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, string(tt.want), string(got))
+		})
+	}
+}
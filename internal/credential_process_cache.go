@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spiffe/aws-spiffe-workload-helper/vendoredaws"
+)
+
+// CredentialProcessCacheEntry is a set of credentials stored in the
+// credential process cache.
+type CredentialProcessCacheEntry struct {
+	// SVIDFingerprint identifies the SVID that was exchanged for the
+	// credentials, so that the entry can be invalidated when it rotates.
+	SVIDFingerprint string                              `json:"svid_fingerprint"`
+	Credentials     vendoredaws.CredentialProcessOutput `json:"credentials"`
+}
+
+// CredentialProcessCache stores the output of credential process
+// invocations on disk, so that it can be reused by later invocations.
+//
+// Each entry is identified by a key, which must be safe for use as a file
+// name. Entries are written with 0600 permissions within a directory created
+// with 0700 permissions.
+type CredentialProcessCache struct {
+	Dir string
+}
+
+func (c CredentialProcessCache) entryPath(key string) string {
+	return filepath.Join(c.Dir, key+".json")
+}
+
+// Lock acquires an exclusive lock on the entry with the given key, which is
+// shared with other processes using the same cache directory. The returned
+// function releases the lock.
+func (c CredentialProcessCache) Lock(key string) (func() error, error) {
+	return LockFile(filepath.Join(c.Dir, key+".lock"))
+}
+
+// Load returns the entry with the given key. If there is no such entry, it
+// returns nil.
+func (c CredentialProcessCache) Load(key string) (*CredentialProcessCacheEntry, error) {
+	b, err := os.ReadFile(c.entryPath(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading cache entry: %w", err)
+	}
+	entry := &CredentialProcessCacheEntry{}
+	if err := json.Unmarshal(b, entry); err != nil {
+		return nil, fmt.Errorf("unmarshalling cache entry: %w", err)
+	}
+	return entry, nil
+}
+
+// Store writes the entry with the given key, replacing any existing entry.
+func (c CredentialProcessCache) Store(key string, entry CredentialProcessCacheEntry) error {
+	if err := ensureDirectory(c.entryPath(key)); err != nil {
+		return fmt.Errorf("ensuring cache directory: %w", err)
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("marshalling cache entry: %w", err)
+	}
+	if err := WriteFileAtomic(c.entryPath(key), b, 0600); err != nil {
+		return fmt.Errorf("writing cache entry: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/spiffe/aws-spiffe-workload-helper/vendoredaws"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialProcessCache(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	cache := CredentialProcessCache{Dir: dir}
+
+	got, err := cache.Load("key")
+	require.NoError(t, err)
+	require.Nil(t, got)
+
+	entry := CredentialProcessCacheEntry{
+		SVIDFingerprint: "fingerprint",
+		Credentials: vendoredaws.CredentialProcessOutput{
+			Version:         1,
+			AccessKeyId:     "1234567890",
+			SecretAccessKey: "abcdefgh",
+			SessionToken:    "ijklmnop",
+			Expiration:      "2024-01-01T00:00:00Z",
+		},
+	}
+	require.NoError(t, cache.Store("key", entry))
+
+	got, err = cache.Load("key")
+	require.NoError(t, err)
+	require.Equal(t, &entry, got)
+
+	info, err := os.Stat(filepath.Join(dir, "key.json"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(dir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "garbage.json"), []byte("{"), 0600))
+	_, err = cache.Load("garbage")
+	require.ErrorContains(t, err, "unmarshalling cache entry")
+}
+
+func TestCredentialProcessCache_Lock(t *testing.T) {
+	cache := CredentialProcessCache{Dir: t.TempDir()}
+
+	// Each goroutine increments the counter non-atomically whilst holding the
+	// lock, so any overlap would be detected by the race detector or result
+	// in a lost update.
+	counter := 0
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := cache.Lock("key")
+			if !assertNoError(t, err) {
+				return
+			}
+			counter++
+			assertNoError(t, unlock())
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 10, counter)
+}
+
+func assertNoError(t *testing.T, err error) bool {
+	t.Helper()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return false
+	}
+	return true
+}
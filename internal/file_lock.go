@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+)
+
+// LockFile acquires an exclusive advisory lock on the file at path, creating
+// it if it does not exist. It blocks until the lock can be acquired. The
+// returned function releases the lock.
+func LockFile(path string) (func() error, error) {
+	if err := ensureDirectory(path); err != nil {
+		return nil, fmt.Errorf("ensuring parent directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening lock file: %w", err)
+	}
+	if err := lockFile(f); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("locking file (%s): %w", path, err)
+	}
+	return func() error {
+		if err := unlockFile(f); err != nil {
+			_ = f.Close()
+			return fmt.Errorf("unlocking file (%s): %w", path, err)
+		}
+		return f.Close()
+	}, nil
+}
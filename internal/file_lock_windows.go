@@ -0,0 +1,21 @@
+//go:build windows
+
+package internal
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+func lockFile(f *os.File) error {
+	return windows.LockFileEx(
+		windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, new(windows.Overlapped),
+	)
+}
+
+func unlockFile(f *os.File) error {
+	return windows.UnlockFileEx(
+		windows.Handle(f.Fd()), 0, 1, 0, new(windows.Overlapped),
+	)
+}
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// Renewal policies, which determine when the long-running commands renew AWS
+// credentials.
+const (
+	// RenewalPolicyFraction renews once a fraction of the remaining lifetime
+	// of the credentials has passed.
+	RenewalPolicyFraction = "fraction"
+	// RenewalPolicyInterval renews at a fixed interval.
+	RenewalPolicyInterval = "interval"
+	// RenewalPolicyBeforeExpiry renews a fixed duration before the
+	// credentials expire.
+	RenewalPolicyBeforeExpiry = "before-expiry"
+	// RenewalPolicySVID renews when the SVID is rotated. Where rotations
+	// are not notified, it renews when the SVID is expected to be rotated,
+	// which SPIRE does once half of its lifetime has passed.
+	RenewalPolicySVID = "svid"
+)
+
+// RenewalPolicies are the supported renewal policies.
+var RenewalPolicies = []string{
+	RenewalPolicyFraction,
+	RenewalPolicyInterval,
+	RenewalPolicyBeforeExpiry,
+	RenewalPolicySVID,
+}
+
+// Clock provides the current time. It allows time to be controlled in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is a Clock which returns the system time.
+var SystemClock Clock = systemClock{}
+
+// RenewalPolicy determines when AWS credentials obtained by exchanging an SVID
+// should next be renewed.
+type RenewalPolicy struct {
+	// Policy is one of RenewalPolicies.
+	Policy string
+	// Fraction is the fraction of the remaining lifetime of the credentials
+	// after which they are renewed, for RenewalPolicyFraction.
+	Fraction float64
+	// Interval is how often the credentials are renewed, for
+	// RenewalPolicyInterval.
+	Interval time.Duration
+	// BeforeExpiry is how long before the credentials expire they are
+	// renewed, for RenewalPolicyBeforeExpiry.
+	BeforeExpiry time.Duration
+	// Jitter is the largest fraction of the time until renewal by which
+	// renewal is randomly brought forward, so that many helpers started at
+	// once do not renew in lockstep. Zero disables jitter.
+	Jitter float64
+
+	// Clock provides the current time. If nil, SystemClock is used.
+	Clock Clock
+	// Rand returns a random number in [0, n). If nil, math/rand/v2 is used.
+	Rand func(n int64) int64
+}
+
+// Validate checks that the policy and its settings are valid.
+func (p *RenewalPolicy) Validate() error {
+	switch p.Policy {
+	case RenewalPolicyFraction:
+		if p.Fraction <= 0 || p.Fraction >= 1 {
+			return fmt.Errorf("renewal fraction must be between 0 and 1 exclusive, got %v", p.Fraction)
+		}
+	case RenewalPolicyInterval:
+		if p.Interval <= 0 {
+			return fmt.Errorf("renewal interval must be positive, got %s", p.Interval)
+		}
+	case RenewalPolicyBeforeExpiry:
+		if p.BeforeExpiry <= 0 {
+			return fmt.Errorf("renewal before expiry must be positive, got %s", p.BeforeExpiry)
+		}
+	case RenewalPolicySVID:
+	default:
+		return fmt.Errorf("renewal policy must be one of %v, got %q", RenewalPolicies, p.Policy)
+	}
+	if p.Jitter < 0 || p.Jitter >= 1 {
+		return fmt.Errorf("renewal jitter must be at least 0 and less than 1, got %v", p.Jitter)
+	}
+	return nil
+}
+
+// NextRenewal returns when credentials expiring at awsExpiresAt, which were
+// obtained with an SVID expiring at svidExpiresAt, should be renewed.
+//
+// svidNotified is whether the caller is notified when the SVID is rotated,
+// and renews the credentials then. If it is not, the credentials are also
+// renewed once the SVID is halfway through its remaining lifetime, so that a
+// fresh SVID is presented to AWS.
+//
+// Whatever the policy, the credentials are renewed no later than halfway
+// through their remaining lifetime when the policy would otherwise renew
+// them after they expire, e.g. with an interval longer than the session.
+func (p *RenewalPolicy) NextRenewal(awsExpiresAt, svidExpiresAt time.Time, svidNotified bool) time.Time {
+	now := p.now()
+	awsTTL := awsExpiresAt.Sub(now)
+	svidTTL := svidExpiresAt.Sub(now)
+
+	var renewIn time.Duration
+	switch p.Policy {
+	case RenewalPolicyInterval:
+		renewIn = p.Interval
+	case RenewalPolicyBeforeExpiry:
+		renewIn = awsTTL - p.BeforeExpiry
+	case RenewalPolicySVID:
+		// Where rotations are notified, renewal is triggered by them, so
+		// the SVID expiring is only a fallback.
+		renewIn = svidTTL
+		if !svidNotified {
+			renewIn = svidTTL / 2
+		}
+	default:
+		renewIn = time.Duration(float64(awsTTL) * p.Fraction)
+	}
+	if renewIn <= 0 || renewIn >= awsTTL {
+		renewIn = awsTTL / 2
+	}
+	if !svidNotified && svidTTL/2 < renewIn {
+		renewIn = svidTTL / 2
+	}
+	if p.Jitter > 0 && renewIn > 0 {
+		if maxJitter := int64(float64(renewIn) * p.Jitter); maxJitter > 0 {
+			renewIn -= time.Duration(p.randN(maxJitter + 1))
+		}
+	}
+	return now.Add(max(renewIn, 0))
+}
+
+func (p *RenewalPolicy) now() time.Time {
+	if p.Clock == nil {
+		return SystemClock.Now()
+	}
+	return p.Clock.Now()
+}
+
+func (p *RenewalPolicy) randN(n int64) int64 {
+	if p.Rand == nil {
+		return rand.Int64N(n)
+	}
+	return p.Rand(n)
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestRenewalPolicy_NextRenewal(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	awsExpiresAt := now.Add(time.Hour)
+	svidExpiresAt := now.Add(4 * time.Hour)
+
+	tests := []struct {
+		name          string
+		policy        RenewalPolicy
+		svidExpiresAt time.Time
+		svidNotified  bool
+		want          time.Duration
+	}{
+		{
+			name:         "fraction",
+			policy:       RenewalPolicy{Policy: RenewalPolicyFraction, Fraction: 0.8},
+			svidNotified: true,
+			want:         48 * time.Minute,
+		},
+		{
+			name:         "interval",
+			policy:       RenewalPolicy{Policy: RenewalPolicyInterval, Interval: 5 * time.Minute},
+			svidNotified: true,
+			want:         5 * time.Minute,
+		},
+		{
+			name:         "interval longer than credentials lifetime",
+			policy:       RenewalPolicy{Policy: RenewalPolicyInterval, Interval: 2 * time.Hour},
+			svidNotified: true,
+			want:         30 * time.Minute,
+		},
+		{
+			name:         "before expiry",
+			policy:       RenewalPolicy{Policy: RenewalPolicyBeforeExpiry, BeforeExpiry: 10 * time.Minute},
+			svidNotified: true,
+			want:         50 * time.Minute,
+		},
+		{
+			name:         "before expiry longer than credentials lifetime",
+			policy:       RenewalPolicy{Policy: RenewalPolicyBeforeExpiry, BeforeExpiry: 2 * time.Hour},
+			svidNotified: true,
+			want:         30 * time.Minute,
+		},
+		{
+			name:          "svid with notifications",
+			policy:        RenewalPolicy{Policy: RenewalPolicySVID},
+			svidExpiresAt: now.Add(50 * time.Minute),
+			svidNotified:  true,
+			want:          50 * time.Minute,
+		},
+		{
+			name:          "svid without notifications",
+			policy:        RenewalPolicy{Policy: RenewalPolicySVID},
+			svidExpiresAt: now.Add(50 * time.Minute),
+			want:          25 * time.Minute,
+		},
+		{
+			name:         "svid outliving credentials",
+			policy:       RenewalPolicy{Policy: RenewalPolicySVID},
+			svidNotified: true,
+			want:         30 * time.Minute,
+		},
+		{
+			name:          "without notifications, renews halfway through svid lifetime",
+			policy:        RenewalPolicy{Policy: RenewalPolicyFraction, Fraction: 0.5},
+			svidExpiresAt: now.Add(10 * time.Minute),
+			want:          5 * time.Minute,
+		},
+		{
+			name: "jitter",
+			policy: RenewalPolicy{
+				Policy:   RenewalPolicyInterval,
+				Interval: 10 * time.Minute,
+				Jitter:   0.1,
+				Rand: func(n int64) int64 {
+					// Bring renewal forward by the maximum amount.
+					return n - 1
+				},
+			},
+			svidNotified: true,
+			want:         9 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.policy
+			p.Clock = fakeClock{now: now}
+			require.NoError(t, p.Validate())
+			svid := tt.svidExpiresAt
+			if svid.IsZero() {
+				svid = svidExpiresAt
+			}
+			got := p.NextRenewal(awsExpiresAt, svid, tt.svidNotified)
+			require.Equal(t, tt.want, got.Sub(now))
+		})
+	}
+}
+
+func TestRenewalPolicy_Jitter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := RenewalPolicy{
+		Policy:   RenewalPolicyFraction,
+		Fraction: 0.5,
+		Jitter:   0.2,
+		Clock:    fakeClock{now: now},
+	}
+	require.NoError(t, p.Validate())
+
+	// Renewal is only ever brought forward, by up to the jitter fraction.
+	for range 100 {
+		got := p.NextRenewal(now.Add(time.Hour), now.Add(time.Hour), true).Sub(now)
+		require.LessOrEqual(t, got, 30*time.Minute)
+		require.GreaterOrEqual(t, got, 24*time.Minute)
+	}
+}
+
+func TestRenewalPolicy_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RenewalPolicy
+		wantErr string
+	}{
+		{
+			name:    "unknown policy",
+			policy:  RenewalPolicy{Policy: "sometimes"},
+			wantErr: `renewal policy must be one of [fraction interval before-expiry svid], got "sometimes"`,
+		},
+		{
+			name:    "fraction out of range",
+			policy:  RenewalPolicy{Policy: RenewalPolicyFraction, Fraction: 1},
+			wantErr: "renewal fraction must be between 0 and 1 exclusive, got 1",
+		},
+		{
+			name:    "interval not positive",
+			policy:  RenewalPolicy{Policy: RenewalPolicyInterval},
+			wantErr: "renewal interval must be positive, got 0s",
+		},
+		{
+			name:    "before expiry not positive",
+			policy:  RenewalPolicy{Policy: RenewalPolicyBeforeExpiry, BeforeExpiry: -time.Minute},
+			wantErr: "renewal before expiry must be positive, got -1m0s",
+		},
+		{
+			name:    "jitter out of range",
+			policy:  RenewalPolicy{Policy: RenewalPolicySVID, Jitter: 1.5},
+			wantErr: "renewal jitter must be at least 0 and less than 1, got 1.5",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.EqualError(t, tt.policy.Validate(), tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package integration_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spiffe/aws-spiffe-workload-helper/cmd/cli"
+	"github.com/spiffe/aws-spiffe-workload-helper/tests/integration/internal/fakeawsapi"
+	"github.com/spiffe/aws-spiffe-workload-helper/tests/integration/internal/fakespiffeapi"
+	"github.com/spiffe/aws-spiffe-workload-helper/vendoredaws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	return writeConfigFileNamed(t, "config.yaml", contents)
+}
+
+func writeConfigFileNamed(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+func TestX509CredentialProcess_ConfigFile(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		X509Response: ca.CreateX509SVIDResponse(t),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		CACert: ca.CACert,
+		RolesAnywhere: &fakeawsapi.RolesAnywhereExpectations{
+			RoleARN:        testRoleARN,
+			ProfileARN:     testProfileARN,
+			TrustAnchorARN: testTrustAnchorARN,
+		},
+	})
+
+	// The command section takes precedence over the top-level settings, and
+	// the environment takes precedence over the file.
+	configPath := writeConfigFile(t, fmt.Sprintf(`
+role_arn: arn:aws:iam::123456789012:role/overridden-by-env
+profile_arn: %[1]s
+trust_anchor_arn: %[2]s
+endpoint: http://127.0.0.1:1
+# Settings for other commands are ignored.
+aws_credentials_path: /nonexistent
+x509_credential_process:
+  endpoint: %[3]s
+  region: us-east-1
+`, testProfileARN, testTrustAnchorARN, awsSrv.URL))
+	t.Setenv("AWS_SPIFFE_CONFIG", configPath)
+	t.Setenv("AWS_SPIFFE_ROLE_ARN", testRoleARN)
+	t.Setenv("AWS_SPIFFE_WORKLOAD_API_ADDR", "unix:///nonexistent")
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+
+	var stdout bytes.Buffer
+	rootCmd.SetOut(&stdout)
+	rootCmd.SetArgs([]string{
+		"x509-credential-process",
+		// Flags take precedence over the environment.
+		"--workload-api-addr", spiffeAddr,
+	})
+	require.NoError(t, rootCmd.Execute())
+
+	var creds vendoredaws.CredentialProcessOutput
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &creds))
+	assert.Equal(t, fakeawsapi.AccessKeyID, creds.AccessKeyId)
+}
+
+func TestX509CredentialProcess_TOMLConfigFile(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		X509Response: ca.CreateX509SVIDResponse(t),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		CACert: ca.CACert,
+		RolesAnywhere: &fakeawsapi.RolesAnywhereExpectations{
+			RoleARN:        testRoleARN,
+			ProfileARN:     testProfileARN,
+			TrustAnchorARN: testTrustAnchorARN,
+		},
+	})
+
+	// The command section takes precedence over the top-level settings, and
+	// the environment takes precedence over the file.
+	configPath := writeConfigFileNamed(t, "config.toml", fmt.Sprintf(`
+role_arn = "arn:aws:iam::123456789012:role/overridden-by-env"
+profile_arn = "%[1]s"
+trust_anchor_arn = "%[2]s"
+endpoint = "http://127.0.0.1:1"
+session_duration = 3600
+# Settings for other commands are ignored.
+aws_credentials_path = "/nonexistent"
+
+[x509_credential_process]
+endpoint = "%[3]s"
+region = "us-east-1"
+`, testProfileARN, testTrustAnchorARN, awsSrv.URL))
+	t.Setenv("AWS_SPIFFE_CONFIG", configPath)
+	t.Setenv("AWS_SPIFFE_ROLE_ARN", testRoleARN)
+	t.Setenv("AWS_SPIFFE_WORKLOAD_API_ADDR", "unix:///nonexistent")
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+
+	var stdout bytes.Buffer
+	rootCmd.SetOut(&stdout)
+	rootCmd.SetArgs([]string{
+		"x509-credential-process",
+		// Flags take precedence over the environment.
+		"--workload-api-addr", spiffeAddr,
+	})
+	require.NoError(t, rootCmd.Execute())
+
+	var creds vendoredaws.CredentialProcessOutput
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &creds))
+	assert.Equal(t, fakeawsapi.AccessKeyID, creds.AccessKeyId)
+}
+
+func TestConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name       string
+		configName string
+		config     string
+		env        map[string]string
+		wantErr    string
+	}{
+		{
+			name:    "unknown setting",
+			config:  "role_arn: foo\nrole_ran: bar\n",
+			wantErr: "line 2: role_ran: unknown setting",
+		},
+		{
+			name:    "unknown setting in command section",
+			config:  "x509_credential_process:\n  listen_addr: foo\n",
+			wantErr: "line 2: x509_credential_process.listen_addr: unknown setting",
+		},
+		{
+			name:    "invalid value",
+			config:  "session_duration: an hour\n",
+			wantErr: `line 1: session_duration: invalid argument "an hour" for "--session-duration" flag`,
+		},
+		{
+			name:    "list for single value",
+			config:  "role_arn: [foo, bar]\n",
+			wantErr: "line 1: role_arn: expected a single value, not a list",
+		},
+		{
+			name:       "TOML unknown setting",
+			configName: "config.toml",
+			config:     "[x509_credential_process]\nlisten_addr = \"foo\"\n",
+			wantErr:    "x509_credential_process.listen_addr: unknown setting",
+		},
+		{
+			name:       "TOML invalid syntax",
+			configName: "config.toml",
+			config:     "role_arn = \n",
+			wantErr:    "parsing: toml:",
+		},
+		{
+			name:    "invalid environment variable",
+			env:     map[string]string{"AWS_SPIFFE_SESSION_DURATION": "an hour"},
+			wantErr: `environment variable AWS_SPIFFE_SESSION_DURATION: invalid argument "an hour" for "--session-duration" flag`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{"x509-credential-process"}
+			if tt.config != "" {
+				name := tt.configName
+				if name == "" {
+					name = "config.yaml"
+				}
+				path := writeConfigFileNamed(t, name, tt.config)
+				args = append(args, "--config", path)
+				tt.wantErr = "config file " + path + ": " + tt.wantErr
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			rootCmd, err := cli.NewRootCmd("test")
+			require.NoError(t, err)
+			rootCmd.SetArgs(args)
+			rootCmd.SilenceUsage = true
+			require.ErrorContains(t, rootCmd.Execute(), tt.wantErr)
+		})
+	}
+}
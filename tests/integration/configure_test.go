@@ -0,0 +1,162 @@
+package integration_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spiffe/aws-spiffe-workload-helper/cmd/cli"
+	"github.com/spiffe/aws-spiffe-workload-helper/tests/integration/internal/fakeawsapi"
+	"github.com/spiffe/aws-spiffe-workload-helper/tests/integration/internal/fakespiffeapi"
+	"github.com/spiffe/aws-spiffe-workload-helper/vendoredaws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ini.v1"
+)
+
+const testSessionPolicy = `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"arn:aws:s3:::bucket/*"}]}`
+
+// splitCredentialProcess splits a credential_process line into arguments,
+// honouring double quotes, in the same way as the AWS SDKs.
+func splitCredentialProcess(line string) []string {
+	var args []string
+	var current strings.Builder
+	inQuotes, inArg := false, false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case r == ' ' && !inQuotes:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+func TestConfigure(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		JWTResponse: ca.CreateJWTSVIDResponse(t, audience),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		AssumeRole: &fakeawsapi.AssumeRoleExpectations{
+			RoleARN:         testChainedRoleARN,
+			RoleSessionName: "my session",
+			SourceIdentity:  "my-source-identity",
+		},
+	})
+
+	configPath := filepath.Join(t.TempDir(), "config")
+	assumeRole := fmt.Sprintf("role-arn=%s,session-name=my session,source-identity=my-source-identity,endpoint=%s", testChainedRoleARN, awsSrv.URL)
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	rootCmd.SetArgs([]string{
+		"configure", "jwt",
+		"--aws-config-path", configPath,
+		"--aws-profile", "my-profile",
+		"--aws-region", "eu-west-1",
+		"--executable", "/usr/local/bin/aws-spiffe-workload-helper",
+		"--workload-api-addr", spiffeAddr,
+		"--audience", audience,
+		"--endpoint", awsSrv.URL,
+		"--assume-role", assumeRole,
+	})
+	require.NoError(t, rootCmd.Execute())
+
+	f, err := ini.Load(configPath)
+	require.NoError(t, err)
+	sec := f.Section("profile my-profile")
+	assert.Equal(t, "eu-west-1", sec.Key("region").String())
+	credentialProcess := sec.Key("credential_process").String()
+	assert.Equal(t, fmt.Sprintf(
+		`/usr/local/bin/aws-spiffe-workload-helper jwt-credential-process --assume-role "%s" --audience %s --endpoint %s --workload-api-addr %s`,
+		assumeRole, audience, awsSrv.URL, spiffeAddr,
+	), credentialProcess)
+
+	// The generated line should obtain credentials when invoked.
+	args := splitCredentialProcess(credentialProcess)
+	require.Equal(t, "/usr/local/bin/aws-spiffe-workload-helper", args[0])
+	rootCmd, err = cli.NewRootCmd("test")
+	require.NoError(t, err)
+	var stdout bytes.Buffer
+	rootCmd.SetOut(&stdout)
+	rootCmd.SetArgs(args[1:])
+	require.NoError(t, rootCmd.Execute())
+
+	var creds vendoredaws.CredentialProcessOutput
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &creds))
+	assert.Equal(t, fakeawsapi.ChainedAccessKeyID, creds.AccessKeyId)
+}
+
+func TestConfigure_InvalidArgument(t *testing.T) {
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	rootCmd.SetArgs([]string{
+		"configure", "jwt",
+		"--aws-config-path", filepath.Join(t.TempDir(), "config"),
+		"--audience", "sts.amazonaws.com",
+		"--endpoint", "https://sts.amazonaws.com",
+		"--role-session-name", `my "session"`,
+	})
+	rootCmd.SilenceUsage = true
+	require.ErrorContains(t, rootCmd.Execute(), "cannot be used in credential_process")
+}
+
+func TestConfigure_OnlyCommandLineFlags(t *testing.T) {
+	t.Setenv("AWS_SPIFFE_ROLE_SESSION_NAME", "from-env")
+	configFile := writeConfigFile(t, "workload_api_addr: unix:///from/config.sock\n")
+	policyPath := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(policyPath, []byte(testSessionPolicy), 0o600))
+	configPath := filepath.Join(t.TempDir(), "config")
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	rootCmd.SetArgs([]string{
+		"configure", "jwt",
+		"--config", configFile,
+		"--aws-config-path", configPath,
+		"--executable", "/usr/local/bin/aws-spiffe-workload-helper",
+		"--audience", "sts.amazonaws.com",
+		"--endpoint", "https://sts.amazonaws.com",
+		"--policy", policyPath,
+	})
+	require.NoError(t, rootCmd.Execute())
+
+	f, err := ini.Load(configPath)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf(
+		`/usr/local/bin/aws-spiffe-workload-helper jwt-credential-process --audience sts.amazonaws.com --endpoint https://sts.amazonaws.com --policy %s`,
+		policyPath,
+	), f.Section("default").Key("credential_process").String())
+}
+
+func TestConfigure_InlinePolicy(t *testing.T) {
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	rootCmd.SetArgs([]string{
+		"configure", "jwt",
+		"--aws-config-path", filepath.Join(t.TempDir(), "config"),
+		"--audience", "sts.amazonaws.com",
+		"--endpoint", "https://sts.amazonaws.com",
+		"--policy", testSessionPolicy,
+	})
+	rootCmd.SilenceUsage = true
+	require.ErrorContains(t, rootCmd.Execute(), "--policy: an inline session policy cannot be used in credential_process")
+}
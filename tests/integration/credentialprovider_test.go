@@ -0,0 +1,295 @@
+package integration_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/spiffe/aws-spiffe-workload-helper/credentialprovider"
+	"github.com/spiffe/aws-spiffe-workload-helper/credentialprovider/awsv1"
+	"github.com/spiffe/aws-spiffe-workload-helper/tests/integration/internal/fakeawsapi"
+	"github.com/spiffe/aws-spiffe-workload-helper/tests/integration/internal/fakespiffeapi"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rotatingX509Source is an x509svid.Source whose SVID can be replaced, to
+// simulate rotation by the Workload API.
+type rotatingX509Source struct {
+	mu   sync.Mutex
+	svid *x509svid.SVID
+}
+
+func (s *rotatingX509Source) GetX509SVID() (*x509svid.SVID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.svid, nil
+}
+
+func (s *rotatingX509Source) set(svid *x509svid.SVID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.svid = svid
+}
+
+func newTestX509SVID(t *testing.T, ca *fakespiffeapi.CA) *x509svid.SVID {
+	t.Helper()
+	resp := ca.CreateX509SVIDResponse(t)
+	svid, err := x509svid.ParseRaw(resp.Svids[0].X509Svid, resp.Svids[0].X509SvidKey)
+	require.NoError(t, err)
+	return svid
+}
+
+func TestX509Provider(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		CACert: ca.CACert,
+		RolesAnywhere: &fakeawsapi.RolesAnywhereExpectations{
+			RoleARN:        testRoleARN,
+			ProfileARN:     testProfileARN,
+			TrustAnchorARN: testTrustAnchorARN,
+		},
+	})
+	source := &rotatingX509Source{svid: newTestX509SVID(t, ca)}
+
+	provider := credentialprovider.NewX509Provider(source, credentialprovider.X509Config{
+		RoleARN:        testRoleARN,
+		ProfileARN:     testProfileARN,
+		TrustAnchorARN: testTrustAnchorARN,
+		Region:         "us-east-1",
+		Endpoint:       awsSrv.URL,
+	})
+
+	creds, err := provider.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, fakeawsapi.AccessKeyID, creds.AccessKeyID)
+	assert.Equal(t, fakeawsapi.SecretAccessKey, creds.SecretAccessKey)
+	assert.Equal(t, fakeawsapi.SessionToken, creds.SessionToken)
+	assert.True(t, creds.CanExpire)
+	assert.False(t, creds.Expired())
+
+	// The SDK v1 adapter shares the cached credentials, and reports them as
+	// expired once the SVID rotates.
+	v1 := awsv1.New(provider)
+	assert.False(t, v1.IsExpired())
+	assert.Equal(t, creds.Expires, v1.ExpiresAt())
+	source.set(newTestX509SVID(t, ca))
+	assert.True(t, v1.IsExpired())
+
+	value, err := credentials.NewCredentials(v1).Get()
+	require.NoError(t, err)
+	assert.Equal(t, fakeawsapi.AccessKeyID, value.AccessKeyID)
+	assert.Equal(t, "SPIFFEX509Provider", value.ProviderName)
+	assert.False(t, v1.IsExpired())
+}
+
+func TestX509Provider_APIError(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		CACert: ca.CACert,
+		RolesAnywhereErrors: []fakeawsapi.RolesAnywhereError{
+			{StatusCode: http.StatusForbidden, Code: "AccessDeniedException", Message: "Untrusted signing certificate."},
+		},
+	})
+	source := &rotatingX509Source{svid: newTestX509SVID(t, ca)}
+
+	provider := credentialprovider.NewX509Provider(source, credentialprovider.X509Config{
+		RoleARN:        testRoleARN,
+		ProfileARN:     testProfileARN,
+		TrustAnchorARN: testTrustAnchorARN,
+		Endpoint:       awsSrv.URL,
+	})
+
+	// Errors returned by Roles Anywhere are parsed into an APIError, which
+	// can also be handled as an awserr.RequestFailure.
+	_, err := provider.Retrieve(context.Background())
+	var apiErr *credentialprovider.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusForbidden, apiErr.StatusCode())
+	assert.Equal(t, "AccessDeniedException", apiErr.Code())
+	assert.Equal(t, "Untrusted signing certificate.", apiErr.Message())
+	assert.Equal(t, "fake-request-id", apiErr.RequestID())
+	var reqErr awserr.RequestFailure
+	require.ErrorAs(t, err, &reqErr)
+
+	creds, err := provider.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, fakeawsapi.AccessKeyID, creds.AccessKeyID)
+}
+
+func TestExchangeX509SVID_Timeout(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	// The endpoint does not respond until the test has finished.
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	start := time.Now()
+	_, err := credentialprovider.ExchangeX509SVID(context.Background(), newTestX509SVID(t, ca), credentialprovider.X509Config{
+		RoleARN:        testRoleARN,
+		ProfileARN:     testProfileARN,
+		TrustAnchorARN: testTrustAnchorARN,
+		Endpoint:       srv.URL,
+		Timeout:        100 * time.Millisecond,
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestJWTProvider(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		JWTResponse: ca.CreateJWTSVIDResponse(t, audience),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source, err := workloadapi.New(ctx, workloadapi.WithAddr(spiffeAddr))
+	require.NoError(t, err)
+	defer source.Close()
+
+	provider := credentialprovider.NewJWTProvider(source, credentialprovider.JWTConfig{
+		RoleARN:  testRoleARN,
+		Audience: audience,
+		Endpoint: awsSrv.URL,
+	})
+
+	creds, err := provider.Retrieve(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, fakeawsapi.AccessKeyID, creds.AccessKeyID)
+	assert.Equal(t, fakeawsapi.SecretAccessKey, creds.SecretAccessKey)
+	assert.Equal(t, fakeawsapi.SessionToken, creds.SessionToken)
+	assert.Equal(t, "SPIFFEJWTProvider", creds.Source)
+
+	// Cached credentials are returned even once the context is cancelled,
+	// but renewing them fails.
+	cancelled, cancelRetrieve := context.WithCancel(ctx)
+	cancelRetrieve()
+	cached, err := provider.Retrieve(cancelled)
+	require.NoError(t, err)
+	assert.Equal(t, creds, cached)
+	provider.Invalidate()
+	_, err = provider.Retrieve(cancelled)
+	require.ErrorContains(t, err, "context canceled")
+}
+
+// blockingJWTSource is a jwtsvid.Source which blocks each fetch until it is
+// released, to simulate a slow exchange.
+type blockingJWTSource struct {
+	jwtsvid.Source
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingJWTSource) FetchJWTSVID(ctx context.Context, params jwtsvid.Params) (*jwtsvid.SVID, error) {
+	s.started <- struct{}{}
+	<-s.release
+	return s.Source.FetchJWTSVID(ctx, params)
+}
+
+func TestJWTProvider_CancelWhileWaiting(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		JWTResponse: ca.CreateJWTSVIDResponse(t, audience),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := workloadapi.New(ctx, workloadapi.WithAddr(spiffeAddr))
+	require.NoError(t, err)
+	defer client.Close()
+	source := &blockingJWTSource{
+		Source:  client,
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+
+	provider := credentialprovider.NewJWTProvider(source, credentialprovider.JWTConfig{
+		RoleARN:  testRoleARN,
+		Audience: audience,
+		Endpoint: awsSrv.URL,
+	})
+
+	type result struct {
+		creds aws.Credentials
+		err   error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		creds, err := provider.Retrieve(ctx)
+		slow <- result{creds, err}
+	}()
+	<-source.started
+
+	// A caller waiting for the slow exchange gives up once its context is
+	// cancelled, rather than blocking until the exchange completes.
+	waitCtx, cancelWait := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelWait()
+	_, err = provider.Retrieve(waitCtx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(source.release)
+	res := <-slow
+	require.NoError(t, res.err)
+	assert.Equal(t, fakeawsapi.AccessKeyID, res.creds.AccessKeyID)
+
+	// The credentials obtained by the slow exchange are shared.
+	creds, err := provider.Retrieve(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, res.creds, creds)
+}
+
+func TestJWTProvider_APIError(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		JWTResponse: ca.CreateJWTSVIDResponse(t, audience),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		STSErrors: []fakeawsapi.STSError{
+			{StatusCode: http.StatusBadRequest, Code: "InvalidIdentityToken", Message: "No OpenIDConnect provider found in your account"},
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source, err := workloadapi.New(ctx, workloadapi.WithAddr(spiffeAddr))
+	require.NoError(t, err)
+	defer source.Close()
+
+	provider := credentialprovider.NewJWTProvider(source, credentialprovider.JWTConfig{
+		RoleARN:  testRoleARN,
+		Audience: audience,
+		Endpoint: awsSrv.URL,
+	})
+
+	// Errors returned by STS are parsed into an APIError. An invalid token
+	// is not transient, so it is returned without being retried.
+	_, err = provider.Retrieve(ctx)
+	var apiErr *credentialprovider.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, credentialprovider.ErrCodeInvalidIdentityToken, apiErr.Code())
+	assert.Equal(t, "No OpenIDConnect provider found in your account", apiErr.Message())
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode())
+	assert.Equal(t, "fake-request-id", apiErr.RequestID())
+
+	creds, err := provider.Retrieve(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, fakeawsapi.AccessKeyID, creds.AccessKeyID)
+}
@@ -0,0 +1,128 @@
+package integration_test
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/spiffe/aws-spiffe-workload-helper/cmd/cli"
+	"github.com/spiffe/aws-spiffe-workload-helper/tests/integration/internal/fakeawsapi"
+	"github.com/spiffe/aws-spiffe-workload-helper/tests/integration/internal/fakespiffeapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnv(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		JWTResponse: ca.CreateJWTSVIDResponse(t, audience),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{})
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: "bash",
+			want:   "export AWS_ACCESS_KEY_ID='%s'\nexport AWS_SECRET_ACCESS_KEY='%s'\nexport AWS_SESSION_TOKEN='%s'\n",
+		},
+		{
+			format: "fish",
+			want:   "set -gx AWS_ACCESS_KEY_ID '%s';\nset -gx AWS_SECRET_ACCESS_KEY '%s';\nset -gx AWS_SESSION_TOKEN '%s';\n",
+		},
+		{
+			format: "powershell",
+			want:   "$Env:AWS_ACCESS_KEY_ID = '%s'\n$Env:AWS_SECRET_ACCESS_KEY = '%s'\n$Env:AWS_SESSION_TOKEN = '%s'\n",
+		},
+		{
+			format: "dotenv",
+			want:   "AWS_ACCESS_KEY_ID=\"%s\"\nAWS_SECRET_ACCESS_KEY=\"%s\"\nAWS_SESSION_TOKEN=\"%s\"\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			rootCmd, err := cli.NewRootCmd("test")
+			require.NoError(t, err)
+
+			var stdout bytes.Buffer
+			rootCmd.SetOut(&stdout)
+			rootCmd.SetArgs([]string{
+				"env",
+				"--format", tt.format,
+				"--aws-region", "eu-west-1",
+				"jwt",
+				"--workload-api-addr", spiffeAddr,
+				"--audience", audience,
+				"--endpoint", awsSrv.URL,
+			})
+			require.NoError(t, rootCmd.Execute())
+
+			want := fmt.Sprintf(tt.want, fakeawsapi.AccessKeyID, fakeawsapi.SecretAccessKey, fakeawsapi.SessionToken)
+			assert.True(t, bytes.HasPrefix(stdout.Bytes(), []byte(want)), "got %q, want prefix %q", stdout.String(), want)
+			assert.Contains(t, stdout.String(), "AWS_CREDENTIAL_EXPIRATION")
+			assert.Contains(t, stdout.String(), "AWS_REGION")
+			assert.Contains(t, stdout.String(), "eu-west-1")
+		})
+	}
+}
+
+func TestExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses sh")
+	}
+	ca := fakespiffeapi.NewCA(t)
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		X509Response: ca.CreateX509SVIDResponse(t),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		CACert: ca.CACert,
+	})
+	t.Setenv("AWS_ACCESS_KEY_ID", "stale")
+
+	run := func(t *testing.T, script string) (string, error) {
+		rootCmd, err := cli.NewRootCmd("test")
+		require.NoError(t, err)
+		var stdout bytes.Buffer
+		rootCmd.SetOut(&stdout)
+		rootCmd.SetArgs([]string{
+			"exec",
+			"--aws-region", "eu-west-1",
+			"x509",
+			"--workload-api-addr", spiffeAddr,
+			"--role-arn", testRoleARN,
+			"--profile-arn", testProfileARN,
+			"--trust-anchor-arn", testTrustAnchorARN,
+			"--endpoint", awsSrv.URL,
+			"--",
+			"sh", "-c", script,
+		})
+		err = rootCmd.Execute()
+		return stdout.String(), err
+	}
+
+	t.Run("environment", func(t *testing.T) {
+		out, err := run(t, `echo "$AWS_ACCESS_KEY_ID $AWS_SESSION_TOKEN $AWS_REGION"`)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("%s %s eu-west-1\n", fakeawsapi.AccessKeyID, fakeawsapi.SessionToken), out)
+	})
+
+	t.Run("exit code", func(t *testing.T) {
+		_, err := run(t, "exit 3")
+		var exitErr *cli.ExitError
+		require.ErrorAs(t, err, &exitErr)
+		assert.Equal(t, 3, exitErr.Code)
+	})
+
+	t.Run("signal forwarding", func(t *testing.T) {
+		// The child sends SIGTERM to its parent, the test process, which
+		// should forward it back to the child rather than exiting.
+		out, err := run(t, `trap 'echo terminated; exit 7' TERM; kill -TERM $PPID; while :; do sleep 0.1; done`)
+		var exitErr *cli.ExitError
+		require.ErrorAs(t, err, &exitErr)
+		assert.Equal(t, 7, exitErr.Code)
+		assert.Equal(t, "terminated\n", out)
+	})
+}
@@ -1,11 +1,19 @@
 package integration_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,6 +21,7 @@ import (
 	"github.com/spiffe/aws-spiffe-workload-helper/tests/integration/internal/fakeawsapi"
 	"github.com/spiffe/aws-spiffe-workload-helper/tests/integration/internal/fakespiffeapi"
 	"github.com/spiffe/aws-spiffe-workload-helper/vendoredaws"
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/ini.v1"
@@ -22,6 +31,7 @@ const (
 	testRoleARN        = "arn:aws:iam::123456789012:role/test-role"
 	testProfileARN     = "arn:aws:rolesanywhere:us-east-1:123456789012:profile/test-profile"
 	testTrustAnchorARN = "arn:aws:rolesanywhere:us-east-1:123456789012:trust-anchor/test-anchor"
+	testChainedRoleARN = "arn:aws:iam::210987654321:role/chained-role"
 )
 
 func TestX509CredentialProcess(t *testing.T) {
@@ -63,6 +73,250 @@ func TestX509CredentialProcess(t *testing.T) {
 	assert.NotEmpty(t, creds.Expiration)
 }
 
+func TestX509CredentialProcess_RoleSessionNameTemplate(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		X509Response: &workload.X509SVIDResponse{
+			Svids: []*workload.X509SVID{
+				ca.CreateX509SVID(t, "spiffe://example.org/ns/default/sa/app", "db"),
+			},
+		},
+	})
+	t.Setenv("POD_NAME", "app-7d9f8-x2x4z")
+	t.Setenv("APP_ENV", "prod")
+
+	tests := []struct {
+		name            string
+		roleSessionName string
+		want            string
+		wantErr         string
+	}{
+		{
+			name:            "static",
+			roleSessionName: "my-session",
+			want:            "my-session",
+		},
+		{
+			name:            "template",
+			roleSessionName: `{{.TrustDomain}}@{{.Path}}.{{.Hint}}.{{.PodName}}.{{env "APP_ENV"}}`,
+			want:            "example.org@ns-default-sa-app.db.app-7d9f8-x2x4z.prod",
+		},
+		{
+			name:            "truncated",
+			roleSessionName: "{{.SPIFFEID}}/{{.SPIFFEID}}",
+			want:            "spiffe---example.org-ns-default-sa-app-spiffe---example.org-ns-d",
+		},
+		{
+			name:            "unknown field",
+			roleSessionName: "{{.Namespace}}",
+			wantErr:         "rendering role session name template",
+		},
+		{
+			name:            "invalid template",
+			roleSessionName: "{{.Path",
+			wantErr:         "parsing role session name template",
+		},
+		{
+			name:            "too short",
+			roleSessionName: `{{env "UNSET_VARIABLE"}}`,
+			wantErr:         "which is shorter than 2 characters",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+				CACert: ca.CACert,
+				RolesAnywhere: &fakeawsapi.RolesAnywhereExpectations{
+					RoleARN:         testRoleARN,
+					ProfileARN:      testProfileARN,
+					TrustAnchorARN:  testTrustAnchorARN,
+					RoleSessionName: tt.want,
+				},
+			})
+
+			rootCmd, err := cli.NewRootCmd("test")
+			require.NoError(t, err)
+			rootCmd.SetOut(io.Discard)
+			rootCmd.SetArgs([]string{
+				"x509-credential-process",
+				"--workload-api-addr", spiffeAddr,
+				"--role-arn", testRoleARN,
+				"--profile-arn", testProfileARN,
+				"--trust-anchor-arn", testTrustAnchorARN,
+				"--region", "us-east-1",
+				"--endpoint", awsSrv.URL,
+				"--role-session-name", tt.roleSessionName,
+			})
+			err = rootCmd.Execute()
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestX509CredentialProcess_RoleSessionNameTemplateInvalid(t *testing.T) {
+	// The template is parsed before the Workload API, which is unavailable
+	// here, is contacted.
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	rootCmd.SetOut(io.Discard)
+	rootCmd.SilenceUsage = true
+	rootCmd.SetArgs([]string{
+		"x509-credential-process",
+		"--workload-api-addr", "unix://" + filepath.Join(t.TempDir(), "missing.sock"),
+		"--role-arn", testRoleARN,
+		"--profile-arn", testProfileARN,
+		"--trust-anchor-arn", testTrustAnchorARN,
+		"--role-session-name", "{{.Path",
+	})
+	require.ErrorContains(t, rootCmd.Execute(), `invalid argument "{{.Path" for "--role-session-name" flag: parsing role session name template`)
+}
+
+func TestX509CredentialProcess_Cache(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		X509Response: ca.CreateX509SVIDResponse(t),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		CACert: ca.CACert,
+		RolesAnywhere: &fakeawsapi.RolesAnywhereExpectations{
+			RoleARN:        testRoleARN,
+			ProfileARN:     testProfileARN,
+			TrustAnchorARN: testTrustAnchorARN,
+		},
+	})
+	cacheDir := t.TempDir()
+	args := []string{
+		"x509-credential-process",
+		"--workload-api-addr", spiffeAddr,
+		"--role-arn", testRoleARN,
+		"--profile-arn", testProfileARN,
+		"--trust-anchor-arn", testTrustAnchorARN,
+		"--region", "us-east-1",
+		"--endpoint", awsSrv.URL,
+		"--cache-dir", cacheDir,
+	}
+	run := func() vendoredaws.CredentialProcessOutput {
+		rootCmd, err := cli.NewRootCmd("test")
+		require.NoError(t, err)
+		var stdout bytes.Buffer
+		rootCmd.SetOut(&stdout)
+		rootCmd.SetArgs(args)
+		require.NoError(t, rootCmd.Execute())
+		var creds vendoredaws.CredentialProcessOutput
+		require.NoError(t, json.Unmarshal(stdout.Bytes(), &creds))
+		return creds
+	}
+
+	first := run()
+	assert.Equal(t, fakeawsapi.AccessKeyID, first.AccessKeyId)
+
+	// With the AWS API unavailable, the second invocation can only succeed
+	// by returning the cached credentials.
+	awsSrv.Close()
+	second := run()
+	assert.Equal(t, first, second)
+}
+
+func TestX509CredentialProcess_CacheMinTTLExceedsSessionDuration(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		X509Response: ca.CreateX509SVIDResponse(t),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		CACert: ca.CACert,
+		RolesAnywhere: &fakeawsapi.RolesAnywhereExpectations{
+			RoleARN:        testRoleARN,
+			ProfileARN:     testProfileARN,
+			TrustAnchorARN: testTrustAnchorARN,
+		},
+	})
+	// The minimum TTL exceeds the session duration, so it is reduced to half
+	// of the session duration, rather than preventing any cache hits.
+	args := []string{
+		"x509-credential-process",
+		"--workload-api-addr", spiffeAddr,
+		"--role-arn", testRoleARN,
+		"--profile-arn", testProfileARN,
+		"--trust-anchor-arn", testTrustAnchorARN,
+		"--region", "us-east-1",
+		"--endpoint", awsSrv.URL,
+		"--session-duration", "900",
+		"--cache-dir", t.TempDir(),
+		"--cache-min-ttl", "2h",
+	}
+	run := func() vendoredaws.CredentialProcessOutput {
+		rootCmd, err := cli.NewRootCmd("test")
+		require.NoError(t, err)
+		var stdout bytes.Buffer
+		rootCmd.SetOut(&stdout)
+		rootCmd.SetArgs(args)
+		require.NoError(t, rootCmd.Execute())
+		var creds vendoredaws.CredentialProcessOutput
+		require.NoError(t, json.Unmarshal(stdout.Bytes(), &creds))
+		return creds
+	}
+
+	first := run()
+	awsSrv.Close()
+	second := run()
+	assert.Equal(t, first, second)
+}
+
+func TestX509CredentialProcess_AssumeRole(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		X509Response: ca.CreateX509SVIDResponse(t),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		CACert: ca.CACert,
+		RolesAnywhere: &fakeawsapi.RolesAnywhereExpectations{
+			RoleARN:        testRoleARN,
+			ProfileARN:     testProfileARN,
+			TrustAnchorARN: testTrustAnchorARN,
+		},
+		AssumeRole: &fakeawsapi.AssumeRoleExpectations{
+			RoleARN:         testChainedRoleARN,
+			ExternalID:      "my-external-id",
+			RoleSessionName: "example.org-workload",
+			SourceIdentity:  "example.org-workload",
+			Tags:            map[string]string{"team": "payments", "cost-centres": "a,b"},
+			Region:          "eu-west-1",
+		},
+	})
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+
+	var stdout bytes.Buffer
+	rootCmd.SetOut(&stdout)
+	rootCmd.SetArgs([]string{
+		"x509-credential-process",
+		"--workload-api-addr", spiffeAddr,
+		"--role-arn", testRoleARN,
+		"--profile-arn", testProfileARN,
+		"--trust-anchor-arn", testTrustAnchorARN,
+		"--region", "us-east-1",
+		"--endpoint", awsSrv.URL,
+		"--assume-role", fmt.Sprintf(
+			// Pairs containing a comma are quoted.
+			`role-arn=%s,external-id=my-external-id,tag=team=payments,"tag=cost-centres=a,b",region=eu-west-1,endpoint=%s`,
+			testChainedRoleARN, awsSrv.URL,
+		),
+	})
+	require.NoError(t, rootCmd.Execute())
+
+	var creds vendoredaws.CredentialProcessOutput
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &creds))
+	assert.Equal(t, fakeawsapi.ChainedAccessKeyID, creds.AccessKeyId)
+	assert.Equal(t, fakeawsapi.ChainedSecretAccessKey, creds.SecretAccessKey)
+	assert.Equal(t, fakeawsapi.ChainedSessionToken, creds.SessionToken)
+	assert.NotEmpty(t, creds.Expiration)
+}
+
 func TestX509CredentialFileOneshot(t *testing.T) {
 	ca := fakespiffeapi.NewCA(t)
 	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
@@ -90,6 +344,8 @@ func TestX509CredentialFileOneshot(t *testing.T) {
 		"--region", "us-east-1",
 		"--endpoint", awsSrv.URL,
 		"--aws-credentials-path", credFile,
+		"--aws-credentials-mode", "0640",
+		"--aws-credentials-metadata",
 		"--replace",
 	})
 	require.NoError(t, rootCmd.Execute())
@@ -100,6 +356,114 @@ func TestX509CredentialFileOneshot(t *testing.T) {
 	assert.Equal(t, fakeawsapi.AccessKeyID, sec.Key("aws_access_key_id").String())
 	assert.Equal(t, fakeawsapi.SecretAccessKey, sec.Key("aws_secret_access_key").String())
 	assert.Equal(t, fakeawsapi.SessionToken, sec.Key("aws_session_token").String())
+	assert.Equal(t, "123456789012", sec.Key("aws_account_id").String())
+	assert.Equal(t, "spiffe://example.org/workload", sec.Key("x_spiffe_id").String())
+	assert.Equal(t, testRoleARN, sec.Key("x_role_arn").String())
+	assert.Equal(t, "aws-spiffe-workload-helper", sec.Key("x_managed_by").String())
+	expiresAt, err := time.Parse(time.RFC3339, sec.Key("x_security_token_expires").String())
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute)
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(credFile)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+	}
+}
+
+func TestX509CredentialFileOneshot_SelectSVID(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		X509Response: &workload.X509SVIDResponse{
+			Svids: []*workload.X509SVID{
+				ca.CreateX509SVID(t, "spiffe://example.org/workload", "internal"),
+				ca.CreateX509SVID(t, "spiffe://example.org/db/primary", "external"),
+				ca.CreateX509SVID(t, "spiffe://example.org/db/replica", "replica"),
+			},
+		},
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		CACert: ca.CACert,
+		RolesAnywhere: &fakeawsapi.RolesAnywhereExpectations{
+			RoleARN:        testRoleARN,
+			ProfileARN:     testProfileARN,
+			TrustAnchorARN: testTrustAnchorARN,
+		},
+	})
+
+	tests := []struct {
+		name         string
+		args         []string
+		wantSPIFFEID string
+		wantErr      string
+	}{
+		{
+			name:         "default",
+			wantSPIFFEID: "spiffe://example.org/workload",
+		},
+		{
+			name:         "hint",
+			args:         []string{"--hint", "replica"},
+			wantSPIFFEID: "spiffe://example.org/db/replica",
+		},
+		{
+			name:         "spiffe id pattern",
+			args:         []string{"--spiffe-id", "spiffe://example.org/db/*"},
+			wantSPIFFEID: "spiffe://example.org/db/primary",
+		},
+		{
+			name:         "spiffe id",
+			args:         []string{"--spiffe-id", "spiffe://example.org/db/primary"},
+			wantSPIFFEID: "spiffe://example.org/db/primary",
+		},
+		{
+			name:         "spiffe id pattern and hint",
+			args:         []string{"--spiffe-id", "spiffe://example.org/db/*", "--hint", "replica"},
+			wantSPIFFEID: "spiffe://example.org/db/replica",
+		},
+		{
+			name: "no match",
+			args: []string{"--spiffe-id", "spiffe://example.org/web/*"},
+			wantErr: `no X509 SVID matches SPIFFE ID "spiffe://example.org/web/*", available SVIDs: [` +
+				`spiffe://example.org/workload (hint "internal"), ` +
+				`spiffe://example.org/db/primary (hint "external"), ` +
+				`spiffe://example.org/db/replica (hint "replica")]`,
+		},
+		{
+			name:    "invalid pattern",
+			args:    []string{"--spiffe-id", "spiffe://example.org/["},
+			wantErr: `invalid SPIFFE ID pattern "spiffe://example.org/["`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			credFile := filepath.Join(t.TempDir(), "aws-credentials")
+
+			rootCmd, err := cli.NewRootCmd("test")
+			require.NoError(t, err)
+			rootCmd.SetArgs(append([]string{
+				"x509-credential-file-oneshot",
+				"--workload-api-addr", spiffeAddr,
+				"--role-arn", testRoleARN,
+				"--profile-arn", testProfileARN,
+				"--trust-anchor-arn", testTrustAnchorARN,
+				"--region", "us-east-1",
+				"--endpoint", awsSrv.URL,
+				"--aws-credentials-path", credFile,
+				"--aws-credentials-metadata",
+				"--replace",
+			}, tt.args...))
+			err = rootCmd.Execute()
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			f, err := ini.Load(credFile)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantSPIFFEID, f.Section("default").Key("x_spiffe_id").String())
+		})
+	}
 }
 
 func TestX509CredentialFile(t *testing.T) {
@@ -123,6 +487,7 @@ func TestX509CredentialFile(t *testing.T) {
 
 	rootCmd, err := cli.NewRootCmd("test")
 	require.NoError(t, err)
+	healthAddr := freeAddr(t)
 	rootCmd.SetArgs([]string{
 		"x509-credential-file",
 		"--workload-api-addr", spiffeAddr,
@@ -133,6 +498,7 @@ func TestX509CredentialFile(t *testing.T) {
 		"--endpoint", awsSrv.URL,
 		"--aws-credentials-path", credFile,
 		"--replace",
+		"--health-addr", healthAddr,
 	})
 
 	errCh := make(chan error, 1)
@@ -153,11 +519,219 @@ func TestX509CredentialFile(t *testing.T) {
 	assert.Equal(t, fakeawsapi.SecretAccessKey, sec.Key("aws_secret_access_key").String())
 	assert.Equal(t, fakeawsapi.SessionToken, sec.Key("aws_session_token").String())
 
+	// The daemon should be ready once the credentials have been written.
+	httpClient := &http.Client{}
+	require.Eventually(t, func() bool {
+		resp, err := httpClient.Get("http://" + healthAddr + "/readyz")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 15*time.Second, 100*time.Millisecond, "daemon never became ready")
+	assert.Equal(t, http.StatusOK, getStatusCode(t, httpClient, "http://"+healthAddr+"/healthz"))
+	status := getHealthStatus(t, httpClient, healthAddr)
+	assert.Equal(t, true, status["ready"])
+	require.Len(t, status["profiles"], 1)
+	profile := status["profiles"].([]any)[0].(map[string]any)
+	assert.Equal(t, "spiffe://example.org/workload", profile["svid_id"])
+	assert.NotEmpty(t, profile["svid_expires_at"])
+	assert.NotEmpty(t, profile["aws_expires_at"])
+	assert.NotContains(t, profile, "last_error")
+	// Idle connections would otherwise delay the shutdown of the server.
+	httpClient.CloseIdleConnections()
+
 	// Stop the daemon.
 	cancel()
 	require.NoError(t, <-errCh)
 }
 
+func TestX509CredentialFile_RemoveOnExit(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		X509Response: ca.CreateX509SVIDResponse(t),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{CACert: ca.CACert})
+
+	credFile := filepath.Join(t.TempDir(), "aws-credentials")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	rootCmd.SetArgs([]string{
+		"x509-credential-file",
+		"--workload-api-addr", spiffeAddr,
+		"--role-arn", testRoleARN,
+		"--profile-arn", testProfileARN,
+		"--trust-anchor-arn", testTrustAnchorARN,
+		"--region", "us-east-1",
+		"--endpoint", awsSrv.URL,
+		"--aws-credentials-path", credFile,
+		"--replace",
+		"--remove-on-exit",
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- rootCmd.ExecuteContext(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(credFile)
+		return err == nil
+	}, 15*time.Second, 100*time.Millisecond, "credential file never appeared")
+
+	// As the file is written in replace mode, it is removed entirely.
+	cancel()
+	require.NoError(t, <-errCh)
+	_, err = os.Stat(credFile)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestX509CredentialFile_Revoked(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	revoked := make(chan struct{})
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		X509Response: ca.CreateX509SVIDResponse(t),
+		X509Revoked:  revoked,
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{CACert: ca.CACert})
+
+	// Other profiles in the file are left in place.
+	credFile := filepath.Join(t.TempDir(), "aws-credentials")
+	require.NoError(t, os.WriteFile(credFile, []byte("[other]\naws_access_key_id = other\n"), 0o600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	healthAddr := freeAddr(t)
+	rootCmd.SetArgs([]string{
+		"x509-credential-file",
+		"--workload-api-addr", spiffeAddr,
+		"--role-arn", testRoleARN,
+		"--profile-arn", testProfileARN,
+		"--trust-anchor-arn", testTrustAnchorARN,
+		"--region", "us-east-1",
+		"--endpoint", awsSrv.URL,
+		"--aws-credentials-path", credFile,
+		"--aws-profile", "workload",
+		"--retry-give-up", "never",
+		"--health-addr", healthAddr,
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- rootCmd.ExecuteContext(ctx)
+	}()
+
+	hasProfile := func() bool {
+		f, err := ini.Load(credFile)
+		require.NoError(t, err)
+		return f.Section("workload").HasKey("aws_access_key_id")
+	}
+	require.Eventually(t, hasProfile, 15*time.Second, 100*time.Millisecond, "credentials never written")
+
+	// Deleting the registration entry of the workload removes the
+	// credentials, without waiting for them to expire.
+	close(revoked)
+	require.Eventually(t, func() bool {
+		return !hasProfile()
+	}, 15*time.Second, 100*time.Millisecond, "credentials never removed")
+
+	f, err := ini.Load(credFile)
+	require.NoError(t, err)
+	assert.Equal(t, "other", f.Section("other").Key("aws_access_key_id").String())
+
+	// The daemon is no longer ready, but is still live as restarting it
+	// would not restore the identity.
+	httpClient := &http.Client{}
+	require.Eventually(t, func() bool {
+		return getStatusCode(t, httpClient, "http://"+healthAddr+"/readyz") == http.StatusServiceUnavailable
+	}, 15*time.Second, 100*time.Millisecond, "daemon never became unready")
+	status := getHealthStatus(t, httpClient, healthAddr)
+	require.Len(t, status["profiles"], 1)
+	profile := status["profiles"].([]any)[0].(map[string]any)
+	assert.Equal(t, "credentials were removed as the workload identity was revoked", profile["problem"])
+	assert.Equal(t, http.StatusOK, getStatusCode(t, httpClient, "http://"+healthAddr+"/healthz"))
+	httpClient.CloseIdleConnections()
+
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+func TestX509CredentialFile_FollowsSelectedSVID(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	updates := make(chan *workload.X509SVIDResponse)
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		X509Response: &workload.X509SVIDResponse{
+			Svids: []*workload.X509SVID{
+				ca.CreateX509SVID(t, "spiffe://example.org/db/primary", "primary"),
+				ca.CreateX509SVID(t, "spiffe://example.org/db/replica", "replica"),
+			},
+		},
+		X509Updates: updates,
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{CACert: ca.CACert})
+
+	credFile := filepath.Join(t.TempDir(), "aws-credentials")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	rootCmd.SetArgs([]string{
+		"x509-credential-file",
+		"--workload-api-addr", spiffeAddr,
+		"--role-arn", testRoleARN,
+		"--profile-arn", testProfileARN,
+		"--trust-anchor-arn", testTrustAnchorARN,
+		"--region", "us-east-1",
+		"--endpoint", awsSrv.URL,
+		"--aws-credentials-path", credFile,
+		"--aws-credentials-metadata",
+		"--spiffe-id", "spiffe://example.org/db/*",
+		"--replace",
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- rootCmd.ExecuteContext(ctx)
+	}()
+
+	spiffeID := func() string {
+		f, err := ini.Load(credFile)
+		if err != nil {
+			return ""
+		}
+		return f.Section("default").Key("x_spiffe_id").String()
+	}
+	require.Eventually(t, func() bool {
+		return spiffeID() == "spiffe://example.org/db/primary"
+	}, 15*time.Second, 100*time.Millisecond, "credentials never written")
+
+	// The Workload API may return rotated SVIDs in a different order. The
+	// SVID selected at startup continues to be used.
+	require.NoError(t, os.Remove(credFile))
+	updates <- &workload.X509SVIDResponse{
+		Svids: []*workload.X509SVID{
+			ca.CreateX509SVID(t, "spiffe://example.org/db/replica", "replica"),
+			ca.CreateX509SVID(t, "spiffe://example.org/db/primary", "primary"),
+		},
+	}
+	require.Eventually(t, func() bool {
+		return spiffeID() != ""
+	}, 15*time.Second, 100*time.Millisecond, "credentials never renewed")
+	assert.Equal(t, "spiffe://example.org/db/primary", spiffeID())
+
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
 func TestJWTCredentialProcess(t *testing.T) {
 	ca := fakespiffeapi.NewCA(t)
 	audience := "sts.amazonaws.com"
@@ -187,3 +761,1165 @@ func TestJWTCredentialProcess(t *testing.T) {
 	assert.Equal(t, fakeawsapi.SessionToken, creds.SessionToken)
 	assert.NotEmpty(t, creds.Expiration)
 }
+
+func TestJWTCredentialProcess_Cache(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	policy := `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"*"}]}`
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(policyFile, []byte(policy), 0o600))
+	cacheDir := t.TempDir()
+	run := func(spiffeAddr, endpoint string) (vendoredaws.CredentialProcessOutput, error) {
+		rootCmd, err := cli.NewRootCmd("test")
+		require.NoError(t, err)
+		var stdout bytes.Buffer
+		rootCmd.SetOut(&stdout)
+		rootCmd.SetArgs([]string{
+			"jwt-credential-process",
+			"--workload-api-addr", spiffeAddr,
+			"--audience", audience,
+			"--endpoint", endpoint,
+			"--role-arn", testRoleARN,
+			"--policy", policyFile,
+			"--cache-dir", cacheDir,
+		})
+		if err := rootCmd.Execute(); err != nil {
+			return vendoredaws.CredentialProcessOutput{}, err
+		}
+		var creds vendoredaws.CredentialProcessOutput
+		require.NoError(t, json.Unmarshal(stdout.Bytes(), &creds))
+		return creds, nil
+	}
+
+	// The Workload API and AWS API are stopped at the end of the subtest.
+	var spiffeAddr, endpoint string
+	var first vendoredaws.CredentialProcessOutput
+	t.Run("exchange", func(t *testing.T) {
+		spiffeAddr = fakespiffeapi.Start(t, fakespiffeapi.Config{
+			JWTResponse: ca.CreateJWTSVIDResponse(t, audience),
+		})
+		awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+			WebIdentity: &fakeawsapi.WebIdentityExpectations{
+				RoleARN: testRoleARN,
+				Policy:  policy,
+			},
+		})
+		endpoint = awsSrv.URL
+		var err error
+		first, err = run(spiffeAddr, endpoint)
+		require.NoError(t, err)
+		assert.Equal(t, fakeawsapi.AccessKeyID, first.AccessKeyId)
+	})
+
+	// With neither API available, the second invocation can only succeed by
+	// returning the cached credentials without fetching a JWT SVID.
+	second, err := run(spiffeAddr, endpoint)
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	// Changing the policy file changes the credentials requested, so the
+	// cached credentials are not reused.
+	require.NoError(t, os.WriteFile(policyFile, []byte(strings.ReplaceAll(policy, "s3:GetObject", "s3:PutObject")), 0o600))
+	_, err = run(spiffeAddr, endpoint)
+	require.ErrorContains(t, err, "fetching jwt")
+}
+
+func TestJWTCredentialProcess_TransientError(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		JWTResponse: ca.CreateJWTSVIDResponse(t, audience),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		STSErrors: []fakeawsapi.STSError{
+			{StatusCode: http.StatusBadRequest, Code: "IDPCommunicationError", Message: "Couldn't retrieve verification key from your identity provider"},
+			{StatusCode: http.StatusBadRequest, Code: "Throttling", Message: "Rate exceeded"},
+		},
+	})
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+
+	var stdout bytes.Buffer
+	rootCmd.SetOut(&stdout)
+	rootCmd.SetArgs([]string{
+		"jwt-credential-process",
+		"--workload-api-addr", spiffeAddr,
+		"--audience", audience,
+		"--endpoint", awsSrv.URL,
+	})
+	// The one-shot command has no retry loop of its own, so the transient
+	// errors must be retried by the STS client.
+	require.NoError(t, rootCmd.Execute())
+
+	var creds vendoredaws.CredentialProcessOutput
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &creds))
+	assert.Equal(t, fakeawsapi.AccessKeyID, creds.AccessKeyId)
+}
+
+func TestJWTCredentialProcess_ValidateJWT(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	untrustedCA := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{})
+
+	tests := []struct {
+		name     string
+		jwtCA    *fakespiffeapi.CA
+		bundles  *workload.JWTBundlesResponse
+		args     []string
+		wantErrs []string
+	}{
+		{
+			name:    "valid",
+			jwtCA:   ca,
+			bundles: ca.CreateJWTBundlesResponse(t),
+		},
+		{
+			name:     "untrusted signer",
+			jwtCA:    untrustedCA,
+			bundles:  ca.CreateJWTBundlesResponse(t),
+			wantErrs: []string{"validating JWT SVID", "unable to get claims from token"},
+		},
+		{
+			name:     "expires too soon",
+			jwtCA:    ca,
+			bundles:  ca.CreateJWTBundlesResponse(t),
+			args:     []string{"--jwt-min-lifetime", "2h"},
+			wantErrs: []string{"validating JWT SVID", "which is less than the minimum lifetime of 2h0m0s"},
+		},
+		{
+			name:     "no bundles",
+			jwtCA:    ca,
+			wantErrs: []string{"validating JWT SVID: fetching JWT bundles"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+				JWTResponse: tt.jwtCA.CreateJWTSVIDResponse(t, audience),
+				JWTBundles:  tt.bundles,
+			})
+
+			rootCmd, err := cli.NewRootCmd("test")
+			require.NoError(t, err)
+
+			var stdout bytes.Buffer
+			rootCmd.SetOut(&stdout)
+			rootCmd.SetArgs(append([]string{
+				"jwt-credential-process",
+				"--workload-api-addr", spiffeAddr,
+				"--audience", audience,
+				"--endpoint", awsSrv.URL,
+				"--validate-jwt",
+			}, tt.args...))
+			err = rootCmd.Execute()
+			if len(tt.wantErrs) > 0 {
+				for _, want := range tt.wantErrs {
+					require.ErrorContains(t, err, want)
+				}
+				return
+			}
+			require.NoError(t, err)
+
+			var creds vendoredaws.CredentialProcessOutput
+			require.NoError(t, json.Unmarshal(stdout.Bytes(), &creds))
+			assert.Equal(t, fakeawsapi.AccessKeyID, creds.AccessKeyId)
+		})
+	}
+}
+
+func TestJWTCredentialProcess_AssumeRole(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		JWTResponse: ca.CreateJWTSVIDResponse(t, audience),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		AssumeRole: &fakeawsapi.AssumeRoleExpectations{
+			RoleARN:         testChainedRoleARN,
+			RoleSessionName: "my-session",
+			SourceIdentity:  "my-source-identity",
+			// The region is derived from the partition of the role ARN.
+			Region: "us-east-1",
+		},
+	})
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+
+	var stdout bytes.Buffer
+	rootCmd.SetOut(&stdout)
+	rootCmd.SetArgs([]string{
+		"jwt-credential-process",
+		"--workload-api-addr", spiffeAddr,
+		"--audience", audience,
+		"--endpoint", awsSrv.URL,
+		"--assume-role", fmt.Sprintf(
+			"role-arn=%s,session-name=my-session,source-identity=my-source-identity,endpoint=%s",
+			testChainedRoleARN, awsSrv.URL,
+		),
+	})
+	require.NoError(t, rootCmd.Execute())
+
+	var creds vendoredaws.CredentialProcessOutput
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &creds))
+	assert.Equal(t, fakeawsapi.ChainedAccessKeyID, creds.AccessKeyId)
+	assert.Equal(t, fakeawsapi.ChainedSecretAccessKey, creds.SecretAccessKey)
+	assert.Equal(t, fakeawsapi.ChainedSessionToken, creds.SessionToken)
+}
+
+func TestJWTCredentialProcess_AssumeRoleUnknownPartition(t *testing.T) {
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	rootCmd.SetOut(io.Discard)
+	rootCmd.SetArgs([]string{
+		"jwt-credential-process",
+		"--workload-api-addr", "unix:///does/not/exist",
+		"--audience", "sts.amazonaws.com",
+		"--endpoint", "http://127.0.0.1:1",
+		"--assume-role", "role-arn=arn:aws-example:iam::210987654321:role/chained-role",
+	})
+	err = rootCmd.Execute()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `region is required for roles in partition "aws-example"`)
+}
+
+func TestJWTCredentialProcess_SessionPolicy(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		JWTResponse: ca.CreateJWTSVIDResponse(t, audience),
+	})
+	policy := `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"arn:aws:s3:::bucket/*"}]}`
+	policyARNs := []string{
+		"arn:aws:iam::aws:policy/ReadOnlyAccess",
+		"arn:aws:iam::123456789012:policy/example-policy",
+	}
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(policyFile, []byte(policy), 0o600))
+
+	tests := []struct {
+		name       string
+		policyFlag string
+	}{
+		{name: "inline", policyFlag: policy},
+		{name: "file", policyFlag: policyFile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+				WebIdentity: &fakeawsapi.WebIdentityExpectations{
+					RoleARN:    testRoleARN,
+					Policy:     policy,
+					PolicyARNs: policyARNs,
+					ProviderID: "www.amazon.com",
+				},
+			})
+
+			rootCmd, err := cli.NewRootCmd("test")
+			require.NoError(t, err)
+
+			var stdout bytes.Buffer
+			rootCmd.SetOut(&stdout)
+			rootCmd.SetArgs([]string{
+				"jwt-credential-process",
+				"--workload-api-addr", spiffeAddr,
+				"--audience", audience,
+				"--endpoint", awsSrv.URL,
+				"--role-arn", testRoleARN,
+				"--policy", tt.policyFlag,
+				"--policy-arn", policyARNs[0],
+				"--policy-arn", policyARNs[1],
+				"--provider-id", "www.amazon.com",
+			})
+			require.NoError(t, rootCmd.Execute())
+
+			var creds vendoredaws.CredentialProcessOutput
+			require.NoError(t, json.Unmarshal(stdout.Bytes(), &creds))
+			assert.Equal(t, fakeawsapi.AccessKeyID, creds.AccessKeyId)
+		})
+	}
+}
+
+func TestJWTCredentialProcess_RoleSessionNameTemplate(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		JWTResponse: &workload.JWTSVIDResponse{
+			Svids: []*workload.JWTSVID{
+				ca.CreateJWTSVID(t, "spiffe://example.org/ns/default/sa/app", "db", audience),
+			},
+		},
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		WebIdentity: &fakeawsapi.WebIdentityExpectations{
+			RoleARN:         testRoleARN,
+			RoleSessionName: "example.org-ns-default-sa-app",
+		},
+	})
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	rootCmd.SetOut(io.Discard)
+	rootCmd.SetArgs([]string{
+		"jwt-credential-process",
+		"--workload-api-addr", spiffeAddr,
+		"--audience", audience,
+		"--endpoint", awsSrv.URL,
+		"--role-arn", testRoleARN,
+		"--role-session-name", "{{.TrustDomain}}/{{.Path}}",
+	})
+	require.NoError(t, rootCmd.Execute())
+}
+
+func TestJWTCredentialProcess_SessionPolicyInvalid(t *testing.T) {
+	tooManyARNs := make([]string, 0, 22)
+	for i := range 11 {
+		tooManyARNs = append(tooManyARNs, "--policy-arn", fmt.Sprintf("arn:aws:iam::123456789012:policy/policy-%d", i))
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{
+			name:    "invalid JSON",
+			args:    []string{"--policy", `{"Version": "2012-10-17",`},
+			wantErr: `invalid argument "{\"Version\": \"2012-10-17\"," for "--policy" flag: session policy is not a JSON object: unexpected end of JSON input`,
+		},
+		{
+			name:    "too large",
+			args:    []string{"--policy", `{"Sid":"` + strings.Repeat("a", 2048) + `"}`},
+			wantErr: "session policy is 2058 characters, more than the maximum of 2048",
+		},
+		{
+			name:    "missing file",
+			args:    []string{"--policy", filepath.Join(t.TempDir(), "missing.json")},
+			wantErr: "reading session policy file",
+		},
+		{
+			name:    "not an ARN",
+			args:    []string{"--policy-arn", "ReadOnlyAccess"},
+			wantErr: `parsing session policy ARN "ReadOnlyAccess"`,
+		},
+		{
+			name:    "not an IAM policy",
+			args:    []string{"--policy-arn", "arn:aws:s3:::bucket"},
+			wantErr: `session policy ARN "arn:aws:s3:::bucket" is not an IAM policy`,
+		},
+		{
+			name:    "too many ARNs",
+			args:    tooManyARNs,
+			wantErr: "11 session policy ARNs given, more than the maximum of 10",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootCmd, err := cli.NewRootCmd("test")
+			require.NoError(t, err)
+			rootCmd.SetArgs(append([]string{
+				"jwt-credential-process",
+				"--audience", "sts.amazonaws.com",
+				"--endpoint", "http://127.0.0.1:1",
+			}, tt.args...))
+			require.ErrorContains(t, rootCmd.Execute(), tt.wantErr)
+		})
+	}
+}
+
+func TestJWTCredentialFileOneshot(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		JWTResponse: ca.CreateJWTSVIDResponse(t, audience),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{})
+
+	credFile := filepath.Join(t.TempDir(), "aws-credentials")
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	rootCmd.SetArgs([]string{
+		"jwt-credential-file-oneshot",
+		"--workload-api-addr", spiffeAddr,
+		"--audience", audience,
+		"--endpoint", awsSrv.URL,
+		"--aws-credentials-path", credFile,
+		"--replace",
+	})
+	require.NoError(t, rootCmd.Execute())
+
+	f, err := ini.Load(credFile)
+	require.NoError(t, err)
+	sec := f.Section("default")
+	assert.Equal(t, fakeawsapi.AccessKeyID, sec.Key("aws_access_key_id").String())
+	assert.Equal(t, fakeawsapi.SecretAccessKey, sec.Key("aws_secret_access_key").String())
+	assert.Equal(t, fakeawsapi.SessionToken, sec.Key("aws_session_token").String())
+}
+
+func TestJWTCredentialFileOneshot_SelectSVID(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		JWTResponse: &workload.JWTSVIDResponse{
+			Svids: []*workload.JWTSVID{
+				ca.CreateJWTSVID(t, "spiffe://example.org/workload", "internal", audience),
+				ca.CreateJWTSVID(t, "spiffe://example.org/db/primary", "primary", audience, "minio"),
+				ca.CreateJWTSVID(t, "spiffe://example.org/db/replica", "replica", audience, "minio"),
+			},
+		},
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{})
+
+	tests := []struct {
+		name         string
+		args         []string
+		wantSPIFFEID string
+		wantErr      string
+	}{
+		{
+			name:         "default",
+			wantSPIFFEID: "spiffe://example.org/workload",
+		},
+		{
+			name:         "hint",
+			args:         []string{"--hint", "replica"},
+			wantSPIFFEID: "spiffe://example.org/db/replica",
+		},
+		{
+			name:         "spiffe id",
+			args:         []string{"--spiffe-id", "spiffe://example.org/db/replica", "--extra-audience", "minio"},
+			wantSPIFFEID: "spiffe://example.org/db/replica",
+		},
+		{
+			name:         "spiffe id pattern",
+			args:         []string{"--spiffe-id", "spiffe://example.org/db/*"},
+			wantSPIFFEID: "spiffe://example.org/db/primary",
+		},
+		{
+			name:         "extra audience",
+			args:         []string{"--extra-audience", "minio"},
+			wantSPIFFEID: "spiffe://example.org/db/primary",
+		},
+		{
+			name:    "extra audience not issued",
+			args:    []string{"--spiffe-id", "spiffe://example.org/workload", "--extra-audience", "minio"},
+			wantErr: "no identity issued",
+		},
+		{
+			name:    "spiffe id not issued",
+			args:    []string{"--spiffe-id", "spiffe://example.org/web"},
+			wantErr: "no identity issued",
+		},
+		{
+			name: "no match",
+			args: []string{"--spiffe-id", "spiffe://example.org/web/*"},
+			wantErr: `no JWT SVID matches SPIFFE ID "spiffe://example.org/web/*", available SVIDs: [` +
+				`spiffe://example.org/workload (hint "internal"), ` +
+				`spiffe://example.org/db/primary (hint "primary"), ` +
+				`spiffe://example.org/db/replica (hint "replica")]`,
+		},
+		{
+			name:    "invalid spiffe id",
+			args:    []string{"--spiffe-id", "example.org/web"},
+			wantErr: `invalid SPIFFE ID "example.org/web"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			credFile := filepath.Join(t.TempDir(), "aws-credentials")
+
+			rootCmd, err := cli.NewRootCmd("test")
+			require.NoError(t, err)
+			rootCmd.SetArgs(append([]string{
+				"jwt-credential-file-oneshot",
+				"--workload-api-addr", spiffeAddr,
+				"--audience", audience,
+				"--endpoint", awsSrv.URL,
+				"--aws-credentials-path", credFile,
+				"--aws-credentials-metadata",
+				"--replace",
+			}, tt.args...))
+			err = rootCmd.Execute()
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			f, err := ini.Load(credFile)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantSPIFFEID, f.Section("default").Key("x_spiffe_id").String())
+		})
+	}
+}
+
+func TestJWTCredentialFile(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		JWTResponse: ca.CreateJWTSVIDResponse(t, audience),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{})
+
+	credFile := filepath.Join(t.TempDir(), "aws-credentials")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	rootCmd.SetArgs([]string{
+		"jwt-credential-file",
+		"--workload-api-addr", spiffeAddr,
+		"--audience", audience,
+		"--endpoint", awsSrv.URL,
+		"--aws-credentials-path", credFile,
+		"--replace",
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- rootCmd.ExecuteContext(ctx)
+	}()
+
+	// Wait for the credential file to appear with valid content.
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(credFile)
+		return err == nil
+	}, 15*time.Second, 100*time.Millisecond, "credential file never appeared")
+
+	f, err := ini.Load(credFile)
+	require.NoError(t, err)
+	sec := f.Section("default")
+	assert.Equal(t, fakeawsapi.AccessKeyID, sec.Key("aws_access_key_id").String())
+	assert.Equal(t, fakeawsapi.SecretAccessKey, sec.Key("aws_secret_access_key").String())
+	assert.Equal(t, fakeawsapi.SessionToken, sec.Key("aws_session_token").String())
+
+	// Stop the daemon.
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+func TestJWTCredentialFile_Retry(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		JWTResponse: ca.CreateJWTSVIDResponse(t, audience),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		STSErrors: []fakeawsapi.STSError{
+			{StatusCode: http.StatusServiceUnavailable, Code: "ServiceUnavailable", Message: "Service unavailable"},
+			{StatusCode: http.StatusBadRequest, Code: "Throttling", Message: "Rate exceeded"},
+		},
+	})
+
+	credFile := filepath.Join(t.TempDir(), "aws-credentials")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	rootCmd.SetArgs([]string{
+		"jwt-credential-file",
+		"--workload-api-addr", spiffeAddr,
+		"--audience", audience,
+		"--endpoint", awsSrv.URL,
+		"--aws-credentials-path", credFile,
+		"--replace",
+		"--retry-initial-backoff", "10ms",
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- rootCmd.ExecuteContext(ctx)
+	}()
+
+	// The transient failures should be retried until the exchange succeeds.
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(credFile)
+		return err == nil
+	}, 15*time.Second, 100*time.Millisecond, "credential file never appeared")
+
+	f, err := ini.Load(credFile)
+	require.NoError(t, err)
+	assert.Equal(t, fakeawsapi.AccessKeyID, f.Section("default").Key("aws_access_key_id").String())
+
+	// Stop the daemon.
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+func TestJWTCredentialFile_FatalError(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		JWTResponse: ca.CreateJWTSVIDResponse(t, audience),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		STSErrors: []fakeawsapi.STSError{
+			{StatusCode: http.StatusForbidden, Code: "AccessDenied", Message: "Not authorized to perform sts:AssumeRoleWithWebIdentity"},
+		},
+	})
+
+	credFile := filepath.Join(t.TempDir(), "aws-credentials")
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	rootCmd.SetArgs([]string{
+		"jwt-credential-file",
+		"--workload-api-addr", spiffeAddr,
+		"--audience", audience,
+		"--endpoint", awsSrv.URL,
+		"--aws-credentials-path", credFile,
+		"--replace",
+		"--retry-initial-backoff", "10ms",
+	})
+
+	// Access being denied cannot be resolved by retrying, so the daemon
+	// should exit without writing credentials.
+	err = rootCmd.ExecuteContext(context.Background())
+	require.ErrorContains(t, err, "AccessDenied")
+	assert.NoFileExists(t, credFile)
+}
+
+func TestMultiCredentialFile(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		X509Response: ca.CreateX509SVIDResponse(t),
+		JWTResponse:  ca.CreateJWTSVIDResponse(t, audience),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		CACert: ca.CACert,
+		RolesAnywhere: &fakeawsapi.RolesAnywhereExpectations{
+			RoleARN:        testRoleARN,
+			ProfileARN:     testProfileARN,
+			TrustAnchorARN: testTrustAnchorARN,
+		},
+	})
+
+	dir := t.TempDir()
+	credFile := filepath.Join(dir, "aws-credentials")
+	otherCredFile := filepath.Join(dir, "other-aws-credentials")
+	profilesFile := filepath.Join(dir, "profiles.yaml")
+	profiles := fmt.Sprintf(`
+workload_api_addr: %[1]s
+aws_credentials_path: %[2]s
+profiles:
+  - name: x509-profile
+    type: x509
+    role_arn: %[3]s
+    profile_arn: %[4]s
+    trust_anchor_arn: %[5]s
+    region: us-east-1
+    endpoint: %[6]s
+  - name: jwt-profile
+    type: jwt
+    audience: %[7]s
+    endpoint: %[6]s
+    aws_credentials_metadata: true
+  # This profile cannot reach its endpoint, and should not prevent the
+  # others from being written.
+  - name: broken-profile
+    type: jwt
+    audience: %[7]s
+    endpoint: http://127.0.0.1:1
+  # The SVID has no hint, so the role session name renders empty, which
+  # retrying cannot resolve.
+  - name: fatal-profile
+    type: x509
+    role_arn: %[3]s
+    profile_arn: %[4]s
+    trust_anchor_arn: %[5]s
+    region: us-east-1
+    endpoint: %[6]s
+    role_session_name: "{{.Hint}}"
+  # Profiles in different files may share a name.
+  - name: x509-profile
+    type: x509
+    aws_credentials_path: %[8]s
+    aws_credentials_mode: "0640"
+    role_arn: %[3]s
+    profile_arn: %[4]s
+    trust_anchor_arn: %[5]s
+    region: us-east-1
+    endpoint: %[6]s
+`, spiffeAddr, credFile, testRoleARN, testProfileARN, testTrustAnchorARN, awsSrv.URL, audience, otherCredFile)
+	require.NoError(t, os.WriteFile(profilesFile, []byte(profiles), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	metricsAddr := freeAddr(t)
+	rootCmd.SetArgs([]string{
+		"multi-credential-file",
+		"--profiles-file", profilesFile,
+		"--metrics-addr", metricsAddr,
+		"--health-addr", metricsAddr,
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- rootCmd.ExecuteContext(ctx)
+	}()
+
+	// Wait for both working profiles to be written.
+	require.Eventually(t, func() bool {
+		f, err := ini.Load(credFile)
+		if err != nil {
+			return false
+		}
+		other, err := ini.Load(otherCredFile)
+		if err != nil {
+			return false
+		}
+		return f.HasSection("x509-profile") && f.HasSection("jwt-profile") && other.HasSection("x509-profile")
+	}, 15*time.Second, 100*time.Millisecond, "profiles never appeared in credential file")
+
+	f, err := ini.Load(credFile)
+	require.NoError(t, err)
+	for _, name := range []string{"x509-profile", "jwt-profile"} {
+		sec := f.Section(name)
+		assert.Equal(t, fakeawsapi.AccessKeyID, sec.Key("aws_access_key_id").String())
+		assert.Equal(t, fakeawsapi.SecretAccessKey, sec.Key("aws_secret_access_key").String())
+		assert.Equal(t, fakeawsapi.SessionToken, sec.Key("aws_session_token").String())
+	}
+	assert.False(t, f.HasSection("broken-profile"))
+	assert.False(t, f.HasSection("fatal-profile"))
+	// Only the jwt profile asked for metadata.
+	assert.Equal(t, "aws-spiffe-workload-helper", f.Section("jwt-profile").Key("x_managed_by").String())
+	assert.False(t, f.Section("x509-profile").HasKey("x_managed_by"))
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(otherCredFile)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+	}
+
+	// The metrics should reflect the successful and failed exchanges.
+	httpClient := &http.Client{}
+	var metrics string
+	require.Eventually(t, func() bool {
+		resp, err := httpClient.Get("http://" + metricsAddr + "/metrics")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return false
+		}
+		metrics = string(b)
+		return strings.Contains(metrics, `aws_spiffe_workload_helper_exchange_failures_total{class="aws_exchange",path="`+credFile+`",profile="broken-profile",source="jwt"}`)
+	}, 15*time.Second, 100*time.Millisecond, "metrics never reported failure of broken profile")
+	assert.Contains(t, metrics, `aws_spiffe_workload_helper_exchange_successes_total{path="`+credFile+`",profile="x509-profile",source="x509"} 1`)
+	assert.Contains(t, metrics, `aws_spiffe_workload_helper_exchange_successes_total{path="`+credFile+`",profile="jwt-profile",source="jwt"} 1`)
+	assert.Contains(t, metrics, `aws_spiffe_workload_helper_aws_credentials_expiry_timestamp_seconds{path="`+credFile+`",profile="x509-profile",source="x509"}`)
+	assert.Contains(t, metrics, `aws_spiffe_workload_helper_svid_expiry_timestamp_seconds{path="`+credFile+`",profile="jwt-profile",source="jwt"}`)
+	assert.Contains(t, metrics, `aws_spiffe_workload_helper_credentials_file_write_failures_total{path="`+credFile+`",profile="x509-profile",source="x509"} 0`)
+	assert.Contains(t, metrics, `aws_spiffe_workload_helper_exchange_duration_seconds_count{path="`+credFile+`",profile="x509-profile",source="x509"} 1`)
+	assert.Contains(t, metrics, `aws_spiffe_workload_helper_exchange_successes_total{path="`+otherCredFile+`",profile="x509-profile",source="x509"} 1`)
+
+	// The health checks share the metrics server. The daemon is live, but not
+	// ready, as the broken profile has never written credentials.
+	assert.Equal(t, http.StatusOK, getStatusCode(t, httpClient, "http://"+metricsAddr+"/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, getStatusCode(t, httpClient, "http://"+metricsAddr+"/readyz"))
+	var status map[string]any
+	var profileStatus map[string]map[string]any
+	require.Eventually(t, func() bool {
+		status = getHealthStatus(t, httpClient, metricsAddr)
+		profileStatus = map[string]map[string]any{}
+		for _, p := range status["profiles"].([]any) {
+			p := p.(map[string]any)
+			profileStatus[p["path"].(string)+":"+p["profile"].(string)] = p
+		}
+		return profileStatus[credFile+":fatal-profile"]["last_error"] != nil
+	}, 15*time.Second, 100*time.Millisecond, "fatal profile never reported its error")
+	assert.Equal(t, false, status["ready"])
+	require.Len(t, profileStatus, 5)
+	assert.Equal(t, true, profileStatus[credFile+":x509-profile"]["ready"])
+	assert.Equal(t, true, profileStatus[credFile+":jwt-profile"]["ready"])
+	assert.Equal(t, true, profileStatus[otherCredFile+":x509-profile"]["ready"])
+	assert.Equal(t, false, profileStatus[credFile+":broken-profile"]["ready"])
+	assert.Contains(t, profileStatus[credFile+":broken-profile"]["last_error"], "127.0.0.1:1")
+	assert.Equal(t, false, profileStatus[credFile+":fatal-profile"]["ready"])
+	assert.Contains(t, profileStatus[credFile+":fatal-profile"]["problem"], "cannot be resolved by retrying")
+	assert.Contains(t, profileStatus[credFile+":fatal-profile"]["last_error"], "shorter than 2 characters")
+	// Idle connections would otherwise delay the shutdown of the server.
+	httpClient.CloseIdleConnections()
+
+	// Stop the daemon.
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+// getStatusCode makes a GET request to url and returns the status code of the
+// response.
+func getStatusCode(t *testing.T, client *http.Client, url string) int {
+	t.Helper()
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	return resp.StatusCode
+}
+
+// getHealthStatus returns the document served by the /status endpoint of a
+// long-running command.
+func getHealthStatus(t *testing.T, client *http.Client, addr string) map[string]any {
+	t.Helper()
+	resp, err := client.Get("http://" + addr + "/status")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	status := map[string]any{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	return status
+}
+
+// freeAddr returns a loopback address with a port that is currently free.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	require.NoError(t, lis.Close())
+	return addr
+}
+
+func TestIMDSServer(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		X509Response: ca.CreateX509SVIDResponse(t),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{
+		CACert: ca.CACert,
+		RolesAnywhere: &fakeawsapi.RolesAnywhereExpectations{
+			RoleARN:        testRoleARN,
+			ProfileARN:     testProfileARN,
+			TrustAnchorARN: testTrustAnchorARN,
+		},
+	})
+
+	listenAddr := freeAddr(t)
+	baseURL := "http://" + listenAddr
+	httpClient := &http.Client{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	rootCmd.SetArgs([]string{
+		"imds-server",
+		"x509",
+		"--listen-addr", listenAddr,
+		"--role-name", "my-role",
+		"--workload-api-addr", spiffeAddr,
+		"--role-arn", testRoleARN,
+		"--profile-arn", testProfileARN,
+		"--trust-anchor-arn", testTrustAnchorARN,
+		"--region", "us-east-1",
+		"--endpoint", awsSrv.URL,
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- rootCmd.ExecuteContext(ctx)
+	}()
+
+	// Obtain an IMDSv2 session token once the server is listening.
+	var token string
+	var tokenConnClosed bool
+	require.Eventually(t, func() bool {
+		req, err := http.NewRequest(http.MethodPut, baseURL+"/latest/api/token", nil)
+		if err != nil {
+			return false
+		}
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return false
+		}
+		token = string(body)
+		tokenConnClosed = resp.Close
+		return true
+	}, 15*time.Second, 100*time.Millisecond, "server never started")
+	require.NotEmpty(t, token)
+	// The connection is not reused, as it carries the hop limit.
+	assert.True(t, tokenConnClosed)
+
+	get := func(path, token string) (int, []byte) {
+		req, err := http.NewRequest(http.MethodGet, baseURL+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+		resp, err := httpClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, body
+	}
+
+	// IMDSv1 requests are rejected by default.
+	status, _ := get("/latest/meta-data/iam/security-credentials/", "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = get("/latest/meta-data/iam/security-credentials/", "not-a-token")
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, body := get("/latest/meta-data/iam/security-credentials/", token)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "my-role", string(body))
+
+	status, _ = get("/latest/meta-data/iam/security-credentials/other-role", token)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, body = get("/latest/meta-data/iam/security-credentials/my-role", token)
+	require.Equal(t, http.StatusOK, status)
+	var creds struct {
+		Code            string
+		Type            string
+		AccessKeyId     string
+		SecretAccessKey string
+		Token           string
+		Expiration      string
+	}
+	require.NoError(t, json.Unmarshal(body, &creds))
+	assert.Equal(t, "Success", creds.Code)
+	assert.Equal(t, "AWS-HMAC", creds.Type)
+	assert.Equal(t, fakeawsapi.AccessKeyID, creds.AccessKeyId)
+	assert.Equal(t, fakeawsapi.SecretAccessKey, creds.SecretAccessKey)
+	assert.Equal(t, fakeawsapi.SessionToken, creds.Token)
+	assert.NotEmpty(t, creds.Expiration)
+
+	// Stop the server.
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+func TestContainerCredentialsServer(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		JWTResponse: ca.CreateJWTSVIDResponse(t, audience),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{})
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("my-token\n"), 0600))
+
+	listenAddr := freeAddr(t)
+	credentialsURL := "http://" + listenAddr + "/v1/credentials"
+	httpClient := &http.Client{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	rootCmd.SetArgs([]string{
+		"container-credentials-server",
+		"jwt",
+		"--listen-addr", listenAddr,
+		"--authorization-token-file", tokenFile,
+		"--workload-api-addr", spiffeAddr,
+		"--audience", audience,
+		"--endpoint", awsSrv.URL,
+		"--role-arn", testRoleARN,
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- rootCmd.ExecuteContext(ctx)
+	}()
+
+	get := func(token string) (*http.Response, []byte, error) {
+		req, err := http.NewRequest(http.MethodGet, credentialsURL, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp, body, err
+	}
+
+	var body []byte
+	require.Eventually(t, func() bool {
+		resp, b, err := get("my-token")
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return false
+		}
+		body = b
+		return true
+	}, 15*time.Second, 100*time.Millisecond, "server never served credentials")
+
+	var creds struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		Token           string
+		Expiration      string
+		AccountId       string
+	}
+	require.NoError(t, json.Unmarshal(body, &creds))
+	assert.Equal(t, fakeawsapi.AccessKeyID, creds.AccessKeyId)
+	assert.Equal(t, fakeawsapi.SecretAccessKey, creds.SecretAccessKey)
+	assert.Equal(t, fakeawsapi.SessionToken, creds.Token)
+	assert.NotEmpty(t, creds.Expiration)
+	assert.Equal(t, "123456789012", creds.AccountId)
+
+	resp, _, err := get("")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, _, err = get("wrong-token")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Stop the server.
+	cancel()
+	require.NoError(t, <-errCh)
+}
+
+func TestSigningProxy(t *testing.T) {
+	ca := fakespiffeapi.NewCA(t)
+	audience := "sts.amazonaws.com"
+	spiffeAddr := fakespiffeapi.Start(t, fakespiffeapi.Config{
+		JWTResponse: ca.CreateJWTSVIDResponse(t, audience),
+	})
+	awsSrv := fakeawsapi.Start(t, fakeawsapi.Config{})
+
+	type upstreamRequest struct {
+		host   string
+		path   string
+		header http.Header
+		body   string
+	}
+	upstreamCh := make(chan upstreamRequest, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading upstream request body: %v", err)
+		}
+		upstreamCh <- upstreamRequest{
+			host:   r.Host,
+			path:   r.URL.Path,
+			header: r.Header.Clone(),
+			body:   string(body),
+		}
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte("accepted"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	listenAddr := freeAddr(t)
+	httpClient := &http.Client{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rootCmd, err := cli.NewRootCmd("test")
+	require.NoError(t, err)
+	rootCmd.SetArgs([]string{
+		"signing-proxy",
+		"jwt",
+		"--listen-addr", listenAddr,
+		"--upstream", upstream.URL + "/workspaces/ws-1",
+		"--signing-service", "aps",
+		"--signing-region", "us-east-1",
+		"--host", "aps-workspaces.us-east-1.amazonaws.com",
+		"--allow-header", "content-type",
+		"--allow-header", "Content-Encoding",
+		"--max-body-size", "16",
+		"--workload-api-addr", spiffeAddr,
+		"--audience", audience,
+		"--endpoint", awsSrv.URL,
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- rootCmd.ExecuteContext(ctx)
+	}()
+
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		req, err := http.NewRequest(
+			http.MethodPost,
+			"http://"+listenAddr+"/api/v1/remote_write",
+			strings.NewReader("payload"),
+		)
+		if err != nil {
+			return false
+		}
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Not-Allowed", "secret")
+		req.Header.Set("Authorization", "Bearer should-be-replaced")
+		resp, err = httpClient.Do(req)
+		return err == nil
+	}, 15*time.Second, 100*time.Millisecond, "proxy never became available")
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "accepted", string(body))
+
+	got := <-upstreamCh
+	assert.Equal(t, "aps-workspaces.us-east-1.amazonaws.com", got.host)
+	assert.Equal(t, "/workspaces/ws-1/api/v1/remote_write", got.path)
+	assert.Equal(t, "payload", got.body)
+	assert.Equal(t, "application/x-protobuf", got.header.Get("Content-Type"))
+	assert.Equal(t, "snappy", got.header.Get("Content-Encoding"))
+	assert.Empty(t, got.header.Get("X-Not-Allowed"))
+	assert.True(t, strings.HasPrefix(
+		got.header.Get("Authorization"),
+		"AWS4-HMAC-SHA256 Credential="+fakeawsapi.AccessKeyID+"/",
+	), "unexpected Authorization header %q", got.header.Get("Authorization"))
+	assert.Contains(t, got.header.Get("Authorization"), "/us-east-1/aps/aws4_request")
+	assert.Equal(t, fakeawsapi.SessionToken, got.header.Get("X-Amz-Security-Token"))
+	assert.NotEmpty(t, got.header.Get("X-Amz-Date"))
+
+	// Bodies larger than the maximum are rejected without being forwarded.
+	resp, err = httpClient.Post(
+		"http://"+listenAddr+"/api/v1/remote_write",
+		"application/x-protobuf",
+		strings.NewReader("a payload which is too large"),
+	)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Empty(t, upstreamCh)
+
+	// An empty chunked body is forwarded as an empty body.
+	conn, err := net.Dial("tcp", listenAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST /api/v1/remote_write HTTP/1.1\r\nHost: " + listenAddr + "\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	got = <-upstreamCh
+	assert.Empty(t, got.body)
+
+	// Stop the proxy.
+	cancel()
+	require.NoError(t, <-errCh)
+}
@@ -6,12 +6,15 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -21,6 +24,13 @@ const (
 	AccessKeyID     = "ASIATESTCREDENTIAL"
 	SecretAccessKey = "fake-secret-access-key"
 	SessionToken    = "fake-session-token"
+
+	// Canned credential values returned by the fake STS AssumeRole API, so
+	// that tests can distinguish chained credentials from those obtained by
+	// exchanging an SVID.
+	ChainedAccessKeyID     = "ASIATESTCHAINED"
+	ChainedSecretAccessKey = "fake-chained-secret-access-key"
+	ChainedSessionToken    = "fake-chained-session-token"
 )
 
 // Expiration returns a fixed expiration time for the canned credentials.
@@ -35,6 +45,48 @@ type RolesAnywhereExpectations struct {
 	RoleARN        string
 	ProfileARN     string
 	TrustAnchorARN string
+	// RoleSessionName is the expected roleSessionName in the request body.
+	RoleSessionName string
+}
+
+// AssumeRoleExpectations holds expected values for STS AssumeRole request
+// validation. When set, the handler asserts that the request carries these
+// exact values.
+type AssumeRoleExpectations struct {
+	RoleARN         string
+	ExternalID      string
+	RoleSessionName string
+	SourceIdentity  string
+	// Tags are the expected session tags, keyed by tag key.
+	Tags map[string]string
+	// Region is the region the request is expected to be signed for.
+	Region string
+}
+
+// WebIdentityExpectations holds expected values for STS
+// AssumeRoleWithWebIdentity request validation. When set, the handler asserts
+// that the request carries these exact values.
+type WebIdentityExpectations struct {
+	RoleARN         string
+	RoleSessionName string
+	Policy          string
+	PolicyARNs      []string
+	ProviderID      string
+}
+
+// STSError is an error response returned by the fake STS API.
+type STSError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+// RolesAnywhereError is an error response returned by the fake Roles Anywhere
+// API.
+type RolesAnywhereError struct {
+	StatusCode int
+	Code       string
+	Message    string
 }
 
 // Config configures the fake AWS API server.
@@ -45,11 +97,25 @@ type Config struct {
 	// RolesAnywhere holds expected values for Roles Anywhere request
 	// validation. If nil, ARN query parameters are not checked.
 	RolesAnywhere *RolesAnywhereExpectations
+	// AssumeRole holds expected values for STS AssumeRole request
+	// validation. If nil, the request parameters are not checked.
+	AssumeRole *AssumeRoleExpectations
+	// WebIdentity holds expected values for STS AssumeRoleWithWebIdentity
+	// request validation. If nil, the request parameters are not checked.
+	WebIdentity *WebIdentityExpectations
+	// STSErrors are returned, in order, in response to the first
+	// AssumeRoleWithWebIdentity requests. Once exhausted, requests succeed.
+	STSErrors []STSError
+	// RolesAnywhereErrors are returned, in order, in response to the first
+	// CreateSession requests which pass signature verification. Once
+	// exhausted, requests succeed.
+	RolesAnywhereErrors []RolesAnywhereError
 }
 
 // Start creates a fake AWS API HTTP server that handles both:
 //   - Roles Anywhere CreateSession (POST /sessions)
-//   - STS AssumeRoleWithWebIdentity (POST / with Action query param)
+//   - STS AssumeRoleWithWebIdentity (POST / with Action form param)
+//   - STS AssumeRole (POST / with Action form param)
 //
 // For Roles Anywhere requests, the server performs full SigV4-X509 signature
 // verification using the CA certificate from cfg as the trust anchor. This
@@ -62,24 +128,56 @@ func Start(t *testing.T, cfg Config) *httptest.Server {
 
 	expiration := Expiration()
 
+	var stsErrorsMu sync.Mutex
+	stsErrors := cfg.STSErrors
+	var rolesAnywhereErrorsMu sync.Mutex
+	rolesAnywhereErrors := cfg.RolesAnywhereErrors
+	nextRolesAnywhereError := func() *RolesAnywhereError {
+		rolesAnywhereErrorsMu.Lock()
+		defer rolesAnywhereErrorsMu.Unlock()
+		var raErr *RolesAnywhereError
+		if len(rolesAnywhereErrors) > 0 {
+			raErr, rolesAnywhereErrors = &rolesAnywhereErrors[0], rolesAnywhereErrors[1:]
+		}
+		return raErr
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
-		rolesAnywhereHandler(t, w, r, expiration, cfg)
+		rolesAnywhereHandler(t, w, r, expiration, cfg, nextRolesAnywhereError)
 	})
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Query().Get("Action") == "AssumeRoleWithWebIdentity" {
-			stsHandler(t, w, r, expiration)
-			return
+		switch r.FormValue("Action") {
+		case "AssumeRoleWithWebIdentity":
+			stsErrorsMu.Lock()
+			var stsErr *STSError
+			if len(stsErrors) > 0 {
+				stsErr, stsErrors = &stsErrors[0], stsErrors[1:]
+			}
+			stsErrorsMu.Unlock()
+			if stsErr != nil {
+				stsErrorHandler(w, *stsErr)
+				return
+			}
+			stsHandler(t, w, r, expiration, cfg)
+		case "AssumeRole":
+			assumeRoleHandler(t, w, r, expiration, cfg)
+		default:
+			http.NotFound(w, r)
 		}
-		http.NotFound(w, r)
 	})
 
-	srv := httptest.NewServer(mux)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ua := r.Header.Get("User-Agent"); !strings.HasPrefix(ua, "aws-spiffe-workload-helper ") {
+			t.Errorf("User-Agent = %q, want aws-spiffe-workload-helper", ua)
+		}
+		mux.ServeHTTP(w, r)
+	}))
 	t.Cleanup(srv.Close)
 	return srv
 }
 
-func rolesAnywhereHandler(t *testing.T, w http.ResponseWriter, r *http.Request, expiration string, cfg Config) {
+func rolesAnywhereHandler(t *testing.T, w http.ResponseWriter, r *http.Request, expiration string, cfg Config, nextError func() *RolesAnywhereError) {
 	t.Helper()
 
 	// Read the body so we can compute its hash for signature verification.
@@ -97,8 +195,8 @@ func rolesAnywhereHandler(t *testing.T, w http.ResponseWriter, r *http.Request,
 	}
 
 	// Validate that the expected ARNs were sent as query parameters.
-	// The AWS SDK sends profileArn, roleArn, and trustAnchorArn as
-	// querystring parameters per the CreateSessionInput struct.
+	// CreateSession takes profileArn, roleArn, and trustAnchorArn as
+	// querystring parameters.
 	if exp := cfg.RolesAnywhere; exp != nil {
 		q := r.URL.Query()
 		if got := q.Get("roleArn"); got != exp.RoleARN {
@@ -110,6 +208,20 @@ func rolesAnywhereHandler(t *testing.T, w http.ResponseWriter, r *http.Request,
 		if got := q.Get("trustAnchorArn"); got != exp.TrustAnchorARN {
 			t.Errorf("Roles Anywhere: trustAnchorArn = %q, want %q", got, exp.TrustAnchorARN)
 		}
+		var body struct {
+			RoleSessionName string `json:"roleSessionName"`
+		}
+		if err := json.Unmarshal(bodyBytes, &body); err != nil {
+			t.Errorf("Roles Anywhere: parsing request body: %v", err)
+		}
+		if body.RoleSessionName != exp.RoleSessionName {
+			t.Errorf("Roles Anywhere: roleSessionName = %q, want %q", body.RoleSessionName, exp.RoleSessionName)
+		}
+	}
+
+	if raErr := nextError(); raErr != nil {
+		rolesAnywhereErrorHandler(w, *raErr)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -130,16 +242,46 @@ func rolesAnywhereHandler(t *testing.T, w http.ResponseWriter, r *http.Request,
 }`, AccessKeyID, SecretAccessKey, SessionToken, expiration)
 }
 
-func stsHandler(t *testing.T, w http.ResponseWriter, r *http.Request, expiration string) {
+func stsHandler(t *testing.T, w http.ResponseWriter, r *http.Request, expiration string, cfg Config) {
 	t.Helper()
 
 	if r.Method != http.MethodPost {
 		t.Errorf("STS: expected POST, got %s", r.Method)
 	}
 
-	token := r.URL.Query().Get("WebIdentityToken")
+	// The token must be sent in the body, so that it is not recorded in
+	// access logs.
+	if r.URL.Query().Has("WebIdentityToken") {
+		t.Errorf("STS: WebIdentityToken sent as a query parameter")
+	}
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/x-www-form-urlencoded") {
+		t.Errorf("STS: Content-Type = %q, want application/x-www-form-urlencoded", ct)
+	}
+	token := r.PostFormValue("WebIdentityToken")
 	if token == "" {
-		t.Errorf("STS: missing WebIdentityToken query parameter")
+		t.Errorf("STS: missing WebIdentityToken form parameter")
+	}
+
+	if exp := cfg.WebIdentity; exp != nil {
+		if got := r.PostFormValue("RoleArn"); got != exp.RoleARN {
+			t.Errorf("STS: RoleArn = %q, want %q", got, exp.RoleARN)
+		}
+		if got := r.PostFormValue("RoleSessionName"); got != exp.RoleSessionName {
+			t.Errorf("STS: RoleSessionName = %q, want %q", got, exp.RoleSessionName)
+		}
+		if got := r.PostFormValue("Policy"); got != exp.Policy {
+			t.Errorf("STS: Policy = %q, want %q", got, exp.Policy)
+		}
+		var policyARNs []string
+		for i := 1; r.PostFormValue(fmt.Sprintf("PolicyArns.member.%d.arn", i)) != ""; i++ {
+			policyARNs = append(policyARNs, r.PostFormValue(fmt.Sprintf("PolicyArns.member.%d.arn", i)))
+		}
+		if !slices.Equal(policyARNs, exp.PolicyARNs) {
+			t.Errorf("STS: PolicyArns = %v, want %v", policyARNs, exp.PolicyARNs)
+		}
+		if got := r.PostFormValue("ProviderId"); got != exp.ProviderID {
+			t.Errorf("STS: ProviderId = %q, want %q", got, exp.ProviderID)
+		}
 	}
 
 	w.Header().Set("Content-Type", "text/xml")
@@ -160,6 +302,89 @@ func stsHandler(t *testing.T, w http.ResponseWriter, r *http.Request, expiration
 </AssumeRoleWithWebIdentityResponse>`, AccessKeyID, SecretAccessKey, SessionToken, expiration)
 }
 
+func stsErrorHandler(w http.ResponseWriter, stsErr STSError) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(stsErr.StatusCode)
+	fmt.Fprintf(w, `<ErrorResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <Error>
+    <Type>Sender</Type>
+    <Code>%s</Code>
+    <Message>%s</Message>
+  </Error>
+  <RequestId>fake-request-id</RequestId>
+</ErrorResponse>`, stsErr.Code, stsErr.Message)
+}
+
+func rolesAnywhereErrorHandler(w http.ResponseWriter, raErr RolesAnywhereError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Amzn-Errortype", raErr.Code+":http://internal.amazon.com/coral/com.amazonaws.rolesanywhere/")
+	w.Header().Set("X-Amzn-Requestid", "fake-request-id")
+	w.WriteHeader(raErr.StatusCode)
+	fmt.Fprintf(w, `{"message": %q}`, raErr.Message)
+}
+
+func assumeRoleHandler(t *testing.T, w http.ResponseWriter, r *http.Request, expiration string, cfg Config) {
+	t.Helper()
+
+	if r.Method != http.MethodPost {
+		t.Errorf("STS: expected POST, got %s", r.Method)
+	}
+
+	// AssumeRole is signed with SigV4 using the credentials obtained by
+	// exchanging the SVID.
+	if auth := r.Header.Get("Authorization"); !strings.Contains(auth, "Credential="+AccessKeyID+"/") {
+		t.Errorf("STS: AssumeRole not signed with exchanged credentials: %q", auth)
+	}
+
+	if exp := cfg.AssumeRole; exp != nil {
+		if got := r.PostFormValue("RoleArn"); got != exp.RoleARN {
+			t.Errorf("STS: RoleArn = %q, want %q", got, exp.RoleARN)
+		}
+		if got := r.PostFormValue("ExternalId"); got != exp.ExternalID {
+			t.Errorf("STS: ExternalId = %q, want %q", got, exp.ExternalID)
+		}
+		if got := r.PostFormValue("RoleSessionName"); got != exp.RoleSessionName {
+			t.Errorf("STS: RoleSessionName = %q, want %q", got, exp.RoleSessionName)
+		}
+		if got := r.PostFormValue("SourceIdentity"); got != exp.SourceIdentity {
+			t.Errorf("STS: SourceIdentity = %q, want %q", got, exp.SourceIdentity)
+		}
+		if exp.Region != "" && !strings.Contains(r.Header.Get("Authorization"), "/"+exp.Region+"/sts/aws4_request") {
+			t.Errorf("STS: AssumeRole not signed for region %q: %q", exp.Region, r.Header.Get("Authorization"))
+		}
+		tags := map[string]string{}
+		for i := 1; r.PostFormValue(fmt.Sprintf("Tags.member.%d.Key", i)) != ""; i++ {
+			tags[r.PostFormValue(fmt.Sprintf("Tags.member.%d.Key", i))] = r.PostFormValue(fmt.Sprintf("Tags.member.%d.Value", i))
+		}
+		if len(tags) != len(exp.Tags) {
+			t.Errorf("STS: Tags = %v, want %v", tags, exp.Tags)
+		}
+		for k, v := range exp.Tags {
+			if tags[k] != v {
+				t.Errorf("STS: Tags = %v, want %v", tags, exp.Tags)
+				break
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::210987654321:assumed-role/chained-role/session</Arn>
+      <AssumedRoleId>AROA3XFRBF24:session</AssumedRoleId>
+    </AssumedRoleUser>
+    <Credentials>
+      <AccessKeyId>%s</AccessKeyId>
+      <SecretAccessKey>%s</SecretAccessKey>
+      <SessionToken>%s</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+  <ResponseMetadata/>
+</AssumeRoleResponse>`, ChainedAccessKeyID, ChainedSecretAccessKey, ChainedSessionToken, expiration)
+}
+
 // authHeader holds parsed components of a SigV4-X509 Authorization header.
 type authHeader struct {
 	algorithm     string
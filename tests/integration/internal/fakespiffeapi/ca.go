@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
 	"math/big"
 	"net/url"
 	"testing"
@@ -19,6 +20,7 @@ import (
 const (
 	trustDomain = "example.org"
 	spiffeID    = "spiffe://example.org/workload"
+	jwtKeyID    = "jwt-key"
 )
 
 // CA is a test certificate authority that generates X.509 and JWT SVIDs.
@@ -81,19 +83,32 @@ func NewCA(t *testing.T) *CA {
 // certificate signed by the CA.
 func (ca *CA) CreateX509SVIDResponse(t *testing.T) *workload.X509SVIDResponse {
 	t.Helper()
+	return &workload.X509SVIDResponse{
+		Svids: []*workload.X509SVID{ca.CreateX509SVID(t, spiffeID, "")},
+	}
+}
+
+// CreateX509SVID creates a workload API X509SVID for the given SPIFFE ID and
+// hint, with a leaf certificate signed by the CA.
+func (ca *CA) CreateX509SVID(t *testing.T, id, hint string) *workload.X509SVID {
+	t.Helper()
 
 	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		t.Fatalf("generating leaf key: %v", err)
 	}
 
-	spiffeURI, err := url.Parse(spiffeID)
+	spiffeURI, err := url.Parse(id)
 	if err != nil {
 		t.Fatalf("parsing SPIFFE URI: %v", err)
 	}
 
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("generating serial number: %v", err)
+	}
 	leafTemplate := &x509.Certificate{
-		SerialNumber: big.NewInt(2),
+		SerialNumber: serial,
 		Subject: pkix.Name{
 			CommonName: "workload",
 		},
@@ -116,15 +131,12 @@ func (ca *CA) CreateX509SVIDResponse(t *testing.T) *workload.X509SVIDResponse {
 	// X509Svid is the concatenation of leaf + CA cert DER bytes
 	certChainDER := append(leafCertDER, ca.CACert.Raw...)
 
-	return &workload.X509SVIDResponse{
-		Svids: []*workload.X509SVID{
-			{
-				SpiffeId:    spiffeID,
-				X509Svid:    certChainDER,
-				X509SvidKey: leafKeyDER,
-				Bundle:      ca.CACert.Raw,
-			},
-		},
+	return &workload.X509SVID{
+		SpiffeId:    id,
+		X509Svid:    certChainDER,
+		X509SvidKey: leafKeyDER,
+		Bundle:      ca.CACert.Raw,
+		Hint:        hint,
 	}
 }
 
@@ -132,9 +144,18 @@ func (ca *CA) CreateX509SVIDResponse(t *testing.T) *workload.X509SVIDResponse {
 // JWT token.
 func (ca *CA) CreateJWTSVIDResponse(t *testing.T, audience string) *workload.JWTSVIDResponse {
 	t.Helper()
+	return &workload.JWTSVIDResponse{
+		Svids: []*workload.JWTSVID{ca.CreateJWTSVID(t, spiffeID, "", audience)},
+	}
+}
+
+// CreateJWTSVID creates a workload API JWTSVID for the given SPIFFE ID and
+// hint, with a JWT signed by the CA's JWT key for the given audiences.
+func (ca *CA) CreateJWTSVID(t *testing.T, id, hint string, audience ...string) *workload.JWTSVID {
+	t.Helper()
 
 	signer, err := jose.NewSigner(
-		jose.SigningKey{Algorithm: jose.ES256, Key: ca.JWTKey},
+		jose.SigningKey{Algorithm: jose.ES256, Key: jose.JSONWebKey{Key: ca.JWTKey, KeyID: jwtKeyID}},
 		(&jose.SignerOptions{}).WithType("JWT"),
 	)
 	if err != nil {
@@ -143,8 +164,8 @@ func (ca *CA) CreateJWTSVIDResponse(t *testing.T, audience string) *workload.JWT
 
 	now := time.Now()
 	claims := jwt.Claims{
-		Subject:   spiffeID,
-		Audience:  jwt.Audience{audience},
+		Subject:   id,
+		Audience:  jwt.Audience(audience),
 		Issuer:    "test-ca",
 		IssuedAt:  jwt.NewNumericDate(now),
 		Expiry:    jwt.NewNumericDate(now.Add(time.Hour)),
@@ -156,12 +177,28 @@ func (ca *CA) CreateJWTSVIDResponse(t *testing.T, audience string) *workload.JWT
 		t.Fatalf("signing JWT: %v", err)
 	}
 
-	return &workload.JWTSVIDResponse{
-		Svids: []*workload.JWTSVID{
-			{
-				SpiffeId: spiffeID,
-				Svid:     token,
-			},
+	return &workload.JWTSVID{
+		SpiffeId: id,
+		Svid:     token,
+		Hint:     hint,
+	}
+}
+
+// CreateJWTBundlesResponse creates a workload API JWTBundlesResponse holding
+// the CA's JWT key, against which the JWT SVIDs it creates can be validated.
+func (ca *CA) CreateJWTBundlesResponse(t *testing.T) *workload.JWTBundlesResponse {
+	t.Helper()
+
+	jwks, err := json.Marshal(jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{
+			{Key: &ca.JWTKey.PublicKey, KeyID: jwtKeyID, Use: "jwt-svid"},
 		},
+	})
+	if err != nil {
+		t.Fatalf("marshalling JWKS: %v", err)
+	}
+
+	return &workload.JWTBundlesResponse{
+		Bundles: map[string][]byte{trustDomain: jwks},
 	}
 }
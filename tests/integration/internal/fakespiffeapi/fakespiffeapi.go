@@ -6,8 +6,11 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
 	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -19,6 +22,15 @@ import (
 type Config struct {
 	X509Response *workload.X509SVIDResponse
 	JWTResponse  *workload.JWTSVIDResponse
+	JWTBundles   *workload.JWTBundlesResponse
+	// X509Revoked, if set, is closed to stop issuing the X509 SVID, as the
+	// Workload API does when the registration entry of the workload is
+	// deleted. Open streams then end with PermissionDenied.
+	X509Revoked <-chan struct{}
+	// X509Updates, if set, receives responses which are sent on open
+	// streams after X509Response, as the Workload API does when SVIDs are
+	// rotated.
+	X509Updates <-chan *workload.X509SVIDResponse
 }
 
 // Start creates a fake SPIFFE Workload API gRPC server listening on a Unix
@@ -46,6 +58,9 @@ func Start(t *testing.T, cfg Config) string {
 	workload.RegisterSpiffeWorkloadAPIServer(srv, &server{
 		x509Response: cfg.X509Response,
 		jwtResponse:  cfg.JWTResponse,
+		jwtBundles:   cfg.JWTBundles,
+		x509Revoked:  cfg.X509Revoked,
+		x509Updates:  cfg.X509Updates,
 	})
 
 	go func() {
@@ -62,13 +77,16 @@ type server struct {
 	workload.UnimplementedSpiffeWorkloadAPIServer
 	x509Response *workload.X509SVIDResponse
 	jwtResponse  *workload.JWTSVIDResponse
+	jwtBundles   *workload.JWTBundlesResponse
+	x509Revoked  <-chan struct{}
+	x509Updates  <-chan *workload.X509SVIDResponse
 }
 
 func (s *server) FetchX509SVID(_ *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
 	if err := checkHeader(stream.Context()); err != nil {
 		return err
 	}
-	if s.x509Response == nil {
+	if s.x509Response == nil || isClosed(s.x509Revoked) {
 		return status.Error(codes.PermissionDenied, "no identity issued")
 	}
 	if err := stream.Send(s.x509Response); err != nil {
@@ -76,18 +94,86 @@ func (s *server) FetchX509SVID(_ *workload.X509SVIDRequest, stream workload.Spif
 	}
 	// Block until the client disconnects - this is the streaming behavior
 	// the go-spiffe workloadapi client expects.
-	<-stream.Context().Done()
-	return stream.Context().Err()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-s.x509Revoked:
+			return status.Error(codes.PermissionDenied, "no identity issued")
+		case resp := <-s.x509Updates:
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		}
+	}
 }
 
-func (s *server) FetchJWTSVID(ctx context.Context, _ *workload.JWTSVIDRequest) (*workload.JWTSVIDResponse, error) {
+func (s *server) FetchJWTSVID(ctx context.Context, req *workload.JWTSVIDRequest) (*workload.JWTSVIDResponse, error) {
 	if err := checkHeader(ctx); err != nil {
 		return nil, err
 	}
 	if s.jwtResponse == nil {
 		return nil, status.Error(codes.PermissionDenied, "no identity issued")
 	}
-	return s.jwtResponse, nil
+	// The Workload API mints JWT SVIDs on request. Only the SVIDs which were
+	// created for the requested SPIFFE ID and all of the requested audiences
+	// are returned.
+	resp := &workload.JWTSVIDResponse{}
+	for _, svid := range s.jwtResponse.Svids {
+		if req.SpiffeId != "" && svid.SpiffeId != req.SpiffeId {
+			continue
+		}
+		if !hasAudiences(svid.Svid, req.Audience) {
+			continue
+		}
+		resp.Svids = append(resp.Svids, svid)
+	}
+	if len(resp.Svids) == 0 {
+		return nil, status.Error(codes.PermissionDenied, "no identity issued")
+	}
+	return resp, nil
+}
+
+func (s *server) FetchJWTBundles(_ *workload.JWTBundlesRequest, stream workload.SpiffeWorkloadAPI_FetchJWTBundlesServer) error {
+	if err := checkHeader(stream.Context()); err != nil {
+		return err
+	}
+	if s.jwtBundles == nil {
+		return status.Error(codes.PermissionDenied, "no identity issued")
+	}
+	if err := stream.Send(s.jwtBundles); err != nil {
+		return err
+	}
+	<-stream.Context().Done()
+	return stream.Context().Err()
+}
+
+// hasAudiences returns whether the token was issued for all of the audiences.
+func hasAudiences(token string, audiences []string) bool {
+	tok, err := jwt.ParseSigned(token, []jose.SignatureAlgorithm{jose.ES256})
+	if err != nil {
+		return false
+	}
+	var claims jwt.Claims
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return false
+	}
+	for _, aud := range audiences {
+		if !slices.Contains(claims.Audience, aud) {
+			return false
+		}
+	}
+	return true
+}
+
+// isClosed returns whether ch has been closed. A nil channel is never closed.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
 }
 
 func checkHeader(ctx context.Context) error {
@@ -15,7 +15,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math/big"
 	"net/http"
 	"os"
@@ -23,8 +22,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/request"
 	"golang.org/x/crypto/pkcs12"
 )
 
@@ -125,8 +122,6 @@ var ignoredHeaderKeys = map[string]bool{
 	"X-Amzn-Trace-Id": true,
 }
 
-var Debug bool = false
-
 // Find whether the current certificate matches the CertIdentifier
 func certMatches(certIdentifier CertIdentifier, cert x509.Certificate) bool {
 	if certIdentifier.Subject != "" && certIdentifier.Subject != cert.Subject.String() {
@@ -205,46 +200,40 @@ func certificateChainToString(certificateChain []*x509.Certificate) string {
 	return x509ChainString.String()
 }
 
-func CreateRequestSignFunction(signer crypto.Signer, signingAlgorithm string, certificate *x509.Certificate, certificateChain []*x509.Certificate) func(*request.Request) {
-	return func(req *request.Request) {
-		region := req.ClientInfo.SigningRegion
-		if region == "" {
-			region = aws.StringValue(req.Config.Region)
-		}
-
-		name := req.ClientInfo.SigningName
-		if name == "" {
-			name = req.ClientInfo.ServiceName
-		}
-
-		signerParams := SignerParams{time.Now(), region, name, signingAlgorithm}
-
-		// Set headers that are necessary for signing
-		req.HTTPRequest.Header.Set(host, req.HTTPRequest.URL.Host)
-		req.HTTPRequest.Header.Set(x_amz_date, signerParams.GetFormattedSigningDateTime())
-		req.HTTPRequest.Header.Set(x_amz_x509, certificateToString(certificate))
-		if certificateChain != nil {
-			req.HTTPRequest.Header.Set(x_amz_x509_chain, certificateChainToString(certificateChain))
-		}
+// SignRequest signs an HTTP request using SigV4-X509, as used by the Roles
+// Anywhere API. body must contain the body of the request, or be nil if the
+// request has no body.
+//
+// Note: This function is not part of the upstream package. It was extracted
+// from the upstream CreateRequestSignFunction so that requests can be signed
+// without using the AWS SDK.
+func SignRequest(req *http.Request, body io.ReadSeeker, signer crypto.Signer, signingAlgorithm string, region string, service string, certificate *x509.Certificate, certificateChain []*x509.Certificate) error {
+	signerParams := SignerParams{time.Now(), region, service, signingAlgorithm}
 
-		contentSha256 := calculateContentHash(req.HTTPRequest, req.Body)
-		if req.HTTPRequest.Header.Get(x_amz_content_sha256) == "required" {
-			req.HTTPRequest.Header.Set(x_amz_content_sha256, contentSha256)
-		}
+	// Set headers that are necessary for signing
+	req.Header.Set(host, req.URL.Host)
+	req.Header.Set(x_amz_date, signerParams.GetFormattedSigningDateTime())
+	req.Header.Set(x_amz_x509, certificateToString(certificate))
+	if certificateChain != nil {
+		req.Header.Set(x_amz_x509_chain, certificateChainToString(certificateChain))
+	}
 
-		canonicalRequest, signedHeadersString := createCanonicalRequest(req.HTTPRequest, req.Body, contentSha256)
+	contentSha256 := calculateContentHash(req, body)
+	if req.Header.Get(x_amz_content_sha256) == "required" {
+		req.Header.Set(x_amz_content_sha256, contentSha256)
+	}
 
-		stringToSign := CreateStringToSign(canonicalRequest, signerParams)
-		signatureBytes, err := signer.Sign(rand.Reader, []byte(stringToSign), crypto.SHA256)
-		if err != nil {
-			log.Println(err.Error())
-			os.Exit(1)
-		}
-		signature := hex.EncodeToString(signatureBytes)
+	canonicalRequest, signedHeadersString := createCanonicalRequest(req, body, contentSha256)
 
-		req.HTTPRequest.Header.Set(authorization, BuildAuthorizationHeader(req.HTTPRequest, req.Body, signedHeadersString, signature, certificate, signerParams))
-		req.SignedHeaderVals = req.HTTPRequest.Header
+	stringToSign := CreateStringToSign(canonicalRequest, signerParams)
+	signatureBytes, err := signer.Sign(rand.Reader, []byte(stringToSign), crypto.SHA256)
+	if err != nil {
+		return err
 	}
+	signature := hex.EncodeToString(signatureBytes)
+
+	req.Header.Set(authorization, BuildAuthorizationHeader(req, body, signedHeadersString, signature, certificate, signerParams))
+	return nil
 }
 
 // Find the SHA256 hash of the provided request body as a io.ReadSeeker
@@ -416,7 +405,6 @@ func encodeDer(der []byte) (string, error) {
 func parseDERFromPEM(pemDataId string, blockType string) (*pem.Block, error) {
 	bytes, err := os.ReadFile(pemDataId)
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 
@@ -437,7 +425,6 @@ func parseDERFromPEM(pemDataId string, blockType string) (*pem.Block, error) {
 func ReadCertificateBundleData(certificateBundleId string) ([]*x509.Certificate, error) {
 	bytes, err := os.ReadFile(certificateBundleId)
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 
@@ -550,9 +537,6 @@ func ReadPKCS12Data(certificateId string) (certChain []*x509.Certificate, privat
 		}
 		// If neither a certificate nor a private key could be parsed from the
 		// Block, ignore it and continue.
-		if Debug {
-			log.Println("unable to parse PEM block in PKCS#12 file - skipping")
-		}
 	}
 
 	certMap = make(map[string]*x509.Certificate)
@@ -627,8 +611,7 @@ func ReadCertificateData(certificateId string) (CertificateData, *x509.Certifica
 
 	cert, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
-		log.Println("could not parse certificate", err)
-		return CertificateData{}, nil, errors.New("could not parse certificate")
+		return CertificateData{}, nil, fmt.Errorf("could not parse certificate: %w", err)
 	}
 
 	//extract serial number